@@ -0,0 +1,340 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	_ "github.com/mattn/go-sqlite3"
+	"unicode/utf8"
+)
+
+/*
+ * アルバム単位のアクセス権.
+ *
+ * album_membersに1件も登録の無いアルバムは全ユーザーに公開され,
+ * 権限区分(role)のみで操作可否が決まる.
+ * 1件以上登録のあるアルバムは, 登録されたユーザー(またはグループの所属ユーザー)のみが参照でき,
+ * 更新にはwriteのアクセス権とeditor以上の権限区分の両方が必要.
+ * adminは全てのアルバムを操作できる.
+ */
+const (
+	accessNone  = ""
+	accessRead  = "read"
+	accessWrite = "write"
+)
+
+var errAlbumForbidden = errors.New("album access forbidden")
+
+// 参照可能なアルバムに絞り込むための条件. パラメータは(user_id, user_id)
+const albumReadableCond = `
+	(
+		NOT EXISTS (
+			SELECT 1 FROM album_members am WHERE am.album_id = albums.id
+		)
+		OR EXISTS (
+			SELECT
+				1
+			FROM
+				album_members am
+				LEFT JOIN group_members gm ON gm.group_id = am.group_id
+			WHERE
+				am.album_id = albums.id
+				AND (am.user_id = ? OR gm.user_id = ?)
+		)
+	)
+`
+
+/*
+ * ユーザーのアルバムに対するアクセス権を返す.
+ * viewerがnilの場合は内部処理からの呼び出しとして制限しない.
+ */
+func (s *Store) FindAlbumAccess(albumId int64, viewer *user) (string, error) {
+	if viewer == nil || viewer.Role == roleAdmin {
+		return accessWrite, nil
+	}
+	countQuery := `
+		SELECT
+			COUNT(*) AS count
+		FROM
+			album_members
+		WHERE
+			album_id = ?
+	`
+	query := `
+		SELECT
+			am.access AS access
+		FROM
+			album_members am
+			LEFT JOIN group_members gm ON gm.group_id = am.group_id
+		WHERE
+			am.album_id = ?
+			AND (am.user_id = ? OR gm.user_id = ?)
+	`
+	db := s.db
+
+	var count int
+	if err := db.QueryRow(countQuery, albumId).Scan(&count); err != nil {
+		return accessNone, err
+	}
+	if count == 0 {
+		return accessWrite, nil
+	}
+
+	rows, err := db.Query(query, albumId, viewer.Id, viewer.Id)
+	if err != nil {
+		return accessNone, err
+	}
+	defer rows.Close()
+
+	access := accessNone
+	for rows.Next() {
+		var a string
+		if err := rows.Scan(&a); err != nil {
+			return accessNone, err
+		}
+		if a == accessWrite {
+			access = accessWrite
+		} else if access == accessNone {
+			access = a
+		}
+	}
+	return access, nil
+}
+
+func (s *Store) canReadAlbum(albumId int64, viewer *user) (bool, error) {
+	access, err := s.FindAlbumAccess(albumId, viewer)
+	if err != nil {
+		return false, err
+	}
+	return access != accessNone, nil
+}
+
+func (s *Store) canWriteAlbum(albumId int64, viewer *user) (bool, error) {
+	if viewer != nil && !viewer.Can(permEdit) {
+		return false, nil
+	}
+	access, err := s.FindAlbumAccess(albumId, viewer)
+	if err != nil {
+		return false, err
+	}
+	return access == accessWrite, nil
+}
+
+type group struct {
+	Id   int64
+	Name string
+}
+
+func (s *Store) FindGroups() ([]*group, error) {
+	query := `
+		SELECT
+			id AS id,
+			name AS name
+		FROM
+			groups
+		ORDER BY
+			name
+	`
+	db := s.db
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ret := make([]*group, 0)
+	for rows.Next() {
+		m := &group{}
+		if err := rows.Scan(&m.Id, &m.Name); err != nil {
+			return nil, err
+		}
+		ret = append(ret, m)
+	}
+	return ret, nil
+}
+
+func (s *Store) FindGroupByName(name string) (*group, error) {
+	query := `
+		SELECT
+			id AS id
+		FROM
+			groups
+		WHERE
+			name = ?
+	`
+	db := s.db
+
+	var id int64
+	if err := db.QueryRow(query, name).Scan(&id); err != nil {
+		return nil, err
+	}
+	return &group{Id: id, Name: name}, nil
+}
+
+func (m *group) Validate() error {
+	if utf8.RuneCountInString(m.Name) == 0 {
+		return errors.New("name is nesecery.")
+	}
+	if utf8.RuneCountInString(m.Name) > 32 {
+		return errors.New("name is too long")
+	}
+	return nil
+}
+
+func (s *Store) createGroup(m *group) error {
+	query := `
+		INSERT INTO groups (name) values(?)
+	`
+	db := s.db
+
+	id, err := db.Insert(query, m.Name)
+	m.Id = id
+	return err
+}
+
+func (s *Store) updateGroup(m *group) error {
+	query := `
+		UPDATE
+			groups
+		SET
+			name = ?
+		WHERE
+			id = ?
+	`
+	db := s.db
+
+	_, err := db.Exec(query, m.Name, m.Id)
+	return err
+}
+
+func (s *Store) SaveGroup(m *group) error {
+	if err := m.Validate(); err != nil {
+		return err
+	}
+	if m.Id != 0 {
+		return s.updateGroup(m)
+	}
+	return s.createGroup(m)
+}
+
+func (s *Store) AddGroupUser(m *group, userId int64) error {
+	query := `
+		INSERT INTO group_members (group_id, user_id) values(?, ?) ON CONFLICT DO NOTHING
+	`
+	db := s.db
+
+	_, err := db.Exec(query, m.Id, userId)
+	return err
+}
+
+func (s *Store) RemoveGroupUser(m *group, userId int64) error {
+	query := `
+		DELETE
+		FROM
+			group_members
+		WHERE
+			group_id = ?
+			AND user_id = ?
+	`
+	db := s.db
+
+	_, err := db.Exec(query, m.Id, userId)
+	return err
+}
+
+/*
+ * アルバムへのアクセス権の登録.
+ * UserIdとGroupIdはどちらか一方のみを設定する.
+ */
+type albumMember struct {
+	Id      int64
+	AlbumId int64
+	UserId  int64
+	GroupId int64
+	Access  string
+	// 表示用
+	Name string
+}
+
+func (s *Store) FindAlbumMembers(albumId int64) ([]*albumMember, error) {
+	query := `
+		SELECT
+			am.id AS id,
+			COALESCE(am.user_id, 0) AS user_id,
+			COALESCE(am.group_id, 0) AS group_id,
+			am.access AS access,
+			COALESCE(u.name, g.name) AS name
+		FROM
+			album_members am
+			LEFT JOIN users u ON u.id = am.user_id
+			LEFT JOIN groups g ON g.id = am.group_id
+		WHERE
+			am.album_id = ?
+		ORDER BY
+			am.id
+	`
+	db := s.db
+
+	rows, err := db.Query(query, albumId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ret := make([]*albumMember, 0)
+	for rows.Next() {
+		m := &albumMember{AlbumId: albumId}
+		var name sql.NullString
+		if err := rows.Scan(&m.Id, &m.UserId, &m.GroupId, &m.Access, &name); err != nil {
+			return nil, err
+		}
+		m.Name = name.String
+		ret = append(ret, m)
+	}
+	return ret, nil
+}
+
+func (m *albumMember) Validate() error {
+	if (m.UserId == 0) == (m.GroupId == 0) {
+		return errors.New("either user or group is nesecery.")
+	}
+	if m.Access != accessRead && m.Access != accessWrite {
+		return errors.New("unknown access: " + m.Access)
+	}
+	return nil
+}
+
+func (s *Store) SaveAlbumMember(m *albumMember) error {
+	if err := m.Validate(); err != nil {
+		return err
+	}
+	query := `
+		INSERT INTO album_members (album_id, user_id, group_id, access) values(?, ?, ?, ?)
+	`
+	db := s.db
+
+	var userId, groupId sql.NullInt64
+	if m.UserId != 0 {
+		userId = sql.NullInt64{Int64: m.UserId, Valid: true}
+	}
+	if m.GroupId != 0 {
+		groupId = sql.NullInt64{Int64: m.GroupId, Valid: true}
+	}
+	id, err := db.Insert(query, m.AlbumId, userId, groupId, m.Access)
+	m.Id = id
+	return err
+}
+
+func (s *Store) RemoveAlbumMember(m *albumMember) error {
+	query := `
+		DELETE
+		FROM
+			album_members
+		WHERE
+			id = ?
+	`
+	db := s.db
+
+	_, err := db.Exec(query, m.Id)
+	return err
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func createTestUser(t *testing.T, name string, role string) *user {
+	u := &user{Name: name, Role: role}
+	if err := u.SetPassword("correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	if err := testStore.SaveUser(u); err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func TestAlbumAccessControl(t *testing.T) {
+	defer truncateTables()
+
+	alice := createTestUser(t, "alice", roleEditor)
+	bob := createTestUser(t, "bob", roleEditor)
+	carol := createTestUser(t, "carol", roleViewer)
+
+	open := &album{Title: "open"}
+	if err := testStore.SaveAlbum(open); err != nil {
+		t.Fatal(err)
+	}
+	secret := &album{Title: "secret"}
+	if err := testStore.SaveAlbum(secret); err != nil {
+		t.Fatal(err)
+	}
+	if err := testStore.SaveAlbumMember(&albumMember{AlbumId: secret.Id, UserId: alice.Id, Access: accessWrite}); err != nil {
+		t.Fatal(err)
+	}
+	g := &group{Name: "trainees"}
+	if err := testStore.SaveGroup(g); err != nil {
+		t.Fatal(err)
+	}
+	if err := testStore.AddGroupUser(g, carol.Id); err != nil {
+		t.Fatal(err)
+	}
+	if err := testStore.SaveAlbumMember(&albumMember{AlbumId: secret.Id, GroupId: g.Id, Access: accessRead}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 検索結果はメンバーのみに絞り込まれる
+	for _, c := range []struct {
+		u      *user
+		expect int
+	}{{alice, 2}, {bob, 1}, {carol, 2}} {
+		res, err := testStore.FindAlbum("", c.u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res) != c.expect {
+			t.Errorf("%vがFindAlbumで取得したアルバム数が一致しませんでした.Expect: %v, Actual: %v", c.u.Name, c.expect, len(res))
+		}
+	}
+
+	if _, err := testStore.FindPageListData(secret.Id, bob); err != errAlbumForbidden {
+		t.Errorf("メンバー外のユーザーが制限付きアルバムを参照できました.err: %v", err)
+	}
+	pld, err := testStore.FindPageListData(secret.Id, carol)
+	if err != nil {
+		t.Fatal("グループ経由でreadを持つユーザーがアルバムを参照できませんでした.", err)
+	}
+	if pld.Writable {
+		t.Errorf("readのみのユーザーに更新権限があります.")
+	}
+	pld, err = testStore.FindPageListData(secret.Id, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pld.Writable {
+		t.Errorf("writeを持つeditorに更新権限がありません.")
+	}
+
+	if writable, _ := testStore.canWriteAlbum(open.Id, bob); !writable {
+		t.Errorf("メンバー未登録のアルバムをeditorが更新できません.")
+	}
+	if writable, _ := testStore.canWriteAlbum(open.Id, carol); writable {
+		t.Errorf("viewerがアルバムを更新できます.")
+	}
+}
+
+func TestAlbumMemberHandlers(t *testing.T) {
+	defer truncateTables()
+
+	sessionKey = []byte("0123456789abcdef0123456789abcdef")
+	admin := createTestUser(t, "alice", roleAdmin)
+	session, err := testStore.CreateSession(admin.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	call := func(method string, path string, form url.Values, handler http.HandlerFunc) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.AddCookie(&http.Cookie{Name: sessionCookieName, Value: signSessionId(session.Id)})
+		w := httptest.NewRecorder()
+		serveTest(requirePermission(permManageUsers, handler), w, r)
+		return w
+	}
+	a := &album{Title: "secret"}
+	if err := testStore.SaveAlbum(a); err != nil {
+		t.Fatal(err)
+	}
+	album_id := strconv.FormatInt(a.Id, 10)
+
+	if w := call("GET", "/get_album_members?album_id="+album_id, nil, get_album_members); w.Code != http.StatusOK {
+		t.Errorf("アルバムのアクセス権を表示できません.Expect: %v, Actual: %v", http.StatusOK, w.Code)
+	}
+	if w := call("GET", "/get_album_members?album_id=99999", nil, get_album_members); w.Code != http.StatusNotFound {
+		t.Errorf("存在しないアルバムのアクセス権の表示が404になりません.Expect: %v, Actual: %v", http.StatusNotFound, w.Code)
+	}
+
+	form := url.Values{"album_id": {album_id}, "member": {"team:" + strconv.FormatInt(admin.Id, 10)}, "access": {accessRead}}
+	if w := call("POST", "/add_album_member", form, add_album_member); w.Code != http.StatusBadRequest {
+		t.Errorf("不明な種類のメンバーの追加が400になりません.Expect: %v, Actual: %v", http.StatusBadRequest, w.Code)
+	}
+	form.Set("member", "user:"+strconv.FormatInt(admin.Id, 10))
+	if w := call("POST", "/add_album_member", form, add_album_member); w.Code != http.StatusSeeOther {
+		t.Errorf("ユーザーをメンバーに追加できません.Expect: %v, Actual: %v", http.StatusSeeOther, w.Code)
+	}
+	members, err := testStore.FindAlbumMembers(a.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 1 || members[0].UserId != admin.Id {
+		t.Errorf("追加したメンバーが登録されていません.Actual: %v", members)
+	}
+}
@@ -0,0 +1,499 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const apiPrefix = "/api/v1"
+
+// パスパラメータ. {album_id}などの値を保持する
+type apiParams map[string]string
+
+type apiHandlerFunc func(w http.ResponseWriter, r *http.Request, params apiParams)
+
+type apiRoute struct {
+	Method     string
+	Path       string
+	Permission permission
+	Handler    apiHandlerFunc
+	// 以下はOpenAPIドキュメント生成用
+	Summary  string
+	Query    []string // クエリパラメータ名
+	Request  string   // リクエストボディのスキーマ名
+	Upload   string   // multipart/form-dataで受け付ける場合のスキーマ名
+	Body     string   // スキーマの無いバイナリを受け付ける場合のContent-Type
+	Headers  []string // リクエストヘッダー名
+	Response string   // 成功時のレスポンスのスキーマ名. 空ならボディ無し
+	Status   int      // 成功時のステータスコード
+	Errors   []int    // 401, 403, 500などの共通のもの以外に返すエラーのステータスコード
+}
+
+var errBadRequest = errors.New("bad request")
+
+// JSON APIのルーティング表. PathはapiPrefixからの相対パス
+var apiRoutes = []apiRoute{
+	{Method: "GET", Path: "/albums", Permission: permView, Handler: api_get_albums,
+		Summary: "Search albums", Query: []string{"q"}, Response: "AlbumList", Status: http.StatusOK},
+	{Method: "POST", Path: "/albums", Permission: permEdit, Handler: api_create_album,
+		Summary: "Create an album", Request: "AlbumRequest", Response: "Album", Status: http.StatusCreated},
+	{Method: "GET", Path: "/albums/{album_id}", Permission: permView, Handler: api_get_album,
+		Summary: "Get an album", Response: "Album", Status: http.StatusOK},
+	{Method: "PUT", Path: "/albums/{album_id}", Permission: permEdit, Handler: api_update_album,
+		Summary: "Update an album", Request: "AlbumRequest", Response: "Album", Status: http.StatusOK},
+	{Method: "DELETE", Path: "/albums/{album_id}", Permission: permEdit, Handler: api_delete_album,
+		Summary: "Delete an album", Status: http.StatusNoContent},
+	{Method: "GET", Path: "/albums/{album_id}/pages", Permission: permView, Handler: api_get_pages,
+		Summary:  "List pages of an album, optionally filtered by video metadata",
+		Query:    []string{"min_duration", "max_duration", "min_height", "max_height", "video_codec", "audio_codec", "container"},
+		Response: "PageList", Status: http.StatusOK, Errors: []int{http.StatusBadRequest}},
+	{Method: "POST", Path: "/albums/{album_id}/pages", Permission: permEdit, Handler: api_create_page,
+		Summary: "Create a page, optionally uploading its video", Request: "PageRequest", Upload: "PageUpload", Response: "Page", Status: http.StatusCreated,
+		Errors: []int{http.StatusRequestEntityTooLarge, http.StatusInsufficientStorage}},
+	{Method: "GET", Path: "/pages/{page_id}", Permission: permView, Handler: api_get_page,
+		Summary: "Get a page", Response: "Page", Status: http.StatusOK},
+	{Method: "PUT", Path: "/pages/{page_id}", Permission: permEdit, Handler: api_update_page,
+		Summary: "Update a page", Request: "PageRequest", Response: "Page", Status: http.StatusOK},
+	{Method: "DELETE", Path: "/pages/{page_id}", Permission: permEdit, Handler: api_delete_page,
+		Summary: "Delete a page", Status: http.StatusNoContent},
+	{Method: "OPTIONS", Path: "/uploads", Permission: permEdit, Handler: api_upload_options,
+		Summary: "Describe the tus resumable upload server", Status: http.StatusNoContent},
+	{Method: "POST", Path: "/uploads", Permission: permEdit, Handler: api_create_upload,
+		Summary: "Start a tus upload. Upload-Metadata takes album_id, page_id to replace its video or title and description for a new page, note, filename and sha256 (hex) of the whole file",
+		Headers: []string{"Tus-Resumable", "Upload-Length", "Upload-Metadata"}, Status: http.StatusCreated,
+		Errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusPreconditionFailed, http.StatusRequestEntityTooLarge, http.StatusInsufficientStorage}},
+	{Method: "HEAD", Path: "/uploads/{upload_id}", Permission: permEdit, Handler: api_head_upload,
+		Summary: "Get the offset of a tus upload", Headers: []string{"Tus-Resumable"}, Status: http.StatusOK,
+		Errors: []int{http.StatusPreconditionFailed}},
+	{Method: "PATCH", Path: "/uploads/{upload_id}", Permission: permEdit, Handler: api_patch_upload,
+		Summary: "Append to a tus upload. the page is saved when the last byte arrives and returned in Upload-Page-Id",
+		Body:    "application/offset+octet-stream", Headers: []string{"Tus-Resumable", "Upload-Offset", "Upload-Checksum"}, Status: http.StatusNoContent,
+		Errors: []int{http.StatusConflict, http.StatusPreconditionFailed, http.StatusUnsupportedMediaType, statusChecksumMismatch, http.StatusInsufficientStorage}},
+	{Method: "DELETE", Path: "/uploads/{upload_id}", Permission: permEdit, Handler: api_delete_upload,
+		Summary: "Cancel a tus upload", Headers: []string{"Tus-Resumable"}, Status: http.StatusNoContent,
+		Errors: []int{http.StatusPreconditionFailed}},
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println(err.Error())
+	}
+}
+
+/*
+ * エラーの種類に応じたステータスコードでエラーを返す.
+ */
+func writeAPIError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch err {
+	case sql.ErrNoRows:
+		status = http.StatusNotFound
+	case errAlbumForbidden:
+		status = http.StatusForbidden
+	case errBadRequest, errNotVideo:
+		status = http.StatusBadRequest
+	case errUploadTooLarge:
+		status = http.StatusRequestEntityTooLarge
+	case errUserQuotaExceeded, errAlbumQuotaExceeded, errDiskFull:
+		status = http.StatusInsufficientStorage
+	}
+	if status == http.StatusInternalServerError {
+		log.Println(err.Error())
+	}
+	writeJSON(w, status, &apiError{Error: err.Error()})
+}
+
+func writeAPIStatus(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, &apiError{Error: message})
+}
+
+/*
+ * パスがルートのパターンに一致するか調べ, 一致すればパラメータを返す.
+ */
+func matchAPIPath(pattern string, path string) (apiParams, bool) {
+	ps := strings.Split(strings.Trim(pattern, "/"), "/")
+	ss := strings.Split(strings.Trim(path, "/"), "/")
+	if len(ps) != len(ss) {
+		return nil, false
+	}
+	params := apiParams{}
+	for i, p := range ps {
+		if strings.HasPrefix(p, "{") && strings.HasSuffix(p, "}") {
+			if ss[i] == "" {
+				return nil, false
+			}
+			params[p[1:len(p)-1]] = ss[i]
+		} else if p != ss[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+/*
+ * /api/v1/以下のリクエストをapiRoutesに従って振り分ける.
+ * セッションの他にAPIトークンでも認証でき,
+ * 未ログインの場合はログイン画面へのリダイレクトではなく401を返す.
+ */
+func api_dispatch(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, apiPrefix)
+	allowed := make([]string, 0)
+	for _, route := range apiRoutes {
+		params, ok := matchAPIPath(route.Path, path)
+		if !ok {
+			continue
+		}
+		if route.Method != r.Method {
+			allowed = append(allowed, route.Method)
+			continue
+		}
+		u, err := userFromRequestOrToken(r)
+		if err != nil {
+			writeAPIStatus(w, http.StatusUnauthorized, "login required")
+			return
+		}
+		if !u.Can(route.Permission) {
+			writeAPIStatus(w, http.StatusForbidden, http.StatusText(http.StatusForbidden))
+			return
+		}
+		route.Handler(w, withUser(r, u), params)
+		return
+	}
+	if len(allowed) > 0 {
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		writeAPIStatus(w, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+		return
+	}
+	writeAPIStatus(w, http.StatusNotFound, http.StatusText(http.StatusNotFound))
+}
+
+func (params apiParams) id(name string) (int64, error) {
+	id, err := strconv.ParseInt(params[name], 10, 64)
+	if err != nil {
+		return 0, errBadRequest
+	}
+	return id, nil
+}
+
+/*
+ * パスパラメータのアルバムを取得し, 参照(writeがtrueなら更新)権限を確認する.
+ */
+func apiAlbum(r *http.Request, params apiParams, write bool) (*album, error) {
+	s := storeOf(r)
+	id, err := params.id("album_id")
+	if err != nil {
+		return nil, err
+	}
+	m, err := s.FindAlbumById(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkAlbumAccess(r, m.Id, write); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func apiPage(r *http.Request, params apiParams, write bool) (*page, error) {
+	s := storeOf(r)
+	id, err := params.id("page_id")
+	if err != nil {
+		return nil, err
+	}
+	m, err := s.FindPageById(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkAlbumAccess(r, m.AlbumId, write); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func checkAlbumAccess(r *http.Request, albumId int64, write bool) error {
+	s := storeOf(r)
+	var ok bool
+	var err error
+	if write {
+		ok, err = s.canWriteAlbum(albumId, currentUser(r))
+	} else {
+		ok, err = s.canReadAlbum(albumId, currentUser(r))
+	}
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errAlbumForbidden
+	}
+	return nil
+}
+
+type albumRequest struct {
+	Title string `json:"title"`
+}
+
+type pageRequest struct {
+	Title       string `json:"title"`
+	Description string `json:"description"`
+}
+
+func decodeJSON(r *http.Request, v interface{}) error {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return errBadRequest
+	}
+	return nil
+}
+
+func api_get_albums(w http.ResponseWriter, r *http.Request, params apiParams) {
+	s := storeOf(r)
+	albums, err := s.FindAlbum(r.FormValue("q"), currentUser(r))
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, albums)
+}
+
+func api_create_album(w http.ResponseWriter, r *http.Request, params apiParams) {
+	s := storeOf(r)
+	req := &albumRequest{}
+	if err := decodeJSON(r, req); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	m := &album{Title: req.Title}
+	if err := m.Validate(); err != nil {
+		writeAPIStatus(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := s.SaveAlbum(m); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, m)
+}
+
+func api_get_album(w http.ResponseWriter, r *http.Request, params apiParams) {
+	m, err := apiAlbum(r, params, false)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, m)
+}
+
+func api_update_album(w http.ResponseWriter, r *http.Request, params apiParams) {
+	s := storeOf(r)
+	m, err := apiAlbum(r, params, true)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	req := &albumRequest{}
+	if err := decodeJSON(r, req); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	m.Title = req.Title
+	if err := m.Validate(); err != nil {
+		writeAPIStatus(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := s.SaveAlbum(m); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, m)
+}
+
+func api_delete_album(w http.ResponseWriter, r *http.Request, params apiParams) {
+	s := storeOf(r)
+	m, err := apiAlbum(r, params, true)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	if err := s.RemoveAlbum(m); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func api_get_pages(w http.ResponseWriter, r *http.Request, params apiParams) {
+	s := storeOf(r)
+	m, err := apiAlbum(r, params, false)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	filter, err := apiPageFilter(r)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	pages, err := s.FindPageByFilter(m.Id, filter)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, pages)
+}
+
+/*
+ * クエリパラメータからページの絞り込み条件を作る.
+ * min_duration, max_durationは秒で指定する.
+ */
+func apiPageFilter(r *http.Request) (*pageFilter, error) {
+	f := &pageFilter{
+		VideoCodec: r.FormValue("video_codec"),
+		AudioCodec: r.FormValue("audio_codec"),
+		Container:  r.FormValue("container"),
+	}
+	ints := []struct {
+		name  string
+		dest  *int64
+		scale int64
+	}{
+		{"min_duration", &f.MinDurationMs, 1000},
+		{"max_duration", &f.MaxDurationMs, 1000},
+		{"min_height", &f.MinHeight, 1},
+		{"max_height", &f.MaxHeight, 1},
+	}
+	for _, p := range ints {
+		v := r.FormValue(p.name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return nil, errBadRequest
+		}
+		*p.dest = n * p.scale
+	}
+	return f, nil
+}
+
+/*
+ * ページを作成する.
+ * JSONの他, multipart/form-dataでtitle, description, videoを送ると動画も登録できる.
+ */
+func api_create_page(w http.ResponseWriter, r *http.Request, params apiParams) {
+	s := storeOf(r)
+	m, err := apiAlbum(r, params, true)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	p := &page{AlbumId: m.Id, UpdatedBy: currentUser(r).Id}
+	multipart := strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data")
+	if multipart {
+		if err := parseUploadForm(w, r); err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		p.Title = r.FormValue("title")
+		p.Description = r.FormValue("description")
+	} else {
+		req := &pageRequest{}
+		if err := decodeJSON(r, req); err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		p.Title = req.Title
+		p.Description = req.Description
+	}
+	if err := p.Validate(); err != nil {
+		writeAPIStatus(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	note := r.FormValue("note")
+	if err := (&pageVideo{Note: note}).Validate(); err != nil {
+		writeAPIStatus(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	moviePath := ""
+	if multipart {
+		if moviePath, err = saveFormVideo(r, m.Id); err != nil {
+			writeAPIError(w, err)
+			return
+		}
+	}
+	if err := s.SavePage(p); err != nil {
+		s.releaseMovieFile(moviePath)
+		writeAPIError(w, err)
+		return
+	}
+	if moviePath != "" {
+		v, err := s.AddPageVideo(p, moviePath, currentUser(r).Id, note)
+		if err != nil {
+			s.releaseMovieFile(moviePath)
+			writeAPIError(w, err)
+			return
+		}
+		if err := s.queueMediaJobs(v); err != nil {
+			log.Println("job:", moviePath, err)
+		}
+	}
+	writeJSON(w, http.StatusCreated, p)
+}
+
+func api_get_page(w http.ResponseWriter, r *http.Request, params apiParams) {
+	p, err := apiPage(r, params, false)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, p)
+}
+
+func api_update_page(w http.ResponseWriter, r *http.Request, params apiParams) {
+	s := storeOf(r)
+	p, err := apiPage(r, params, true)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	req := &pageRequest{}
+	if err := decodeJSON(r, req); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	p.Title = req.Title
+	p.Description = req.Description
+	p.UpdatedBy = currentUser(r).Id
+	if err := p.Validate(); err != nil {
+		writeAPIStatus(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := s.SavePage(p); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, p)
+}
+
+func api_delete_page(w http.ResponseWriter, r *http.Request, params apiParams) {
+	s := storeOf(r)
+	p, err := apiPage(r, params, true)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	if err := s.RemovePage(p); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
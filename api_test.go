@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// ログイン済みのCookieを付けてAPIを呼び出す
+func callAPI(t *testing.T, u *user, method string, path string, body string) *httptest.ResponseRecorder {
+	sessionKey = []byte("0123456789abcdef0123456789abcdef")
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if u != nil {
+		s, err := testStore.CreateSession(u.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.AddCookie(&http.Cookie{Name: sessionCookieName, Value: signSessionId(s.Id)})
+	}
+	if body != "" {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	w := httptest.NewRecorder()
+	serveTest(api_dispatch, w, r)
+	return w
+}
+
+func TestAPIAlbum(t *testing.T) {
+	defer truncateTables()
+
+	u := createTestUser(t, "alice", roleEditor)
+
+	w := callAPI(t, nil, "GET", "/api/v1/albums", "")
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("未ログインでのAPI呼び出しが401になりませんでした.Actual: %v", w.Code)
+	}
+
+	w = callAPI(t, u, "POST", "/api/v1/albums", `{"title":"api album"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("アルバムの作成に失敗しました.Status: %v, Body: %v", w.Code, w.Body.String())
+	}
+	created := &album{}
+	if err := json.Unmarshal(w.Body.Bytes(), created); err != nil {
+		t.Fatal(err)
+	}
+	if created.Id == 0 || created.Title != "api album" {
+		t.Errorf("作成したアルバムのJSONが正しくありません.Actual: %v", w.Body.String())
+	}
+
+	path := "/api/v1/albums/" + strconv.FormatInt(created.Id, 10)
+	w = callAPI(t, u, "GET", path, "")
+	if w.Code != http.StatusOK {
+		t.Errorf("作成したアルバムが取得できませんでした.Status: %v", w.Code)
+	}
+
+	w = callAPI(t, u, "POST", "/api/v1/albums", `{"title":"123456789012345678901234567890123"}`)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("不正な入力が400になりませんでした.Actual: %v", w.Code)
+	}
+
+	w = callAPI(t, u, "PATCH", path, "")
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("未定義のメソッドが405になりませんでした.Actual: %v", w.Code)
+	}
+
+	w = callAPI(t, u, "DELETE", path, "")
+	if w.Code != http.StatusNoContent {
+		t.Errorf("アルバムの削除に失敗しました.Status: %v", w.Code)
+	}
+	w = callAPI(t, u, "GET", path, "")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("存在しないアルバムが404になりませんでした.Actual: %v", w.Code)
+	}
+}
+
+func TestAPIPage(t *testing.T) {
+	defer truncateTables()
+
+	editor := createTestUser(t, "alice", roleEditor)
+	viewer := createTestUser(t, "bob", roleViewer)
+	m := &album{Title: "album"}
+	if err := testStore.SaveAlbum(m); err != nil {
+		t.Fatal(err)
+	}
+
+	pagesPath := "/api/v1/albums/" + strconv.FormatInt(m.Id, 10) + "/pages"
+	w := callAPI(t, viewer, "POST", pagesPath, `{"title":"page","description":"desc"}`)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("viewerによるページ作成が403になりませんでした.Actual: %v", w.Code)
+	}
+	w = callAPI(t, editor, "POST", pagesPath, `{"title":"page","description":"desc"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("ページの作成に失敗しました.Status: %v, Body: %v", w.Code, w.Body.String())
+	}
+	created := &page{}
+	if err := json.Unmarshal(w.Body.Bytes(), created); err != nil {
+		t.Fatal(err)
+	}
+
+	path := "/api/v1/pages/" + strconv.FormatInt(created.Id, 10)
+	w = callAPI(t, editor, "PUT", path, `{"title":"updated","description":"updated desc"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("ページの更新に失敗しました.Status: %v, Body: %v", w.Code, w.Body.String())
+	}
+	w = callAPI(t, viewer, "GET", pagesPath, "")
+	pages := make([]*page, 0)
+	if err := json.Unmarshal(w.Body.Bytes(), &pages); err != nil {
+		t.Fatal(err)
+	}
+	if len(pages) != 1 || pages[0].Title != "updated" {
+		t.Errorf("更新したページが一覧に反映されていません.Actual: %v", w.Body.String())
+	}
+
+	w = callAPI(t, editor, "GET", "/api/v1/pages/99999", "")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("存在しないページが404になりませんでした.Actual: %v", w.Code)
+	}
+}
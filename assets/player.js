@@ -0,0 +1,29 @@
+/*
+ * data-hlsを持つvideoタグはHLSで再生する.
+ * HLSを再生できないブラウザや再生に失敗した場合は, videoタグ内のMP4を再生する.
+ */
+$(function() {
+	$('video[data-hls]').each(function() {
+		var video = this;
+		var src = $(video).data('hls');
+		var fallback = function() {
+			video.removeAttribute('src');
+			video.load();
+		};
+		if (video.canPlayType('application/vnd.apple.mpegurl')) {
+			// Safariはvideoタグだけで再生できる
+			video.src = src;
+			$(video).one('error', fallback);
+		} else if (window.Hls && Hls.isSupported()) {
+			var hls = new Hls();
+			hls.on(Hls.Events.ERROR, function(event, data) {
+				if (data.fatal) {
+					hls.destroy();
+					fallback();
+				}
+			});
+			hls.loadSource(src);
+			hls.attachMedia(video);
+		}
+	});
+});
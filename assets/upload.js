@@ -0,0 +1,77 @@
+/*
+ * 動画を選んだページ編集フォームは, tusで分割してアップロードする.
+ * 接続が切れても続きから再開し, 進み具合をプログレスバーに表示する.
+ * tusを使えないブラウザでは通常のフォームとして送信する.
+ */
+$(function() {
+	$('form[data-upload]').on('submit', function(event) {
+		var form = this;
+		var file = form.video.files[0];
+		if (!file || !window.tus || !tus.isSupported) {
+			return;
+		}
+		event.preventDefault();
+
+		var albumId = form.album_id.value;
+		var metadata = {
+			album_id: albumId,
+			title: form.title.value,
+			description: form.description.value,
+			note: form.video_note.value,
+			filename: file.name
+		};
+		if (form.page_id) {
+			metadata.page_id = form.page_id.value;
+		}
+		var progress = $('#upload-progress').show();
+		var bar = progress.find('.progress-bar');
+		var message = $('#upload-message').text('');
+		var submit = $(form).find('input[type=submit]').prop('disabled', true);
+		var pageId = null;
+
+		var upload = new tus.Upload(file, {
+			endpoint: $(form).data('upload'),
+			chunkSize: 50 * 1024 * 1024,
+			retryDelays: [0, 1000, 3000, 5000, 10000, 30000],
+			metadata: metadata,
+			// 同じファイルでも登録先が違えば別のアップロードとする
+			fingerprint: function(file) {
+				return Promise.resolve(['video-album', file.name, file.size, file.lastModified, albumId, metadata.page_id || 'new'].join('-'));
+			},
+			removeFingerprintOnSuccess: true,
+			onProgress: function(sent, total) {
+				var percent = Math.floor(sent * 100 / total);
+				bar.css('width', percent + '%').text(percent + '%');
+			},
+			onAfterResponse: function(req, res) {
+				if (res.getHeader('Upload-Page-Id')) {
+					pageId = res.getHeader('Upload-Page-Id');
+				}
+			},
+			onSuccess: function() {
+				var url = '/get_album?album_id=' + encodeURIComponent(albumId);
+				if (pageId) {
+					url += '&page_id=' + encodeURIComponent(pageId);
+				}
+				location.href = url;
+			},
+			onError: function(error) {
+				var res = error.originalResponse;
+				var text = res ? res.getBody() : error.message;
+				try {
+					text = JSON.parse(text).error;
+				} catch (e) {
+				}
+				message.text('アップロードに失敗しました: ' + text);
+				submit.prop('disabled', false);
+			}
+		});
+		// 中断したアップロードがあれば続きから送る
+		upload.findPreviousUploads().then(function(previous) {
+			if (previous.length > 0) {
+				upload.resumeFromPreviousUpload(previous[0]);
+			}
+			upload.start();
+		});
+	});
+});
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+)
+
+const sessionCookieName = "video_album_session"
+
+// セッションCookieの署名鍵を保存するファイル
+const sessionKeyPath = "session.key"
+
+var sessionKey []byte
+
+type contextKey int
+
+const (
+	userContextKey contextKey = iota
+	storeContextKey
+)
+
+type loginData struct {
+	Error string
+}
+
+/*
+ * 署名鍵を読み込む.
+ * ファイルが無ければ新しく生成して保存する.
+ */
+func loadSessionKey() error {
+	if fileExists(sessionKeyPath) {
+		key, err := ioutil.ReadFile(sessionKeyPath)
+		if err != nil {
+			return err
+		}
+		if len(key) < 32 {
+			return errors.New(sessionKeyPath + " is too short")
+		}
+		sessionKey = key
+		return nil
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(sessionKeyPath, key, 0600); err != nil {
+		return err
+	}
+	sessionKey = key
+	return nil
+}
+
+func signSessionId(id string) string {
+	mac := hmac.New(sha256.New, sessionKey)
+	mac.Write([]byte(id))
+	return id + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+/*
+ * 署名付きのCookie値からセッションIDを取り出す.
+ * 署名が一致しなければエラー.
+ */
+func verifySessionCookie(value string) (string, error) {
+	i := strings.LastIndex(value, ".")
+	if i < 0 {
+		return "", errors.New("malformed session cookie")
+	}
+	id := value[:i]
+	if !hmac.Equal([]byte(signSessionId(id)), []byte(value)) {
+		return "", errors.New("invalid session signature")
+	}
+	return id, nil
+}
+
+/*
+ * リクエストのCookieからログイン中のセッションを取得する.
+ */
+func sessionFromRequest(r *http.Request) (*session, error) {
+	s := storeOf(r)
+	c, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return nil, err
+	}
+	id, err := verifySessionCookie(c.Value)
+	if err != nil {
+		return nil, err
+	}
+	return s.FindSessionById(id)
+}
+
+/*
+ * リクエストのセッションからログインユーザーを取得する.
+ */
+func userFromRequest(r *http.Request) (*user, error) {
+	s, err := sessionFromRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	return storeOf(r).FindUserById(s.UserId)
+}
+
+/*
+ * Authorization: Bearerヘッダのトークンを返す. ヘッダが無ければ空文字.
+ */
+func bearerToken(r *http.Request) string {
+	h := r.Header.Get("Authorization")
+	if len(h) > 7 && strings.EqualFold(h[:7], "Bearer ") {
+		return strings.TrimSpace(h[7:])
+	}
+	return ""
+}
+
+/*
+ * APIトークンがあればトークンから, 無ければセッションからログインユーザーを取得する.
+ */
+func userFromRequestOrToken(r *http.Request) (*user, error) {
+	s := storeOf(r)
+	if token := bearerToken(r); token != "" {
+		return s.FindUserByAPIToken(token)
+	}
+	return userFromRequest(r)
+}
+
+func withUser(r *http.Request, u *user) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), userContextKey, u))
+}
+
+/*
+ * requireLoginを通過したリクエストのログインユーザーを返す.
+ */
+func currentUser(r *http.Request) *user {
+	u, _ := r.Context().Value(userContextKey).(*user)
+	return u
+}
+
+/*
+ * 未ログインのリクエストをログイン画面へリダイレクトするミドルウェア.
+ */
+func requireLogin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, err := userFromRequest(r)
+		if err != nil {
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+		h(w, withUser(r, u))
+	}
+}
+
+/*
+ * requireLoginと同様だが, Authorization: BearerヘッダのAPIトークンも受け付ける.
+ * トークンが不正な場合はリダイレクトせず401を返す.
+ */
+func requireLoginOrToken(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, err := userFromRequestOrToken(r)
+		if err != nil && bearerToken(r) != "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="video_album"`)
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+		h(w, withUser(r, u))
+	}
+}
+
+func login(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.NotFound(w, r)
+		return
+	}
+	execTemplate(w, "login", &loginData{})
+}
+
+func auth(w http.ResponseWriter, r *http.Request) {
+	s := storeOf(r)
+	if r.Method != "POST" {
+		http.NotFound(w, r)
+		return
+	}
+	name := r.PostFormValue("username")
+	password := r.PostFormValue("password")
+
+	u, err := s.FindUserByName(name)
+	if err != nil || !u.Authenticate(password) {
+		w.WriteHeader(http.StatusUnauthorized)
+		execTemplate(w, "login", &loginData{Error: "ユーザー名またはパスワードが違います."})
+		return
+	}
+	sess, err := s.CreateSession(u.Id)
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    signSessionId(sess.Id),
+		Path:     "/",
+		Expires:  sess.ExpiresAt,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, "/get_albums", http.StatusSeeOther)
+}
+
+func auth_delete(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.NotFound(w, r)
+		return
+	}
+	if s, err := sessionFromRequest(r); err == nil {
+		if err := storeOf(r).RemoveSession(s); err != nil {
+			log.Println(err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
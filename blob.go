@@ -0,0 +1,242 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	_ "github.com/mattn/go-sqlite3"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * アップロードされた動画は中身のSHA-256をファイル名にして保存する.
+ * 同じ動画が何度アップロードされても保存先には1つだけ置き,
+ * 参照している動画の版の数を数えて, 最後の版が削除された時にファイルを削除する.
+ * サムネイルや変換後の動画も元の動画の名前から作るため, 同じ動画の間で共有される.
+ */
+
+/*
+ * 同じ動画の保存と削除が重ならないように, トランザクションが終わるまでハッシュがsumの動画をロックする.
+ * 複数のサーバーが同じDBを使う場合もあるため, ロックはDBで取る.
+ * SQLiteはトランザクションの開始時にDB全体の書き込みのロックを取るため, それ以上は何もしない.
+ */
+func lockBlob(tx *storeTx, sum string) error {
+	if tx.dialect != dialectPostgres {
+		return nil
+	}
+	key, err := strconv.ParseInt(sum[:15], 16, 64)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("SELECT pg_advisory_xact_lock(?)", key)
+	return err
+}
+
+/*
+ * 保存先のファイル名のうち, 動画の中身から付けた部分を返す.
+ * 動画から作ったサムネイルや変換後の動画の名前からも元の動画のハッシュを取り出せる.
+ * 以前の動画のようにハッシュで名前を付けていない場合は空文字を返す.
+ */
+func blobSum(name string) string {
+	const n = sha256.Size * 2
+	if len(name) < n || (len(name) > n && !strings.ContainsRune("._", rune(name[n]))) {
+		return ""
+	}
+	for _, c := range name[:n] {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return ""
+		}
+	}
+	return name[:n]
+}
+
+/*
+ * 動画を中身のハッシュの名前で保存先に置き, 参照を1つ増やす.
+ * 同じ動画が既にあれば保存せずに参照だけを増やす.
+ * 呼び出し元は動画の版として登録するか, 失敗した場合はreleaseMovieFileで参照を戻す.
+ */
+func (s *Store) saveBlob(r io.Reader, ext string) (string, error) {
+	f, err := ioutil.TempFile("", "video_album-*"+ext)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(f, h), r)
+	if err != nil {
+		return "", err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	name := sum + ext
+
+	db := s.db
+
+	put := func() error {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		_, err := movieStorage.Put(name, f)
+		return err
+	}
+	// 保存には時間がかかるため, 新しい動画はロックを取る前に保存しておく
+	referenced, err := blobReferenced(db, sum)
+	if err != nil {
+		return "", err
+	}
+	if !referenced {
+		if err := put(); err != nil {
+			return "", err
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	if err := lockBlob(tx, sum); err != nil {
+		return "", err
+	}
+	res, err := tx.Exec("UPDATE blobs SET ref_count = ref_count + 1 WHERE sha256 = ?", sum)
+	if err != nil {
+		return "", err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return "", err
+	} else if n == 0 {
+		// ロックを取るまでに参照が無くなり削除された場合は保存し直す
+		if _, err := movieStorage.Stat(name); os.IsNotExist(err) {
+			err = put()
+		}
+		if err != nil {
+			return "", err
+		}
+		query := `
+			INSERT INTO blobs (sha256, filepath, size, ref_count, created_at) values(?, ?, ?, 1, ?)
+		`
+		if _, err := tx.Exec(query, sum, name, size, time.Now().Unix()); err != nil {
+			movieStorage.Delete(name)
+			return "", err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+/*
+ * saveBlobで増やした参照を戻す. 他に参照が無ければ動画を削除する.
+ * 版として登録できなかった場合に呼ぶ.
+ */
+func (s *Store) releaseMovieFile(name string) error {
+	if name == "" {
+		return nil
+	}
+	query := `
+		UPDATE
+			blobs
+		SET
+			ref_count = ref_count - 1
+		WHERE
+			filepath = ?
+	`
+	db := s.db
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(query, name); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM blobs WHERE ref_count <= 0"); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return s.removeMovieFiles([]string{name})
+}
+
+/*
+ * ページの動画の版が参照している動画の参照を減らし, 参照が無くなったものの記録を消す.
+ * ページの削除と同じトランザクションで, 版を削除する前に呼ぶ.
+ * ファイルはコミット後のremoveMovieFilesで, 参照が無くなったものだけが削除される.
+ */
+func releaseBlobs(tx *storeTx, pageCond string, args ...interface{}) error {
+	query := `
+		UPDATE
+			blobs
+		SET
+			ref_count = ref_count - (
+				SELECT COUNT(*) FROM page_videos WHERE filepath = blobs.filepath AND page_id IN (` + pageCond + `)
+			)
+		WHERE
+			filepath IN (SELECT filepath FROM page_videos WHERE page_id IN (` + pageCond + `))
+	`
+	if _, err := tx.Exec(query, append(append([]interface{}{}, args...), args...)...); err != nil {
+		return err
+	}
+	_, err := tx.Exec("DELETE FROM blobs WHERE ref_count <= 0")
+	return err
+}
+
+/*
+ * ハッシュがsumの動画がまだ参照されているか.
+ * 結果に従ってファイルを扱う場合は, 呼び出し元のトランザクションでlockBlobしておく.
+ */
+func blobReferenced(db interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}, sum string) (bool, error) {
+	var n int64
+	if err := db.QueryRow("SELECT COUNT(*) FROM blobs WHERE sha256 = ?", sum).Scan(&n); err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+/*
+ * 重複の排除で節約できた容量.
+ */
+type blobStats struct {
+	// 保存している動画の数と大きさ
+	Blobs      int64
+	StoredSize int64
+	// 動画の版からの参照の数と, 重複を排除しなかった場合の大きさ
+	References     int64
+	ReferencedSize int64
+}
+
+func (m *blobStats) SavedSize() int64 {
+	return m.ReferencedSize - m.StoredSize
+}
+
+func (s *Store) FindBlobStats() (*blobStats, error) {
+	query := `
+		SELECT
+			COUNT(*),
+			COALESCE(SUM(size), 0),
+			COALESCE(SUM(ref_count), 0),
+			COALESCE(SUM(size * ref_count), 0)
+		FROM
+			blobs
+	`
+	db := s.db
+
+	m := &blobStats{}
+	if err := db.QueryRow(query).Scan(&m.Blobs, &m.StoredSize, &m.References, &m.ReferencedSize); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBlobSum(t *testing.T) {
+	sum := strings.Repeat("0123456789abcdef", 4)
+	tests := map[string]string{
+		sum + ".mp4":                  sum,
+		sum + ".jpg":                  sum,
+		sum + "_720p.mp4":             sum,
+		sum + "_hls/720p/00001.ts":    sum,
+		sum:                           sum,
+		"abc123.mp4":                  "",
+		strings.ToUpper(sum) + ".mp4": "",
+		sum + "0.mp4":                 "",
+		"uploads/" + sum + ".part":    "",
+	}
+	for name, expect := range tests {
+		if actual := blobSum(name); actual != expect {
+			t.Errorf("ハッシュの取り出しが誤っています.name: %v, Expect: %q, Actual: %q", name, expect, actual)
+		}
+	}
+}
+
+func TestBlobDedup(t *testing.T) {
+	defer truncateTables()
+	s, cleanup := useTempStorage(t)
+	defer cleanup()
+
+	editor := createTestUser(t, "alice", roleEditor)
+	albums := make([]*album, 2)
+	pages := make([]*page, 2)
+	video := testUploadVideo()
+	for i := range albums {
+		albums[i] = &album{Title: "album"}
+		if err := testStore.SaveAlbum(albums[i]); err != nil {
+			t.Fatal(err)
+		}
+		path := "/api/v1/albums/" + strconv.FormatInt(albums[i].Id, 10) + "/pages"
+		w := callAPIMultipart(t, editor, path, map[string]string{"title": "page", "description": "desc"}, video)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("ページを作成できません.Status: %v, Body: %v", w.Code, w.Body.String())
+		}
+		pages[i] = &page{}
+		if err := json.Unmarshal(w.Body.Bytes(), pages[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	moviePath := pages[0].MoviePath
+	if moviePath == "" || pages[1].MoviePath != moviePath {
+		t.Fatalf("同じ動画が同じファイルになっていません.Actual: %v, %v", moviePath, pages[1].MoviePath)
+	}
+	// 同じページに同じ動画を新しい版として登録しても1つのファイルを参照する
+	path, err := testStore.filesave(strings.NewReader(video))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testStore.AddPageVideo(pages[1], path, editor.Id, ""); err != nil {
+		t.Fatal(err)
+	}
+	files, err := s.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("同じ動画が複数保存されています.Actual: %v", files)
+	}
+	stats, err := testStore.FindBlobStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Blobs != 1 || stats.References != 3 || stats.SavedSize() != int64(len(video)*2) {
+		t.Errorf("節約できた容量が誤っています.Actual: %+v", stats)
+	}
+
+	// 動画から作ったファイルも動画と一緒に共有される
+	thumbnail := thumbnailName(moviePath)
+	if _, err := s.Put(thumbnail, strings.NewReader("jpeg")); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range pages {
+		if err := testStore.SetPageThumbnail(p, moviePath, thumbnail); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := testStore.RemovePage(pages[0]); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{moviePath, thumbnail} {
+		if _, err := s.Stat(name); err != nil {
+			t.Errorf("他のページが参照しているファイルが削除されました.name: %v, err: %v", name, err)
+		}
+	}
+	if stats, _ := testStore.FindBlobStats(); stats.References != 2 {
+		t.Errorf("ページの削除で参照が減っていません.Actual: %+v", stats)
+	}
+
+	// 最後に参照しているページが削除されたらファイルも削除する
+	if err := testStore.RemoveAlbum(albums[1]); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := s.List(); len(files) != 0 {
+		t.Errorf("参照が無くなったファイルが残っています.Actual: %v", files)
+	}
+	if stats, _ := testStore.FindBlobStats(); stats.Blobs != 0 {
+		t.Errorf("参照が無くなった動画の記録が残っています.Actual: %+v", stats)
+	}
+}
+
+func TestReleaseMovieFile(t *testing.T) {
+	defer truncateTables()
+	s, cleanup := useTempStorage(t)
+	defer cleanup()
+
+	video := testUploadVideo()
+	first, err := testStore.filesave(strings.NewReader(video))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := testStore.filesave(strings.NewReader(video))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 登録に失敗した方の参照だけを戻す
+	if err := testStore.releaseMovieFile(second); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Stat(first); err != nil {
+		t.Errorf("参照が残っている動画が削除されました.err: %v", err)
+	}
+	if err := testStore.releaseMovieFile(first); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Stat(first); err == nil {
+		t.Errorf("参照が無くなった動画が残っています")
+	}
+	// 記録の無い以前の動画はそのまま削除する
+	if _, err := s.Put("legacy.mp4", strings.NewReader(video)); err != nil {
+		t.Fatal(err)
+	}
+	if err := testStore.removeMovieFiles([]string{"legacy.mp4"}); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := s.List(); len(files) != 0 {
+		t.Errorf("削除したファイルが残っています.Actual: %v", files)
+	}
+}
+
+func TestRemoveMovieFileWhileSaving(t *testing.T) {
+	defer truncateTables()
+	s, cleanup := useTempStorage(t)
+	defer cleanup()
+
+	sum := strings.Repeat("0123456789abcdef", 4)
+	name := sum + ".mp4"
+	if _, err := s.Put(name, strings.NewReader("movie")); err != nil {
+		t.Fatal(err)
+	}
+	// 他のサーバーが同じ動画を保存している間は, 参照が無くても削除を待たせる
+	tx, err := testStore.db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if err := lockBlob(tx, sum); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() {
+		done <- testStore.removeMovieFile(name)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	if _, err := tx.Exec("INSERT INTO blobs (sha256, filepath, size, ref_count, created_at) values(?, ?, 5, 1, 0)", sum, name); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Stat(name); err != nil {
+		t.Errorf("保存中の動画が削除されました.err: %v", err)
+	}
+}
+
+func TestGetSharedMovie(t *testing.T) {
+	defer truncateTables()
+	_, cleanup := useTempStorage(t)
+	defer cleanup()
+
+	alice := createTestUser(t, "alice", roleViewer)
+	bob := createTestUser(t, "bob", roleViewer)
+	// 先に作ったアルバムはaliceのみ参照できる
+	secret := &album{Title: "secret"}
+	if err := testStore.SaveAlbum(secret); err != nil {
+		t.Fatal(err)
+	}
+	if err := testStore.SaveAlbumMember(&albumMember{AlbumId: secret.Id, UserId: alice.Id, Access: accessRead}); err != nil {
+		t.Fatal(err)
+	}
+	open := &album{Title: "open"}
+	if err := testStore.SaveAlbum(open); err != nil {
+		t.Fatal(err)
+	}
+	addVideo := func(m *album, video string) string {
+		p := &page{AlbumId: m.Id, Title: "page", Description: "desc"}
+		if err := testStore.SavePage(p); err != nil {
+			t.Fatal(err)
+		}
+		moviePath, err := testStore.filesave(strings.NewReader(video))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := testStore.AddPageVideo(p, moviePath, 0, ""); err != nil {
+			t.Fatal(err)
+		}
+		return moviePath
+	}
+	video := testUploadVideo()
+	shared := addVideo(secret, video)
+	if addVideo(open, video) != shared {
+		t.Fatalf("同じ動画が同じファイルになっていません.")
+	}
+	private := addVideo(secret, video+"private")
+
+	sessionKey = []byte("0123456789abcdef0123456789abcdef")
+	get := func(u *user, name string) int {
+		session, err := testStore.CreateSession(u.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest("GET", "/movies/"+name, nil)
+		r.AddCookie(&http.Cookie{Name: sessionCookieName, Value: signSessionId(session.Id)})
+		w := httptest.NewRecorder()
+		serveTest(requirePermission(permView, get_movie), w, r)
+		return w.Code
+	}
+	tests := []struct {
+		u      *user
+		name   string
+		status int
+	}{
+		// 参照できないアルバムのページも同じ動画を持つが, 参照できるアルバムのページから再生できる
+		{bob, shared, http.StatusOK},
+		{alice, shared, http.StatusOK},
+		{bob, private, http.StatusForbidden},
+		{alice, private, http.StatusOK},
+		{bob, "unknown.mp4", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		if status := get(test.u, test.name); status != test.status {
+			t.Errorf("ステータスが異なります.user: %v, name: %v, Expect: %v, Actual: %v", test.u.Name, test.name, test.status, status)
+		}
+	}
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+/*
+ * サブコマンドを実行する.
+ * args[0]がサブコマンド名.
+ */
+func runCommand(s *Store, args []string) error {
+	switch args[0] {
+	case "user":
+		return runUserCommand(s, args[1:])
+	case "group":
+		return runGroupCommand(s, args[1:])
+	case "token":
+		return runTokenCommand(s, args[1:])
+	case "fsck":
+		return runFsckCommand(s, args[1:])
+	case "thumbnail":
+		return runThumbnailCommand(s, args[1:])
+	case "probe":
+		return runProbeCommand(s, args[1:])
+	case "transcode":
+		return runTranscodeCommand(s, args[1:])
+	case "quota":
+		return runQuotaCommand(s, args[1:])
+	case "dedup":
+		return runDedupCommand(s, args[1:])
+	case "migrate":
+		return runMigrateCommand(s, args[1:])
+	}
+	return errors.New("unknown command: " + args[0])
+}
+
+func readPassword(prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+/*
+ * video_album user add -name NAME [-password PASSWORD] [-role ROLE]
+ * video_album user passwd -name NAME [-password PASSWORD]
+ * video_album user role -name NAME -role ROLE
+ *
+ * -passwordを省略した場合は標準入力から読み込む.
+ */
+func runUserCommand(s *Store, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: video_album user add|passwd|role -name NAME [-password PASSWORD] [-role ROLE]")
+	}
+	fs := flag.NewFlagSet("user "+args[0], flag.ExitOnError)
+	name := fs.String("name", "", "user name.")
+	password := fs.String("password", "", "password. read from stdin if omitted.")
+	role := fs.String("role", roleViewer, "role of user. viewer, editor or admin.")
+	fs.Parse(args[1:])
+
+	var u *user
+	switch args[0] {
+	case "add":
+		if _, err := s.FindUserByName(*name); err == nil {
+			return errors.New("user already exists: " + *name)
+		}
+		u = &user{Name: *name, Role: *role}
+	case "role":
+		found, err := s.FindUserByName(*name)
+		if err != nil {
+			return errors.New("user not found: " + *name)
+		}
+		found.Role = *role
+		return s.SaveUser(found)
+	case "passwd":
+		found, err := s.FindUserByName(*name)
+		if err != nil {
+			return errors.New("user not found: " + *name)
+		}
+		u = found
+	default:
+		return errors.New("unknown user command: " + args[0])
+	}
+
+	if *password == "" {
+		pw, err := readPassword("Password: ")
+		if err != nil {
+			return err
+		}
+		*password = pw
+	}
+	if err := u.SetPassword(*password); err != nil {
+		return err
+	}
+	return s.SaveUser(u)
+}
+
+/*
+ * video_album group add -name GROUP
+ * video_album group adduser -name GROUP -user NAME
+ * video_album group deluser -name GROUP -user NAME
+ */
+func runGroupCommand(s *Store, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: video_album group add|adduser|deluser -name GROUP [-user NAME]")
+	}
+	fs := flag.NewFlagSet("group "+args[0], flag.ExitOnError)
+	name := fs.String("name", "", "group name.")
+	userName := fs.String("user", "", "user name.")
+	fs.Parse(args[1:])
+
+	if args[0] == "add" {
+		if _, err := s.FindGroupByName(*name); err == nil {
+			return errors.New("group already exists: " + *name)
+		}
+		return s.SaveGroup(&group{Name: *name})
+	}
+
+	g, err := s.FindGroupByName(*name)
+	if err != nil {
+		return errors.New("group not found: " + *name)
+	}
+	u, err := s.FindUserByName(*userName)
+	if err != nil {
+		return errors.New("user not found: " + *userName)
+	}
+	switch args[0] {
+	case "adduser":
+		return s.AddGroupUser(g, u.Id)
+	case "deluser":
+		return s.RemoveGroupUser(g, u.Id)
+	}
+	return errors.New("unknown group command: " + args[0])
+}
+
+/*
+ * video_album token create -user NAME -name TOKEN_NAME [-expires DURATION]
+ * video_album token list -user NAME
+ * video_album token revoke -id ID
+ *
+ * createは発行したトークンを標準出力に書き出す.
+ */
+func runTokenCommand(s *Store, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: video_album token create|list|revoke [-user NAME] [-name TOKEN_NAME] [-expires DURATION] [-id ID]")
+	}
+	fs := flag.NewFlagSet("token "+args[0], flag.ExitOnError)
+	userName := fs.String("user", "", "user name.")
+	name := fs.String("name", "", "token name.")
+	expires := fs.Duration("expires", 0, "lifetime of token. e.g. 720h. no expiry if 0.")
+	id := fs.Int64("id", 0, "token id.")
+	fs.Parse(args[1:])
+
+	if args[0] == "revoke" {
+		m, err := s.FindAPITokenById(*id)
+		if err != nil {
+			return fmt.Errorf("token not found: %d", *id)
+		}
+		return s.RemoveAPIToken(m)
+	}
+
+	u, err := s.FindUserByName(*userName)
+	if err != nil {
+		return errors.New("user not found: " + *userName)
+	}
+	switch args[0] {
+	case "create":
+		m := &apiToken{UserId: u.Id, Name: *name}
+		if *expires > 0 {
+			m.ExpiresAt = time.Now().Add(*expires)
+		}
+		token, err := s.CreateAPIToken(m)
+		if err != nil {
+			return err
+		}
+		fmt.Println(token)
+		return nil
+	case "list":
+		tokens, err := s.FindAPITokensByUserId(u.Id)
+		if err != nil {
+			return err
+		}
+		const layout = "2006-01-02 15:04"
+		for _, m := range tokens {
+			lastUsed := "-"
+			if !m.LastUsedAt.IsZero() {
+				lastUsed = m.LastUsedAt.Format(layout)
+			}
+			expiresAt := "-"
+			if !m.ExpiresAt.IsZero() {
+				expiresAt = m.ExpiresAt.Format(layout)
+			}
+			fmt.Printf("%d\t%s\tcreated:%s\tlast_used:%s\texpires:%s\n", m.Id, m.Name, m.CreatedAt.Format(layout), lastUsed, expiresAt)
+		}
+		return nil
+	}
+	return errors.New("unknown token command: " + args[0])
+}
+
+/*
+ * video_album thumbnail
+ *
+ * サムネイルの無いページの動画からサムネイルを作成する.
+ * 作成できなかったページは表示して続ける.
+ */
+func runThumbnailCommand(s *Store, args []string) error {
+	fs := flag.NewFlagSet("thumbnail", flag.ExitOnError)
+	fs.Parse(args)
+
+	pages, err := s.FindPagesWithoutThumbnail()
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, p := range pages {
+		if err := s.createThumbnail(p); err != nil {
+			fmt.Printf("page:%d\t%s\t%v\n", p.Id, p.MoviePath, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d thumbnails failed.", failed, len(pages))
+	}
+	return nil
+}
+
+/*
+ * video_album probe
+ *
+ * 長さや解像度などを調べていないページの動画をffprobeで調べる.
+ * 調べられなかったページは表示して続ける.
+ */
+func runProbeCommand(s *Store, args []string) error {
+	fs := flag.NewFlagSet("probe", flag.ExitOnError)
+	fs.Parse(args)
+
+	pages, err := s.FindPagesWithoutMediaInfo()
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, p := range pages {
+		if err := s.probeMedia(p); err != nil {
+			fmt.Printf("page:%d\t%s\t%v\n", p.Id, p.MoviePath, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d pages failed.", failed, len(pages))
+	}
+	return nil
+}
+
+/*
+ * video_album transcode
+ *
+ * ページの現在の動画のうち, ブラウザ向けに変換していないものを変換する.
+ * 版の記録が始まる前の動画も版として記録してから変換する.
+ */
+func runTranscodeCommand(s *Store, args []string) error {
+	fs := flag.NewFlagSet("transcode", flag.ExitOnError)
+	fs.Parse(args)
+
+	if len(renditionHeights) == 0 {
+		return errors.New("transcoding is disabled by -renditions.")
+	}
+	if err := s.RecordLegacyPageVideos(); err != nil {
+		return err
+	}
+	ids, err := s.FindCurrentVideoIdsWithoutRenditions()
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, id := range ids {
+		if err := s.transcodeVideo(id); err != nil {
+			fmt.Printf("video:%d\t%v\n", id, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d videos failed.", failed, len(ids))
+	}
+	return nil
+}
+
+/*
+ * video_album quota -user NAME [-set SIZE]
+ * video_album quota -album ID [-set SIZE]
+ *
+ * ユーザーかアルバムの使用量と容量の上限を表示する.
+ * -setで上限を個別に指定する. 0は無制限, defaultは起動時の指定に戻す.
+ */
+func runQuotaCommand(s *Store, args []string) error {
+	fs := flag.NewFlagSet("quota", flag.ExitOnError)
+	userName := fs.String("user", "", "user name.")
+	albumId := fs.Int64("album", 0, "album id.")
+	set := fs.String("set", "", "quota. e.g. 10G. 0 for unlimited, default to follow -user-quota or -album-quota.")
+	fs.Parse(args)
+
+	var quota sql.NullInt64
+	if *set != "" && *set != "default" {
+		n, err := parseByteSize(*set)
+		if err != nil {
+			return err
+		}
+		quota = sql.NullInt64{Int64: n, Valid: true}
+	}
+	var find func() (*storageQuota, error)
+	switch {
+	case *userName != "":
+		u, err := s.FindUserByName(*userName)
+		if err != nil {
+			return errors.New("user not found: " + *userName)
+		}
+		if *set != "" {
+			if err := s.SetUserQuota(u.Id, quota); err != nil {
+				return err
+			}
+		}
+		find = func() (*storageQuota, error) { return s.FindUserStorage(u.Id) }
+	case *albumId != 0:
+		if *set != "" {
+			if err := s.SetAlbumQuota(*albumId, quota); err != nil {
+				return fmt.Errorf("album not found: %d", *albumId)
+			}
+		}
+		find = func() (*storageQuota, error) { return s.FindAlbumStorage(*albumId) }
+	default:
+		return errors.New("usage: video_album quota -user NAME|-album ID [-set SIZE|default]")
+	}
+	q, err := find()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("used:%s\tquota:%s\n", q.UsedText(), q.LimitText())
+	return nil
+}
+
+/*
+ * video_album dedup
+ *
+ * 同じ動画を1つにまとめて保存したことで節約できた容量を表示する.
+ */
+func runDedupCommand(s *Store, args []string) error {
+	fs := flag.NewFlagSet("dedup", flag.ExitOnError)
+	fs.Parse(args)
+
+	m, err := s.FindBlobStats()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("videos:%d\tstored:%s\n", m.Blobs, formatByteSize(m.StoredSize))
+	fmt.Printf("references:%d\twithout dedup:%s\n", m.References, formatByteSize(m.ReferencedSize))
+	fmt.Printf("saved:%s\n", formatByteSize(m.SavedSize()))
+	return nil
+}
+
+/*
+ * video_album migrate up
+ * video_album migrate status
+ *
+ * DBのスキーマの変更を適用する. 変更はサーバーの起動時にも適用される.
+ */
+func runMigrateCommand(s *Store, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: video_album migrate up|status")
+	}
+	fs := flag.NewFlagSet("migrate "+args[0], flag.ExitOnError)
+	fs.Parse(args[1:])
+
+	switch args[0] {
+	case "up":
+		applied, err := s.MigrateUp()
+		for _, m := range applied {
+			fmt.Printf("applied\t%d\t%s\n", m.Version, m.Name)
+		}
+		return err
+	case "status":
+		status, err := s.FindMigrationStatus()
+		if err != nil {
+			return err
+		}
+		for _, m := range status {
+			appliedAt := "pending"
+			if m.Applied() {
+				appliedAt = m.AppliedAt.Format("2006-01-02 15:04")
+			}
+			fmt.Printf("%d\t%s\t%s\n", m.Version, appliedAt, m.Name)
+		}
+		return nil
+	}
+	return errors.New("unknown migrate command: " + args[0])
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+/*
+ * dirのあるドライブの, 呼び出したユーザーが使える空き容量(バイト).
+ */
+func diskFree(dir string) (int64, error) {
+	kernel32, err := syscall.LoadDLL("kernel32.dll")
+	if err != nil {
+		return 0, err
+	}
+	proc, err := kernel32.FindProc("GetDiskFreeSpaceExW")
+	if err != nil {
+		return 0, err
+	}
+	p, err := syscall.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, err
+	}
+	var free uint64
+	if r, _, err := proc.Call(uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(&free)), 0, 0); r == 0 {
+		return 0, err
+	}
+	return int64(free), nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"io"
+	"mime"
+	"path"
+	"strings"
+)
+
+/*
+ * アップロードを受け付ける動画の形式.
+ * ファイル名の拡張子は中身から判定した形式に合わせる.
+ */
+type videoFormat struct {
+	Ext      string
+	MimeType string
+}
+
+var (
+	formatMP4      = &videoFormat{Ext: ".mp4", MimeType: "video/mp4"}
+	formatM4V      = &videoFormat{Ext: ".m4v", MimeType: "video/mp4"}
+	formatMOV      = &videoFormat{Ext: ".mov", MimeType: "video/quicktime"}
+	format3GP      = &videoFormat{Ext: ".3gp", MimeType: "video/3gpp"}
+	formatWebM     = &videoFormat{Ext: ".webm", MimeType: "video/webm"}
+	formatMatroska = &videoFormat{Ext: ".mkv", MimeType: "video/x-matroska"}
+	formatOgg      = &videoFormat{Ext: ".ogv", MimeType: "video/ogg"}
+	formatAVI      = &videoFormat{Ext: ".avi", MimeType: "video/x-msvideo"}
+)
+
+var videoFormats = []*videoFormat{formatMP4, formatM4V, formatMOV, format3GP, formatWebM, formatMatroska, formatOgg, formatAVI}
+
+var errNotVideo = errors.New("not a supported video file. use MP4, MOV, WebM, Matroska, Ogg or AVI")
+
+// 判定に読む先頭のバイト数
+const sniffLen = 512
+
+/*
+ * 先頭のバイト列から動画の形式を判定する.
+ * 動画でないか, 対応していない形式の場合はnilを返す.
+ */
+func detectVideoFormat(b []byte) *videoFormat {
+	switch {
+	case len(b) >= 12 && string(b[4:8]) == "ftyp":
+		// ISO BMFF. メジャーブランドで種類を見分ける
+		brand := string(b[8:12])
+		switch {
+		case brand == "qt  ":
+			return formatMOV
+		case strings.HasPrefix(brand, "M4V"):
+			return formatM4V
+		case strings.HasPrefix(brand, "3g"):
+			return format3GP
+		case strings.HasPrefix(brand, "M4A"), strings.HasPrefix(brand, "M4B"), brand == "heic", brand == "mif1", brand == "avif":
+			// 音声や画像の形式
+			return nil
+		}
+		return formatMP4
+	case len(b) >= 8 && isQuickTimeAtom(string(b[4:8])):
+		// ftypの無い古いQuickTime
+		return formatMOV
+	case bytes.HasPrefix(b, []byte{0x1a, 0x45, 0xdf, 0xa3}):
+		// EBMLヘッダのDocTypeでWebMかMatroskaかを見分ける
+		header := b
+		if len(header) > 64 {
+			header = header[:64]
+		}
+		if bytes.Contains(header, []byte("webm")) {
+			return formatWebM
+		}
+		return formatMatroska
+	case bytes.HasPrefix(b, []byte("OggS")):
+		return formatOgg
+	case len(b) >= 12 && string(b[0:4]) == "RIFF" && string(b[8:12]) == "AVI ":
+		return formatAVI
+	}
+	return nil
+}
+
+func isQuickTimeAtom(name string) bool {
+	switch name {
+	case "moov", "mdat", "wide", "free", "skip", "pnot":
+		return true
+	}
+	return false
+}
+
+/*
+ * rの先頭を読んで動画の形式を判定し, 読んだ分を戻したReaderと共に返す.
+ * 動画として扱えない場合はerrNotVideoを返す.
+ */
+func sniffVideo(r io.Reader) (*videoFormat, io.Reader, error) {
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, nil, err
+	}
+	head = head[:n]
+	f := detectVideoFormat(head)
+	if f == nil {
+		return nil, nil, errNotVideo
+	}
+	return f, io.MultiReader(bytes.NewReader(head), r), nil
+}
+
+/*
+ * 記録されたMIMEタイプを返す.
+ * 形式を記録する前に登録された動画は拡張子から決める.
+ */
+func videoMimeType(moviePath string, stored sql.NullString) string {
+	if moviePath == "" {
+		return ""
+	}
+	if stored.String != "" {
+		return stored.String
+	}
+	return contentTypeOf(moviePath)
+}
+
+/*
+ * 保存先のファイル名からContent-Typeを決める.
+ * アップロード時に拡張子を中身に合わせているため, 拡張子で判断してよい.
+ */
+func contentTypeOf(name string) string {
+	ext := strings.ToLower(path.Ext(name))
+	for _, f := range videoFormats {
+		if f.Ext == ext {
+			return f.MimeType
+		}
+	}
+	if ct, ok := streamContentTypes[ext]; ok {
+		return ct
+	}
+	return mime.TypeByExtension(ext)
+}
+
+// HLSのファイル. .tsはシステムによって別の形式として登録されていることがある
+var streamContentTypes = map[string]string{
+	".m3u8": "application/vnd.apple.mpegurl",
+	".ts":   "video/mp2t",
+}
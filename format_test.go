@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestDetectVideoFormat(t *testing.T) {
+	ebml := "\x1a\x45\xdf\xa3\x9f\x42\x86\x81\x01\x42\x82\x84"
+	tests := []struct {
+		head   string
+		expect *videoFormat
+	}{
+		{testMP4Box("ftyp", 8) + "isom", formatMP4},
+		{"\x00\x00\x00\x18ftypmp42", formatMP4},
+		{"\x00\x00\x00\x18ftypM4V ", formatM4V},
+		{"\x00\x00\x00\x14ftypqt  ", formatMOV},
+		{"\x00\x00\x00\x08wide\x00\x00\x00\x10mdat", formatMOV},
+		{"\x00\x00\x00\x18ftyp3gp4", format3GP},
+		{ebml + "webm", formatWebM},
+		{ebml + "matroska", formatMatroska},
+		{"OggS\x00\x02", formatOgg},
+		{"RIFF\x00\x00\x00\x00AVI LIST", formatAVI},
+		{"\x00\x00\x00\x18ftypM4A ", nil},
+		{"RIFF\x00\x00\x00\x00WAVEfmt ", nil},
+		{"\xff\xd8\xff\xe0\x00\x10JFIF", nil},
+		{"<html><body>", nil},
+		{"", nil},
+	}
+	for _, test := range tests {
+		if actual := detectVideoFormat([]byte(test.head)); actual != test.expect {
+			t.Errorf("形式の判定が異なります.head: %q, Expect: %v, Actual: %v", test.head, test.expect, actual)
+		}
+	}
+}
+
+func TestFilesave(t *testing.T) {
+	defer truncateTables()
+	s, cleanup := useTempStorage(t)
+	defer cleanup()
+
+	webm := "\x1a\x45\xdf\xa3\x9f\x42\x86\x81\x01\x42\x82\x84webm" + strings.Repeat("x", 1000)
+	name, err := testStore.filesave(strings.NewReader(webm))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte(webm))
+	if name != hex.EncodeToString(sum[:])+".webm" {
+		t.Errorf("名前が中身のハッシュと形式に合っていません.Actual: %v", name)
+	}
+	if contentTypeOf(name) != "video/webm" {
+		t.Errorf("Content-Typeが異なります.Actual: %v", contentTypeOf(name))
+	}
+	// 判定に読んだ先頭部分も含めて保存されている
+	obj, err := s.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(obj)
+	obj.Close()
+	if string(b) != webm {
+		t.Errorf("保存した内容が異なります.Expect: %d bytes, Actual: %d bytes", len(webm), len(b))
+	}
+
+	if _, err := testStore.filesave(strings.NewReader("this is not a video")); err != errNotVideo {
+		t.Errorf("動画でないファイルを保存できました.err: %v", err)
+	}
+	if files, _ := s.List(); len(files) != 1 {
+		t.Errorf("動画でないファイルが保存先に残っています.Actual: %v", files)
+	}
+}
+
+func TestVideoMimeType(t *testing.T) {
+	defer truncateTables()
+
+	m := &album{Title: "test title1"}
+	if err := testStore.SaveAlbum(m); err != nil {
+		t.Fatal(err)
+	}
+	// 形式を記録する前に登録された動画は拡張子から決める
+	p := &page{AlbumId: m.Id, Title: "test page title", Description: "desc", MoviePath: "old.mp4"}
+	if err := testStore.SavePage(p); err != nil {
+		t.Fatal(err)
+	}
+	if found, _ := testStore.FindPageById(p.Id); found.MimeType != "video/mp4" {
+		t.Errorf("以前の動画のMIMEタイプが異なります.Actual: %v", found.MimeType)
+	}
+	v, err := testStore.AddPageVideo(p, "new.mov", 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.MimeType != "video/quicktime" || p.MimeType != "video/quicktime" {
+		t.Errorf("新しい版のMIMEタイプが異なります.Actual: %v", p.MimeType)
+	}
+	videos, err := testStore.FindPageVideosByPageId(p.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testStore.RevertPageVideo(p, videos[1].Id); err != nil {
+		t.Fatal(err)
+	}
+	if found, _ := testStore.FindPageById(p.Id); found.MimeType != "video/mp4" {
+		t.Errorf("以前の版に戻した後のMIMEタイプが異なります.Actual: %v", found.MimeType)
+	}
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	_ "github.com/mattn/go-sqlite3"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// 修復時に問題のある動画ファイルを退避する場所. 検査の対象からは外す
+const quarantinePrefix = "quarantine/"
+
+/*
+ * fsckで検出する問題の種類.
+ */
+const (
+	// どのページからも参照されていないファイル
+	fsckOrphanFile = "orphan-file"
+	// ページが参照しているが存在しないファイル
+	fsckDanglingRef = "dangling-ref"
+	// 0バイトのファイル
+	fsckEmptyFile = "empty-file"
+	// アップロードが途中で切れたファイル
+	fsckTruncatedFile = "truncated-file"
+	// 存在しないアルバムに属するページ
+	fsckOrphanPage = "orphan-page"
+)
+
+type fsckIssue struct {
+	Kind   string
+	File   string // 保存先上の名前. ファイルに関係しない問題では空
+	PageId int64  // 関係するページ. ページに関係しない問題では0
+	Detail string
+}
+
+func (m *fsckIssue) String() string {
+	ret := m.Kind
+	if m.PageId != 0 {
+		ret += fmt.Sprintf("\tpage:%d", m.PageId)
+	}
+	if m.File != "" {
+		ret += "\t" + m.File
+	}
+	if m.Detail != "" {
+		ret += "\t" + m.Detail
+	}
+	return ret
+}
+
+type fsckPage struct {
+	Id       int64
+	AlbumId  int64
+	Filepath string
+	HasAlbum bool
+}
+
+/*
+ * 動画の版として記録されているファイルと, ページや動画の版のサムネイル, 変換後の動画とHLSのファイル,
+ * アップロード途中の断片を返す.
+ */
+func (s *Store) findVideoMovieFiles() ([]string, error) {
+	query := `
+		SELECT
+			filepath AS filepath
+		FROM
+			page_videos
+		UNION ALL
+		SELECT
+			thumbnail AS filepath
+		FROM
+			page_videos
+		UNION ALL
+		SELECT
+			thumbnail AS filepath
+		FROM
+			pages
+		UNION ALL
+		SELECT
+			filepath AS filepath
+		FROM
+			page_renditions
+		UNION ALL
+		SELECT
+			filepath AS filepath
+		FROM
+			page_stream_files
+		UNION ALL
+		SELECT
+			filepath AS filepath
+		FROM
+			upload_chunks
+	`
+	db := s.db
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ret := make([]string, 0)
+	for rows.Next() {
+		var file sql.NullString
+		if err := rows.Scan(&file); err != nil {
+			return nil, err
+		}
+		if file.String != "" {
+			ret = append(ret, file.String)
+		}
+	}
+	return ret, nil
+}
+
+func (s *Store) findFsckPages() ([]*fsckPage, error) {
+	query := `
+		SELECT
+			page.id AS id,
+			page.album_id AS album_id,
+			page.filepath AS filepath,
+			album.id IS NOT NULL AS has_album
+		FROM
+			pages page
+			LEFT JOIN albums album ON album.id = page.album_id
+		ORDER BY
+			page.id
+	`
+	db := s.db
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ret := make([]*fsckPage, 0)
+	for rows.Next() {
+		m := &fsckPage{}
+		var filepath sql.NullString
+		if err := rows.Scan(&m.Id, &m.AlbumId, &filepath, &m.HasAlbum); err != nil {
+			return nil, err
+		}
+		m.Filepath = filepath.String
+		ret = append(ret, m)
+	}
+	return ret, nil
+}
+
+/*
+ * DBのpages.filepathと保存先のファイルを突き合わせて問題を列挙する.
+ */
+func (s *Store) checkIntegrity() ([]*fsckIssue, error) {
+	pages, err := s.findFsckPages()
+	if err != nil {
+		return nil, err
+	}
+	files, err := movieStorage.List()
+	if err != nil {
+		return nil, err
+	}
+	stored := make(map[string]*storageInfo)
+	for _, f := range files {
+		if !strings.HasPrefix(f.Name, quarantinePrefix) {
+			stored[f.Name] = f
+		}
+	}
+
+	versions, err := s.findVideoMovieFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]*fsckIssue, 0)
+	referenced := make(map[string]bool)
+	for _, file := range versions {
+		referenced[file] = true
+	}
+	for _, p := range pages {
+		if !p.HasAlbum {
+			ret = append(ret, &fsckIssue{Kind: fsckOrphanPage, PageId: p.Id, File: p.Filepath, Detail: fmt.Sprintf("album:%d", p.AlbumId)})
+		}
+		if p.Filepath == "" {
+			continue
+		}
+		referenced[p.Filepath] = true
+		f, ok := stored[p.Filepath]
+		if !ok {
+			ret = append(ret, &fsckIssue{Kind: fsckDanglingRef, PageId: p.Id, File: p.Filepath})
+			continue
+		}
+		if f.Size == 0 {
+			ret = append(ret, &fsckIssue{Kind: fsckEmptyFile, PageId: p.Id, File: p.Filepath})
+			continue
+		}
+		if err := checkMovieFile(f); err != nil {
+			ret = append(ret, &fsckIssue{Kind: fsckTruncatedFile, PageId: p.Id, File: p.Filepath, Detail: err.Error()})
+		}
+	}
+	for _, f := range files {
+		if _, ok := stored[f.Name]; ok && !referenced[f.Name] {
+			ret = append(ret, &fsckIssue{Kind: fsckOrphanFile, File: f.Name, Detail: fmt.Sprintf("%d bytes", f.Size)})
+		}
+	}
+	return ret, nil
+}
+
+/*
+ * 動画ファイルが最後まで書き込まれているかを確認する.
+ * 今のところMP4, MOVなどのISO BMFFの形式のみ対象で, それ以外の形式は問題無しとする.
+ */
+func checkMovieFile(f *storageInfo) error {
+	switch strings.ToLower(path.Ext(f.Name)) {
+	case formatMP4.Ext, formatM4V.Ext, formatMOV.Ext, format3GP.Ext:
+	default:
+		return nil
+	}
+	obj, err := movieStorage.Open(f.Name)
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+	return checkMP4(obj, f.Size)
+}
+
+/*
+ * MP4のトップレベルのボックスを辿り, ファイルの末尾で途切れていないか確認する.
+ * 再生に必要なmoovボックスが無い場合もエラー.
+ */
+func checkMP4(r io.ReadSeeker, size int64) error {
+	hasMoov := false
+	var offset int64
+	for offset < size {
+		if size-offset < 8 {
+			return fmt.Errorf("box header at %d is cut off", offset)
+		}
+		if _, err := r.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+		header := make([]byte, 16)
+		if _, err := io.ReadFull(r, header[:8]); err != nil {
+			return err
+		}
+		boxSize := int64(binary.BigEndian.Uint32(header[:4]))
+		boxType := string(header[4:8])
+		switch boxSize {
+		case 0:
+			// ファイルの末尾まで続くボックス
+			boxSize = size - offset
+		case 1:
+			if size-offset < 16 {
+				return fmt.Errorf("box header at %d is cut off", offset)
+			}
+			if _, err := io.ReadFull(r, header[8:16]); err != nil {
+				return err
+			}
+			boxSize = int64(binary.BigEndian.Uint64(header[8:16]))
+		}
+		if boxSize < 8 {
+			return fmt.Errorf("invalid size of %q box at %d", boxType, offset)
+		}
+		if offset+boxSize > size {
+			return fmt.Errorf("%q box at %d needs %d bytes but only %d bytes left", boxType, offset, boxSize, size-offset)
+		}
+		if boxType == "moov" {
+			hasMoov = true
+		}
+		offset += boxSize
+	}
+	if !hasMoov {
+		return errors.New("moov box not found")
+	}
+	return nil
+}
+
+/*
+ * 動画ファイルを退避先へ移す.
+ */
+func quarantineMovieFile(name string) error {
+	obj, err := movieStorage.Open(name)
+	if err != nil {
+		return err
+	}
+	_, err = movieStorage.Put(quarantinePrefix+name, obj)
+	obj.Close()
+	if err != nil {
+		return err
+	}
+	return movieStorage.Delete(name)
+}
+
+/*
+ * 壊れたファイルや存在しないファイルへの参照を外し, ファイルを削除するか退避先へ移す.
+ * 同じ動画は複数のページで共有されるため, ファイルを参照している全てのページと動画の版が対象.
+ * 動画の記録も削除し, 同じ動画が再びアップロードされた場合は保存し直させる.
+ */
+func (s *Store) dropMovieFile(file string, removeFiles bool) error {
+	queries := []string{`
+		DELETE
+		FROM
+			page_renditions
+		WHERE
+			video_id IN (SELECT id FROM page_videos WHERE filepath = ?)
+	`, `
+		DELETE
+		FROM
+			page_stream_files
+		WHERE
+			video_id IN (SELECT id FROM page_videos WHERE filepath = ?)
+	`, `
+		DELETE
+		FROM
+			page_videos
+		WHERE
+			filepath = ?
+	`, `
+		UPDATE
+			pages
+		SET
+			filepath = ''
+		WHERE
+			filepath = ?
+	`, `
+		DELETE
+		FROM
+			blobs
+		WHERE
+			filepath = ?
+	`}
+	db := s.db
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if sum := blobSum(file); sum != "" {
+		if err := lockBlob(tx, sum); err != nil {
+			return err
+		}
+	}
+	for _, query := range queries {
+		if _, err := tx.Exec(query, file); err != nil {
+			return err
+		}
+	}
+	// 同じ動画が保存し直される前に, ロックしたまま削除する
+	if removeFiles {
+		err = movieStorage.Delete(file)
+	} else {
+		err = quarantineMovieFile(file)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return tx.Commit()
+}
+
+/*
+ * ページの動画のファイルを他のページも参照しているか.
+ */
+func (s *Store) movieFileShared(pageId int64, file string) (bool, error) {
+	query := `
+		SELECT
+			COUNT(*)
+		FROM
+			page_videos
+		WHERE
+			filepath = ?
+			AND page_id <> ?
+	`
+	db := s.db
+
+	var n int64
+	if err := db.QueryRow(query, file, pageId).Scan(&n); err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+/*
+ * 問題を修復する.
+ * ファイルはremoveFilesがtrueなら削除し, falseなら退避先へ移す.
+ * ファイルを参照しているページはファイル無しのページにし, 版の記録も削除する.
+ * 存在しないアルバムに属するページは削除する.
+ */
+func (s *Store) FixIssue(m *fsckIssue, removeFiles bool) error {
+	switch m.Kind {
+	case fsckOrphanFile, fsckDanglingRef, fsckEmptyFile, fsckTruncatedFile:
+		return s.dropMovieFile(m.File, removeFiles)
+	case fsckOrphanPage:
+		// ページの削除では参照の無くなったファイルが削除されるため, 退避する場合は先に移しておく.
+		// 他のページも参照しているファイルはそのまま残す
+		if m.File != "" && !removeFiles {
+			shared, err := s.movieFileShared(m.PageId, m.File)
+			if err != nil {
+				return err
+			}
+			if !shared {
+				if err := quarantineMovieFile(m.File); err != nil && !os.IsNotExist(err) {
+					return err
+				}
+			}
+		}
+		return s.RemovePage(&page{Id: m.PageId})
+	}
+	return errors.New("unknown issue: " + m.Kind)
+}
+
+/*
+ * video_album fsck [-fix] [-delete]
+ *
+ * 問題を標準出力に書き出す. -fixを指定しない場合, 問題があればエラーを返す.
+ */
+func runFsckCommand(s *Store, args []string) error {
+	fs := flag.NewFlagSet("fsck", flag.ExitOnError)
+	fix := fs.Bool("fix", false, "fix found problems. files are moved to "+quarantinePrefix+" of storage.")
+	remove := fs.Bool("delete", false, "with -fix, delete files instead of moving them.")
+	fs.Parse(args)
+
+	issues, err := s.checkIntegrity()
+	if err != nil {
+		return err
+	}
+	for _, m := range issues {
+		fmt.Println(m.String())
+	}
+	if !*fix {
+		if len(issues) > 0 {
+			return fmt.Errorf("%d problems found. run with -fix to repair.", len(issues))
+		}
+		return nil
+	}
+	for _, m := range issues {
+		if err := s.FixIssue(m, *remove); err != nil {
+			return fmt.Errorf("%s: %v", m.String(), err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/binary"
+	"os"
+	"strings"
+	"testing"
+)
+
+// トップレベルのボックスだけを持つ最小のMP4
+func testMP4Box(boxType string, size int) string {
+	b := make([]byte, size)
+	binary.BigEndian.PutUint32(b, uint32(size))
+	copy(b[4:], boxType)
+	return string(b)
+}
+
+func TestCheckMP4(t *testing.T) {
+	valid := testMP4Box("ftyp", 16) + testMP4Box("moov", 24) + testMP4Box("mdat", 32)
+	if err := checkMP4(strings.NewReader(valid), int64(len(valid))); err != nil {
+		t.Errorf("正しいMP4がエラーになりました.err: %v", err)
+	}
+	truncated := valid[:len(valid)-10]
+	if err := checkMP4(strings.NewReader(truncated), int64(len(truncated))); err == nil {
+		t.Errorf("途中で切れたMP4がエラーになりませんでした.")
+	}
+	noMoov := testMP4Box("ftyp", 16) + testMP4Box("mdat", 32)
+	if err := checkMP4(strings.NewReader(noMoov), int64(len(noMoov))); err == nil {
+		t.Errorf("moovの無いMP4がエラーになりませんでした.")
+	}
+}
+
+func TestFsck(t *testing.T) {
+	defer truncateTables()
+	s, cleanup := useTempStorage(t)
+	defer cleanup()
+
+	valid := testMP4Box("ftyp", 16) + testMP4Box("moov", 24) + testMP4Box("mdat", 32)
+	files := map[string]string{
+		"ok.mp4":        valid,
+		"orphan.mp4":    valid,
+		"empty.mp4":     "",
+		"truncated.mp4": valid[:30],
+		"lost.mp4":      valid,
+	}
+	for name, body := range files {
+		if _, err := s.Put(name, strings.NewReader(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a := &album{Title: "test title"}
+	if err := testStore.SaveAlbum(a); err != nil {
+		t.Fatal(err)
+	}
+	pages := make(map[string]*page)
+	for _, name := range []string{"ok.mp4", "empty.mp4", "truncated.mp4", "missing.mp4"} {
+		p := &page{AlbumId: a.Id, Title: "test page title", Description: "desc", MoviePath: name}
+		if err := testStore.SavePage(p); err != nil {
+			t.Fatal(err)
+		}
+		pages[name] = p
+	}
+	// 外部キー制約の無かった頃に作られた, アルバムの無いページ
+	db, closeDB, err := testStore.openMigrationDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeDB()
+	if _, err := db.Exec(`INSERT INTO pages (album_id, title, description, filepath) values(99999, 'lost', '', 'lost.mp4')`); err != nil {
+		t.Fatal(err)
+	}
+
+	issues, err := testStore.checkIntegrity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual := make(map[string]string)
+	for _, m := range issues {
+		actual[m.Kind+" "+m.File] = m.String()
+	}
+	for _, expect := range []string{
+		fsckOrphanFile + " orphan.mp4",
+		fsckEmptyFile + " empty.mp4",
+		fsckTruncatedFile + " truncated.mp4",
+		fsckDanglingRef + " missing.mp4",
+		fsckOrphanPage + " lost.mp4",
+	} {
+		if _, ok := actual[expect]; !ok {
+			t.Errorf("問題が検出されませんでした.Expect: %v, Actual: %v", expect, actual)
+		}
+	}
+	if len(issues) != 5 {
+		t.Errorf("検出された問題の数が異なります.Expect: 5, Actual: %v", actual)
+	}
+
+	for _, m := range issues {
+		if err := testStore.FixIssue(m, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	issues, err = testStore.checkIntegrity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(issues) != 0 {
+		t.Errorf("修復後にも問題が残っています.Actual: %v", issues)
+	}
+	for _, name := range []string{"orphan.mp4", "empty.mp4", "truncated.mp4", "lost.mp4"} {
+		if _, err := s.Stat(quarantinePrefix + name); err != nil {
+			t.Errorf("ファイルが退避されていません.file: %v, err: %v", name, err)
+		}
+		if _, err := s.Stat(name); !os.IsNotExist(err) {
+			t.Errorf("退避したファイルが残っています.file: %v, err: %v", name, err)
+		}
+	}
+	if p, err := testStore.FindPageById(pages["ok.mp4"].Id); err != nil || p.MoviePath != "ok.mp4" {
+		t.Errorf("問題の無いページが変更されました.")
+	}
+	if p, err := testStore.FindPageById(pages["missing.mp4"].Id); err != nil || p.MoviePath != "" {
+		t.Errorf("存在しないファイルへの参照が外れていません.")
+	}
+}
+
+func TestFsckSharedMovie(t *testing.T) {
+	for _, removeFiles := range []bool{false, true} {
+		func() {
+			defer truncateTables()
+			s, cleanup := useTempStorage(t)
+			defer cleanup()
+
+			a := &album{Title: "test title"}
+			if err := testStore.SaveAlbum(a); err != nil {
+				t.Fatal(err)
+			}
+			addVideo := func(p *page, video string) string {
+				moviePath, err := testStore.filesave(strings.NewReader(video))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := testStore.AddPageVideo(p, moviePath, 0, ""); err != nil {
+					t.Fatal(err)
+				}
+				return moviePath
+			}
+			// 途中で切れた動画を2つのページで共有する
+			truncated := testUploadVideo()[:100]
+			broken := make([]*page, 2)
+			var brokenPath string
+			for i := range broken {
+				broken[i] = &page{AlbumId: a.Id, Title: "broken", Description: "desc"}
+				if err := testStore.SavePage(broken[i]); err != nil {
+					t.Fatal(err)
+				}
+				brokenPath = addVideo(broken[i], truncated)
+			}
+			// アルバムの無いページと共有している動画
+			ok := &page{AlbumId: a.Id, Title: "ok", Description: "desc"}
+			if err := testStore.SavePage(ok); err != nil {
+				t.Fatal(err)
+			}
+			okPath := addVideo(ok, testUploadVideo())
+			db, closeDB, err := testStore.openMigrationDB()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer closeDB()
+			lostId, err := db.Insert(`INSERT INTO pages (album_id, title, description, filepath) values(99999, 'lost', '', '')`)
+			if err != nil {
+				t.Fatal(err)
+			}
+			addVideo(&page{Id: lostId}, testUploadVideo())
+
+			issues, err := testStore.checkIntegrity()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(issues) != 3 {
+				t.Errorf("検出された問題の数が異なります.Expect: 3, Actual: %v", issues)
+			}
+			for _, m := range issues {
+				if err := testStore.FixIssue(m, removeFiles); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if issues, _ := testStore.checkIntegrity(); len(issues) != 0 {
+				t.Errorf("修復後にも問題が残っています.removeFiles: %v, Actual: %v", removeFiles, issues)
+			}
+
+			// 壊れた動画は共有している全てのページから外れ, 動画の記録も無くなる
+			if _, err := s.Stat(brokenPath); !os.IsNotExist(err) {
+				t.Errorf("壊れた動画が残っています.removeFiles: %v, err: %v", removeFiles, err)
+			}
+			if _, err := s.Stat(quarantinePrefix + brokenPath); (err == nil) == removeFiles {
+				t.Errorf("壊れた動画の退避が誤っています.removeFiles: %v, err: %v", removeFiles, err)
+			}
+			for _, p := range broken {
+				if found, err := testStore.FindPageById(p.Id); err != nil || found.MoviePath != "" {
+					t.Errorf("壊れた動画への参照が外れていません.page: %v", p.Id)
+				}
+				if videos, _ := testStore.FindPageVideosByPageId(p.Id); len(videos) != 0 {
+					t.Errorf("壊れた動画の版が残っています.page: %v", p.Id)
+				}
+			}
+			// アルバムの無いページを削除しても, 他のページが参照している動画は残す
+			if _, err := s.Stat(okPath); err != nil {
+				t.Errorf("他のページが参照している動画が移されました.removeFiles: %v, err: %v", removeFiles, err)
+			}
+			stats, err := testStore.FindBlobStats()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stats.Blobs != 1 || stats.References != 1 {
+				t.Errorf("動画の記録が誤っています.Actual: %+v", stats)
+			}
+
+			// 同じ動画が再びアップロードされたら保存し直す
+			if moviePath, err := testStore.filesave(strings.NewReader(truncated)); err != nil {
+				t.Fatal(err)
+			} else if _, err := s.Stat(moviePath); err != nil {
+				t.Errorf("再びアップロードされた動画が保存されていません.err: %v", err)
+			}
+		}()
+	}
+}
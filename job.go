@@ -0,0 +1,694 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	_ "github.com/mattn/go-sqlite3"
+	"log"
+	"sync"
+	"time"
+)
+
+/*
+ * アップロード後の動画の処理.
+ * jobsテーブルに記録し, ワーカーのgoroutineが順に実行する.
+ * 失敗した処理は間隔を空けて再試行し, 再起動しても続きから実行する.
+ */
+type job struct {
+	Id        int64
+	Kind      string
+	PageId    int64
+	VideoId   int64
+	State     string
+	Attempts  int
+	LastError string
+	RunAt     time.Time
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	// 管理画面の表示用. ページが削除されていれば空
+	AlbumId   int64
+	PageTitle string
+}
+
+// 処理の種類
+const (
+	jobProbe     = "probe"
+	jobThumbnail = "thumbnail"
+	jobTranscode = "transcode"
+)
+
+// 処理の状態
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobDone      = "done"
+	jobFailed    = "failed"
+	jobCancelled = "cancelled"
+)
+
+var jobStates = []string{jobQueued, jobRunning, jobDone, jobFailed, jobCancelled}
+
+// 処理の種類毎の実行内容
+var jobHandlers = map[string]func(s *Store, j *job) error{
+	jobProbe:     runProbeJob,
+	jobThumbnail: runThumbnailJob,
+	jobTranscode: runTranscodeJob,
+}
+
+var (
+	// 失敗した処理を何回まで試すか
+	jobMaxAttempts = 3
+	// 1回目の再試行までの間隔. 以降は倍々に伸ばす
+	jobRetryDelay    = 30 * time.Second
+	jobMaxRetryDelay = 30 * time.Minute
+	// 処理が無い時に新しい処理を確認する間隔
+	jobPollInterval = 5 * time.Second
+	// 実行中の処理の生存を記録する間隔. 記録がjobLeaseTimeout途絶えた処理は中断されたとみなす
+	jobHeartbeatInterval = 30 * time.Second
+	jobLeaseTimeout      = 5 * time.Minute
+)
+
+// 処理が追加されたことを待機中のワーカーに知らせる
+var jobWake = make(chan struct{}, 1)
+
+// SQLiteで複数のワーカーが同じ処理を取らないようにする
+var jobClaimLock sync.Mutex
+
+/*
+ * 処理を追加する.
+ */
+func (s *Store) enqueueJob(kind string, pageId int64, videoId int64) error {
+	query := `
+		INSERT INTO jobs (kind, page_id, video_id, state, attempts, last_error, run_at, created_at, updated_at) values(?, ?, ?, ?, 0, '', ?, ?, ?)
+	`
+	db := s.db
+
+	now := time.Now().Unix()
+	if _, err := db.Exec(query, kind, pageId, videoId, jobQueued, now, now, now); err != nil {
+		return err
+	}
+	select {
+	case jobWake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+/*
+ * アップロードされた動画の版の処理を追加する.
+ * 動画の情報を調べた後に変換するため, 変換は調べ終わってから追加する.
+ */
+func (s *Store) queueMediaJobs(v *pageVideo) error {
+	if len(renditionHeights) > 0 {
+		if err := s.setVideoStatus(v.Id, videoProcessing); err != nil {
+			return err
+		}
+	}
+	if err := s.enqueueJob(jobProbe, v.PageId, v.Id); err != nil {
+		return err
+	}
+	return s.enqueueJob(jobThumbnail, v.PageId, v.Id)
+}
+
+/*
+ * 処理が終わった後に続けて行う処理を追加する.
+ */
+func (s *Store) enqueueNextJob(j *job) error {
+	if j.Kind == jobProbe && len(renditionHeights) > 0 {
+		// 調べられなかった場合も, 全ての高さで変換を試みる
+		return s.enqueueJob(jobTranscode, j.PageId, j.VideoId)
+	}
+	return nil
+}
+
+/*
+ * 実行時刻を過ぎた処理を1つ取り出し, 実行中にする.
+ * 無ければnilを返す.
+ */
+func (s *Store) claimJob(now time.Time) (*job, error) {
+	selectQuery := `
+		SELECT` + jobColumns + `
+		WHERE
+			job.id = ?
+	`
+	db := s.db
+
+	var id int64
+	var err error
+	if db.dialect == dialectPostgres {
+		id, err = s.claimJobIdPostgres(now)
+	} else {
+		id, err = s.claimJobId(now)
+	}
+	if err != nil || id == 0 {
+		return nil, err
+	}
+	return scanJob(db.QueryRow(selectQuery, id))
+}
+
+/*
+ * 取り出す処理を選んでから実行中にする.
+ * SQLiteは書き込みが1つずつ行われるため, 同じプロセスのワーカーの間でだけ重ならないようにする.
+ */
+func (s *Store) claimJobId(now time.Time) (int64, error) {
+	selectQuery := `
+		SELECT
+			id
+		FROM
+			jobs
+		WHERE
+			state = ?
+			AND run_at <= ?
+		ORDER BY
+			run_at,
+			id
+		LIMIT 1
+	`
+	updateQuery := `
+		UPDATE
+			jobs
+		SET
+			state = ?,
+			attempts = attempts + 1,
+			updated_at = ?
+		WHERE
+			id = ?
+			AND state = ?
+	`
+	jobClaimLock.Lock()
+	defer jobClaimLock.Unlock()
+
+	db := s.db
+
+	var id int64
+	err := db.QueryRow(selectQuery, jobQueued, now.Unix()).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	res, err := db.Exec(updateQuery, jobRunning, time.Now().Unix(), id, jobQueued)
+	if err != nil {
+		return 0, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		// 取り出す間に取り消された
+		return 0, err
+	}
+	return id, nil
+}
+
+/*
+ * 処理を選ぶと同時に実行中にする.
+ * 複数のサーバーのワーカーが同時に取り出しても, 他が選んでいる処理は飛ばして別の処理を取る.
+ */
+func (s *Store) claimJobIdPostgres(now time.Time) (int64, error) {
+	query := `
+		UPDATE
+			jobs
+		SET
+			state = ?,
+			attempts = attempts + 1,
+			updated_at = ?
+		WHERE
+			id = (
+				SELECT
+					id
+				FROM
+					jobs
+				WHERE
+					state = ?
+					AND run_at <= ?
+				ORDER BY
+					run_at,
+					id
+				LIMIT 1
+				FOR UPDATE SKIP LOCKED
+			)
+		RETURNING
+			id
+	`
+	db := s.db
+
+	var id int64
+	err := db.QueryRow(query, jobRunning, time.Now().Unix(), jobQueued, now.Unix()).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return id, err
+}
+
+/*
+ * 実行中の処理の状態を更新する.
+ * 実行中にページが削除され取り消された処理は更新しない.
+ */
+func (s *Store) finishJob(m *job, state string, lastError string, runAt time.Time) (bool, error) {
+	query := `
+		UPDATE
+			jobs
+		SET
+			state = ?,
+			last_error = ?,
+			run_at = ?,
+			updated_at = ?
+		WHERE
+			id = ?
+			AND state = ?
+	`
+	db := s.db
+
+	res, err := db.Exec(query, state, lastError, runAt.Unix(), time.Now().Unix(), m.Id, jobRunning)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil || n == 0 {
+		return false, err
+	}
+	m.State = state
+	m.LastError = lastError
+	m.RunAt = runAt
+	return true, nil
+}
+
+/*
+ * n回目の失敗の後, 再試行するまでの間隔.
+ */
+func jobBackoff(attempts int) time.Duration {
+	d := jobRetryDelay
+	for i := 1; i < attempts && d < jobMaxRetryDelay; i++ {
+		d *= 2
+	}
+	if d > jobMaxRetryDelay {
+		d = jobMaxRetryDelay
+	}
+	return d
+}
+
+/*
+ * 取り出した処理を実行し, 結果を記録する.
+ */
+func (s *Store) runJob(j *job) error {
+	stop := s.keepJobAlive(j)
+	err := callJobHandler(s, j)
+	stop()
+	now := time.Now()
+	if err == nil {
+		updated, ferr := s.finishJob(j, jobDone, "", now)
+		if ferr != nil || !updated {
+			return ferr
+		}
+		return s.enqueueNextJob(j)
+	}
+	log.Printf("job:%d %s video:%d attempt %d: %v\n", j.Id, j.Kind, j.VideoId, j.Attempts, err)
+	if j.Attempts < jobMaxAttempts {
+		if j.Kind == jobTranscode {
+			// 失敗した時点で変換失敗になるため, 再試行を待つ間は変換中に戻す
+			if serr := s.setVideoStatus(j.VideoId, videoProcessing); serr != nil {
+				return serr
+			}
+		}
+		_, ferr := s.finishJob(j, jobQueued, err.Error(), now.Add(jobBackoff(j.Attempts)))
+		return ferr
+	}
+	updated, ferr := s.finishJob(j, jobFailed, err.Error(), now)
+	if ferr != nil || !updated {
+		return ferr
+	}
+	return s.enqueueNextJob(j)
+}
+
+func callJobHandler(s *Store, j *job) (err error) {
+	handler, ok := jobHandlers[j.Kind]
+	if !ok {
+		return errors.New("unknown job kind: " + j.Kind)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return handler(s, j)
+}
+
+/*
+ * 動画の版の処理で, 対象のページを組み立てる.
+ * ページが現在別の版を表示していても, 処理はその版の動画に対して行う.
+ * 処理を待つ間に削除されていればnilを返す.
+ */
+func (s *Store) jobPageVideo(j *job) (*page, error) {
+	v, err := s.FindPageVideoById(j.VideoId)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &page{Id: v.PageId, MoviePath: v.MoviePath}, nil
+}
+
+func runProbeJob(s *Store, j *job) error {
+	p, err := s.jobPageVideo(j)
+	if err != nil || p == nil {
+		return err
+	}
+	return s.probeMedia(p)
+}
+
+func runThumbnailJob(s *Store, j *job) error {
+	p, err := s.jobPageVideo(j)
+	if err != nil || p == nil {
+		return err
+	}
+	return s.createThumbnail(p)
+}
+
+func runTranscodeJob(s *Store, j *job) error {
+	return s.transcodeVideo(j.VideoId)
+}
+
+/*
+ * 処理を実行している間, 定期的に生存を記録する.
+ * 返した関数を呼ぶと記録をやめる.
+ */
+func (s *Store) keepJobAlive(j *job) func() {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(jobHeartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := s.touchJob(j); err != nil {
+					log.Println("job:", err)
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+func (s *Store) touchJob(m *job) error {
+	query := `
+		UPDATE
+			jobs
+		SET
+			updated_at = ?
+		WHERE
+			id = ?
+			AND state = ?
+	`
+	db := s.db
+
+	_, err := db.Exec(query, time.Now().Unix(), m.Id, jobRunning)
+	return err
+}
+
+/*
+ * 実行中のまま, beforeより後に生存が記録されていない処理を実行待ちに戻す.
+ * 実行していたサーバーが途中で終了した処理のため.
+ */
+func (s *Store) resetRunningJobs(before time.Time) error {
+	query := `
+		UPDATE
+			jobs
+		SET
+			state = ?,
+			updated_at = ?
+		WHERE
+			state = ?
+			AND updated_at < ?
+	`
+	db := s.db
+
+	_, err := db.Exec(query, jobQueued, time.Now().Unix(), jobRunning, before.Unix())
+	return err
+}
+
+/*
+ * 変換中のまま変換の処理が無い版の変換を追加する.
+ * 処理を記録する前から変換中だった版のため.
+ */
+func (s *Store) enqueueUnqueuedTranscodes() error {
+	query := `
+		SELECT
+			video.id AS id,
+			video.page_id AS page_id
+		FROM
+			page_videos video
+		WHERE
+			video.status = ?
+			AND NOT EXISTS (
+				SELECT 1 FROM jobs job WHERE job.video_id = video.id AND job.state IN (?, ?)
+			)
+		ORDER BY
+			video.id
+	`
+	db := s.db
+
+	rows, err := db.Query(query, videoProcessing, jobQueued, jobRunning)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	videos := make([]*pageVideo, 0)
+	for rows.Next() {
+		v := &pageVideo{}
+		if err := rows.Scan(&v.Id, &v.PageId); err != nil {
+			return err
+		}
+		videos = append(videos, v)
+	}
+	for _, v := range videos {
+		if err := s.enqueueJob(jobTranscode, v.PageId, v.Id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+ * 処理を実行するワーカーのgoroutineをn個起動する.
+ * 実行中のまま生存の記録が途絶えた処理は, 中断されたものとして定期的に実行待ちに戻す.
+ * PostgreSQLを複数のサーバーで使う場合も, 他のサーバーが実行中の処理には触れない.
+ */
+func startJobWorkers(s *Store, n int) error {
+	if n == 0 {
+		return nil
+	}
+	if err := s.enqueueUnqueuedTranscodes(); err != nil {
+		return err
+	}
+	go func() {
+		for {
+			if err := s.resetRunningJobs(time.Now().Add(-jobLeaseTimeout)); err != nil {
+				log.Println("job:", err)
+			}
+			time.Sleep(jobHeartbeatInterval)
+		}
+	}()
+	for i := 0; i < n; i++ {
+		go jobWorker(s)
+	}
+	return nil
+}
+
+func jobWorker(s *Store) {
+	for {
+		j, err := s.claimJob(time.Now())
+		if err != nil {
+			log.Println("job:", err)
+		}
+		if j == nil {
+			select {
+			case <-jobWake:
+			case <-time.After(jobPollInterval):
+			}
+			continue
+		}
+		if err := s.runJob(j); err != nil {
+			log.Println("job:", err)
+		}
+	}
+}
+
+/*
+ * ページの未完了の処理を取り消す.
+ * ページの削除と同じトランザクションで呼ぶ.
+ * 実行中の処理は最後まで実行されるが, 結果は記録されない.
+ */
+func cancelPageJobs(tx *storeTx, pageCond string, args ...interface{}) error {
+	query := `
+		UPDATE
+			jobs
+		SET
+			state = ?,
+			updated_at = ?
+		WHERE
+			state IN (?, ?)
+			AND page_id IN (` + pageCond + `)
+	`
+	_, err := tx.Exec(query, append([]interface{}{jobCancelled, time.Now().Unix(), jobQueued, jobRunning}, args...)...)
+	return err
+}
+
+/*
+ * 失敗した処理をもう一度実行待ちにする.
+ */
+func (s *Store) RetryJob(m *job) error {
+	query := `
+		UPDATE
+			jobs
+		SET
+			state = ?,
+			attempts = 0,
+			run_at = ?,
+			updated_at = ?
+		WHERE
+			id = ?
+			AND state = ?
+	`
+	db := s.db
+
+	now := time.Now().Unix()
+	res, err := db.Exec(query, jobQueued, now, now, m.Id, jobFailed)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errors.New("only failed jobs can be retried")
+	}
+	if m.Kind == jobTranscode {
+		if err := s.setVideoStatus(m.VideoId, videoProcessing); err != nil {
+			return err
+		}
+	}
+	m.State = jobQueued
+	m.Attempts = 0
+	select {
+	case jobWake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+const jobColumns = `
+			job.id AS id,
+			job.kind AS kind,
+			job.page_id AS page_id,
+			job.video_id AS video_id,
+			job.state AS state,
+			job.attempts AS attempts,
+			job.last_error AS last_error,
+			job.run_at AS run_at,
+			job.created_at AS created_at,
+			job.updated_at AS updated_at,
+			page.album_id AS album_id,
+			page.title AS page_title
+		FROM
+			jobs job
+			LEFT JOIN pages page ON page.id = job.page_id
+`
+
+func scanJob(row interface {
+	Scan(dest ...interface{}) error
+}) (*job, error) {
+	m := &job{}
+	var runAt, createdAt, updatedAt int64
+	var albumId sql.NullInt64
+	var pageTitle sql.NullString
+	if err := row.Scan(&m.Id, &m.Kind, &m.PageId, &m.VideoId, &m.State, &m.Attempts, &m.LastError, &runAt, &createdAt, &updatedAt, &albumId, &pageTitle); err != nil {
+		return nil, err
+	}
+	m.RunAt = time.Unix(runAt, 0)
+	m.CreatedAt = time.Unix(createdAt, 0)
+	m.UpdatedAt = time.Unix(updatedAt, 0)
+	m.AlbumId = albumId.Int64
+	m.PageTitle = pageTitle.String
+	return m, nil
+}
+
+func (s *Store) FindJobById(id int64) (*job, error) {
+	query := `
+		SELECT` + jobColumns + `
+		WHERE
+			job.id = ?
+	`
+	db := s.db
+
+	return scanJob(db.QueryRow(query, id))
+}
+
+/*
+ * 処理を新しい順に返す. stateが空の場合は全ての状態が対象.
+ */
+func (s *Store) FindJobs(state string, limit int) ([]*job, error) {
+	query := `
+		SELECT` + jobColumns + `
+		WHERE
+			? = '' OR job.state = ?
+		ORDER BY
+			job.id DESC
+		LIMIT ?
+	`
+	db := s.db
+
+	rows, err := db.Query(query, state, state, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ret := make([]*job, 0)
+	for rows.Next() {
+		m, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, m)
+	}
+	return ret, nil
+}
+
+/*
+ * 状態毎の処理の件数を返す.
+ */
+func (s *Store) CountJobsByState() (map[string]int, error) {
+	query := `
+		SELECT
+			state,
+			COUNT(*)
+		FROM
+			jobs
+		GROUP BY
+			state
+	`
+	db := s.db
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ret := make(map[string]int)
+	for _, state := range jobStates {
+		ret[state] = 0
+	}
+	for rows.Next() {
+		var state string
+		var n int
+		if err := rows.Scan(&state, &n); err != nil {
+			return nil, err
+		}
+		ret[state] = n
+	}
+	return ret, nil
+}
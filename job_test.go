@@ -0,0 +1,422 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 再試行を待たずに全ての処理を取り出すため
+var jobFarFuture = time.Now().Add(365 * 24 * time.Hour)
+
+/*
+ * 実行できる処理が無くなるまで順に実行する.
+ */
+func drainJobs(t *testing.T) {
+	for {
+		j, err := testStore.claimJob(jobFarFuture)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if j == nil {
+			return
+		}
+		if err := testStore.runJob(j); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestJobPipeline(t *testing.T) {
+	defer truncateTables()
+	s, cleanup := useTempStorage(t)
+	defer cleanup()
+	defer useFakeMediaTools()()
+	defer useFakeTranscoder(&fakeTranscoder{})()
+
+	m := &album{Title: "test title1"}
+	if err := testStore.SaveAlbum(m); err != nil {
+		t.Fatal(err)
+	}
+	p := &page{AlbumId: m.Id, Title: "test page title", Description: "desc"}
+	if err := testStore.SavePage(p); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Put("a.mp4", strings.NewReader("h264")); err != nil {
+		t.Fatal(err)
+	}
+	v, err := testStore.AddPageVideo(p, "a.mp4", 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testStore.queueMediaJobs(v); err != nil {
+		t.Fatal(err)
+	}
+	if found, _ := testStore.FindPageById(p.Id); !found.Processing || found.Thumbnail != "" || found.Media != nil {
+		t.Errorf("処理の実行前にページが更新されています.Actual: %+v", found)
+	}
+
+	drainJobs(t)
+
+	found, err := testStore.FindPageById(p.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.Processing {
+		t.Errorf("処理の実行後もページが変換中のままです.")
+	}
+	if found.Thumbnail != "a.jpg" {
+		t.Errorf("サムネイルが登録されていません.Actual: %v", found.Thumbnail)
+	}
+	if found.Media == nil || found.Media.Height != 36 {
+		t.Errorf("動画の情報が登録されていません.Actual: %+v", found.Media)
+	}
+	// 高さ36の動画は拡大せず元の高さで変換する
+	if renditions, _ := testStore.FindRenditionsByVideoId(v.Id); len(renditions) != 1 || renditions[0].Height != 36 {
+		t.Errorf("変換後の動画が異なります.Actual: %v", renditions)
+	}
+	jobs, err := testStore.FindJobs("", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kinds := make([]string, 0)
+	for _, j := range jobs {
+		if j.State != jobDone || j.Attempts != 1 {
+			t.Errorf("処理が完了していません.Actual: %+v", j)
+		}
+		if j.PageTitle != p.Title || j.AlbumId != m.Id {
+			t.Errorf("処理のページが異なります.Actual: %+v", j)
+		}
+		kinds = append(kinds, j.Kind)
+	}
+	if strings.Join(kinds, ",") != "transcode,thumbnail,probe" {
+		t.Errorf("実行された処理が異なります.Actual: %v", kinds)
+	}
+	counts, err := testStore.CountJobsByState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts[jobDone] != 3 || counts[jobQueued] != 0 {
+		t.Errorf("状態毎の件数が異なります.Actual: %v", counts)
+	}
+}
+
+/*
+ * テスト用の処理の種類を登録する. failures回失敗した後に成功する.
+ */
+func useFailingJob(failures int) (string, *int, func()) {
+	kind := "test"
+	calls := 0
+	jobHandlers[kind] = func(s *Store, j *job) error {
+		calls++
+		if calls <= failures {
+			return errors.New("failure " + strconv.Itoa(calls))
+		}
+		return nil
+	}
+	return kind, &calls, func() { delete(jobHandlers, kind) }
+}
+
+func TestJobRetry(t *testing.T) {
+	defer truncateTables()
+	kind, calls, cleanup := useFailingJob(5)
+	defer cleanup()
+
+	if err := testStore.enqueueJob(kind, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+	j, err := testStore.claimJob(time.Now())
+	if err != nil || j == nil {
+		t.Fatalf("実行待ちの処理を取り出せません.err: %v", err)
+	}
+	if again, _ := testStore.claimJob(jobFarFuture); again != nil {
+		t.Errorf("実行中の処理を重ねて取り出せました.")
+	}
+	before := time.Now()
+	if err := testStore.runJob(j); err != nil {
+		t.Fatal(err)
+	}
+	found, err := testStore.FindJobById(j.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.State != jobQueued || found.Attempts != 1 || found.LastError != "failure 1" {
+		t.Errorf("失敗した処理が再試行待ちになっていません.Actual: %+v", found)
+	}
+	if found.RunAt.Before(before.Add(jobRetryDelay).Truncate(time.Second)) {
+		t.Errorf("再試行までの間隔が空いていません.Actual: %v", found.RunAt)
+	}
+	if next, _ := testStore.claimJob(time.Now()); next != nil {
+		t.Errorf("再試行の時刻前に処理を取り出せました.")
+	}
+
+	drainJobs(t)
+	if *calls != jobMaxAttempts {
+		t.Errorf("試行回数が異なります.Expect: %v, Actual: %v", jobMaxAttempts, *calls)
+	}
+	found, _ = testStore.FindJobById(j.Id)
+	if found.State != jobFailed || found.LastError != "failure 3" {
+		t.Errorf("最後まで失敗した処理が失敗になっていません.Actual: %+v", found)
+	}
+
+	if err := testStore.RetryJob(found); err != nil {
+		t.Fatal(err)
+	}
+	if err := testStore.RetryJob(found); err == nil {
+		t.Errorf("失敗していない処理を再実行できました.")
+	}
+	drainJobs(t)
+	found, _ = testStore.FindJobById(j.Id)
+	if found.State != jobDone || found.Attempts != 3 || *calls != 6 {
+		t.Errorf("再実行した処理の状態が異なります.Actual: %+v", found)
+	}
+}
+
+func TestJobBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		expect   time.Duration
+	}{
+		{1, jobRetryDelay},
+		{2, jobRetryDelay * 2},
+		{3, jobRetryDelay * 4},
+		{100, jobMaxRetryDelay},
+	}
+	for _, test := range tests {
+		if actual := jobBackoff(test.attempts); actual != test.expect {
+			t.Errorf("再試行までの間隔が異なります.attempts: %v, Expect: %v, Actual: %v", test.attempts, test.expect, actual)
+		}
+	}
+}
+
+func TestJobPanic(t *testing.T) {
+	defer truncateTables()
+	jobHandlers["test"] = func(s *Store, j *job) error {
+		panic("boom")
+	}
+	defer delete(jobHandlers, "test")
+
+	if err := testStore.enqueueJob("test", 1, 1); err != nil {
+		t.Fatal(err)
+	}
+	drainJobs(t)
+	jobs, _ := testStore.FindJobs(jobFailed, 10)
+	if len(jobs) != 1 || jobs[0].LastError != "panic: boom" {
+		t.Errorf("パニックした処理が失敗になっていません.Actual: %v", jobs)
+	}
+}
+
+func TestJobCancelledOnRemove(t *testing.T) {
+	defer truncateTables()
+	_, cleanup := useTempStorage(t)
+	defer cleanup()
+	kind, calls, cleanupJob := useFailingJob(0)
+	defer cleanupJob()
+
+	m := &album{Title: "test title1"}
+	if err := testStore.SaveAlbum(m); err != nil {
+		t.Fatal(err)
+	}
+	pages := make([]*page, 0)
+	for i := 0; i < 3; i++ {
+		p := &page{AlbumId: m.Id, Title: "test page title", Description: "desc"}
+		if err := testStore.SavePage(p); err != nil {
+			t.Fatal(err)
+		}
+		if err := testStore.enqueueJob(kind, p.Id, 0); err != nil {
+			t.Fatal(err)
+		}
+		pages = append(pages, p)
+	}
+	// 実行中に削除された処理は, 終わっても取り消されたまま
+	running, err := testStore.claimJob(time.Now())
+	if err != nil || running == nil || running.PageId != pages[0].Id {
+		t.Fatalf("処理を取り出せません.err: %v", err)
+	}
+	if err := testStore.RemovePage(pages[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := testStore.runJob(running); err != nil {
+		t.Fatal(err)
+	}
+	if found, _ := testStore.FindJobById(running.Id); found.State != jobCancelled {
+		t.Errorf("実行中に削除されたページの処理の状態が異なります.Actual: %v", found.State)
+	}
+
+	if err := testStore.RemovePage(pages[1]); err != nil {
+		t.Fatal(err)
+	}
+	drainJobs(t)
+	if *calls != 2 {
+		t.Errorf("削除されたページの処理が実行されました.Actual: %v", *calls)
+	}
+	if err := testStore.enqueueJob(kind, pages[2].Id, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := testStore.RemoveAlbum(m); err != nil {
+		t.Fatal(err)
+	}
+	counts, err := testStore.CountJobsByState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts[jobCancelled] != 3 || counts[jobDone] != 1 || counts[jobQueued] != 0 {
+		t.Errorf("状態毎の件数が異なります.Actual: %v", counts)
+	}
+}
+
+func TestResetRunningJobs(t *testing.T) {
+	defer truncateTables()
+
+	if err := testStore.enqueueJob(jobProbe, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+	j, err := testStore.claimJob(time.Now())
+	if err != nil || j == nil {
+		t.Fatalf("処理を取り出せません.err: %v", err)
+	}
+	// 生存が記録されている処理は, 他のサーバーが実行中のため戻さない
+	if err := testStore.resetRunningJobs(time.Now().Add(-jobLeaseTimeout)); err != nil {
+		t.Fatal(err)
+	}
+	if again, err := testStore.claimJob(time.Now()); err != nil || again != nil {
+		t.Fatalf("実行中の処理を取り出しました.err: %v, Actual: %v", err, again)
+	}
+	// 生存の記録が途絶えた処理は, 実行していたサーバーが終了したものとしてもう一度実行する
+	if err := testStore.resetRunningJobs(time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	again, err := testStore.claimJob(time.Now())
+	if err != nil || again == nil || again.Id != j.Id {
+		t.Fatalf("中断された処理を取り出せません.err: %v", err)
+	}
+	if again.Attempts != 2 {
+		t.Errorf("試行回数が異なります.Actual: %v", again.Attempts)
+	}
+}
+
+func TestJobHeartbeat(t *testing.T) {
+	defer truncateTables()
+	interval := jobHeartbeatInterval
+	jobHeartbeatInterval = 10 * time.Millisecond
+	defer func() { jobHeartbeatInterval = interval }()
+
+	var state string
+	jobHandlers["test"] = func(s *Store, j *job) error {
+		if state != "" {
+			// 実行待ちに戻された処理をもう一度実行した
+			return nil
+		}
+		// 生存の記録が途絶えた後, 実行中に記録し直す
+		if _, err := s.db.Exec("UPDATE jobs SET updated_at = 0 WHERE id = ?", j.Id); err != nil {
+			return err
+		}
+		time.Sleep(100 * time.Millisecond)
+		if err := s.resetRunningJobs(time.Now().Add(-jobLeaseTimeout)); err != nil {
+			return err
+		}
+		return s.db.QueryRow("SELECT state FROM jobs WHERE id = ?", j.Id).Scan(&state)
+	}
+	defer delete(jobHandlers, "test")
+
+	if err := testStore.enqueueJob("test", 1, 1); err != nil {
+		t.Fatal(err)
+	}
+	drainJobs(t)
+	if state != jobRunning {
+		t.Errorf("実行中の処理が実行待ちに戻されました.Actual: %v", state)
+	}
+	if jobs, _ := testStore.FindJobs(jobDone, 10); len(jobs) != 1 {
+		t.Errorf("処理が完了していません.Actual: %v", jobs)
+	}
+}
+
+func TestEnqueueUnqueuedTranscodes(t *testing.T) {
+	defer truncateTables()
+	_, cleanup := useTempStorage(t)
+	defer cleanup()
+
+	m := &album{Title: "test title1"}
+	if err := testStore.SaveAlbum(m); err != nil {
+		t.Fatal(err)
+	}
+	p := &page{AlbumId: m.Id, Title: "test page title", Description: "desc"}
+	if err := testStore.SavePage(p); err != nil {
+		t.Fatal(err)
+	}
+	v, err := testStore.AddPageVideo(p, "a.mp4", 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testStore.setVideoStatus(v.Id, videoProcessing); err != nil {
+		t.Fatal(err)
+	}
+	// 2回呼んでも変換は1つだけ追加する
+	for i := 0; i < 2; i++ {
+		if err := testStore.enqueueUnqueuedTranscodes(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	jobs, err := testStore.FindJobs(jobQueued, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 || jobs[0].Kind != jobTranscode || jobs[0].VideoId != v.Id || jobs[0].PageId != p.Id {
+		t.Errorf("変換中の版の変換が追加されていません.Actual: %v", jobs)
+	}
+}
+
+func TestGetJobs(t *testing.T) {
+	defer truncateTables()
+	kind, _, cleanup := useFailingJob(jobMaxAttempts)
+	defer cleanup()
+
+	if err := testStore.enqueueJob(kind, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+	drainJobs(t)
+	failed, _ := testStore.FindJobs(jobFailed, 10)
+	if len(failed) != 1 {
+		t.Fatalf("失敗した処理がありません.")
+	}
+
+	sessionKey = []byte("0123456789abcdef0123456789abcdef")
+	call := func(u *user, method string, path string, form url.Values, handler http.HandlerFunc) *httptest.ResponseRecorder {
+		session, err := testStore.CreateSession(u.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.AddCookie(&http.Cookie{Name: sessionCookieName, Value: signSessionId(session.Id)})
+		w := httptest.NewRecorder()
+		serveTest(requirePermission(permManageUsers, handler), w, r)
+		return w
+	}
+	admin := createTestUser(t, "alice", roleAdmin)
+	editor := createTestUser(t, "bob", roleEditor)
+
+	if w := call(editor, "GET", "/get_jobs", nil, get_jobs); w.Code != http.StatusForbidden {
+		t.Errorf("管理者以外が処理状況を表示できました.Actual: %v", w.Code)
+	}
+	w := call(admin, "GET", "/get_jobs?state=failed", nil, get_jobs)
+	if w.Code != http.StatusOK {
+		t.Fatalf("処理状況を表示できません.Actual: %v", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "failure 3") {
+		t.Errorf("処理状況に失敗の理由が表示されていません.")
+	}
+
+	form := url.Values{"job_id": {strconv.FormatInt(failed[0].Id, 10)}}
+	if w := call(admin, "POST", "/retry_job", form, retry_job); w.Code != http.StatusSeeOther {
+		t.Errorf("処理を再実行できません.Actual: %v", w.Code)
+	}
+	if found, _ := testStore.FindJobById(failed[0].Id); found.State != jobQueued {
+		t.Errorf("再実行した処理が実行待ちになっていません.Actual: %v", found.State)
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * 動画の解析や変換を行う外部ツール.
+ * 引数のパスはローカルのファイル.
+ */
+type mediaTools interface {
+	// srcの動画からポスター画像を1枚切り出し, JPEGでdstに書き出す
+	PosterFrame(src string, dst string) error
+	// srcの動画の長さや解像度などを調べる
+	Probe(src string) (*mediaInfo, error)
+}
+
+/*
+ * ffprobeで調べた動画の情報.
+ * 調べられなかった項目は0または空.
+ */
+type mediaInfo struct {
+	DurationMs int64  `json:"duration_ms"`
+	Width      int64  `json:"width"`
+	Height     int64  `json:"height"`
+	VideoCodec string `json:"video_codec"`
+	AudioCodec string `json:"audio_codec"`
+	// ビット/秒
+	Bitrate int64 `json:"bitrate"`
+	// ffprobeのformat_name. mov,mp4,m4a,3gp,3g2,mj2のように候補が並ぶことがある
+	Container string `json:"container"`
+	FileSize  int64  `json:"file_size"`
+}
+
+/*
+ * 再生時間を時:分:秒で返す.
+ */
+func (m *mediaInfo) DurationText() string {
+	sec := m.DurationMs / 1000
+	if sec >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", sec/3600, sec/60%60, sec%60)
+	}
+	return fmt.Sprintf("%d:%02d", sec/60, sec%60)
+}
+
+func (m *mediaInfo) FileSizeText() string {
+	return formatByteSize(m.FileSize)
+}
+
+func (m *mediaInfo) BitrateText() string {
+	if m.Bitrate >= 1000000 {
+		return fmt.Sprintf("%.1f Mbps", float64(m.Bitrate)/1000000)
+	}
+	return fmt.Sprintf("%d kbps", m.Bitrate/1000)
+}
+
+// pages, page_videosの動画情報の列. 並びはnullMediaInfo.destと合わせる
+const mediaInfoColumns = "duration_ms, width, height, video_codec, audio_codec, bitrate, container, file_size"
+
+/*
+ * 動画情報の列の読み込み先.
+ * 調べる前の動画はcontainerがNULLになる.
+ */
+type nullMediaInfo struct {
+	DurationMs sql.NullInt64
+	Width      sql.NullInt64
+	Height     sql.NullInt64
+	VideoCodec sql.NullString
+	AudioCodec sql.NullString
+	Bitrate    sql.NullInt64
+	Container  sql.NullString
+	FileSize   sql.NullInt64
+}
+
+func (n *nullMediaInfo) dest() []interface{} {
+	return []interface{}{&n.DurationMs, &n.Width, &n.Height, &n.VideoCodec, &n.AudioCodec, &n.Bitrate, &n.Container, &n.FileSize}
+}
+
+// 調べる前の動画ならnilを返す
+func (n *nullMediaInfo) value() *mediaInfo {
+	if !n.Container.Valid {
+		return nil
+	}
+	return &mediaInfo{
+		DurationMs: n.DurationMs.Int64,
+		Width:      n.Width.Int64,
+		Height:     n.Height.Int64,
+		VideoCodec: n.VideoCodec.String,
+		AudioCodec: n.AudioCodec.String,
+		Bitrate:    n.Bitrate.Int64,
+		Container:  n.Container.String,
+		FileSize:   n.FileSize.Int64,
+	}
+}
+
+func (m *mediaInfo) values() []interface{} {
+	return []interface{}{m.DurationMs, m.Width, m.Height, m.VideoCodec, m.AudioCodec, m.Bitrate, m.Container, m.FileSize}
+}
+
+// 起動時に-ffmpeg, -ffprobeの指定で差し替える
+var mediaTool mediaTools = &ffmpegTools{FFmpeg: "ffmpeg", FFprobe: "ffprobe"}
+
+/*
+ * ffmpeg/ffprobeのコマンドによる実装.
+ */
+type ffmpegTools struct {
+	FFmpeg  string
+	FFprobe string
+}
+
+func runTool(name string, args ...string) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command(name, args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v: %s", path.Base(name), err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// ffprobe -of jsonの出力のうち使う項目. 数値の多くは文字列で出力される
+type ffprobeOutput struct {
+	Format struct {
+		FormatName string `json:"format_name"`
+		Duration   string `json:"duration"`
+		Size       string `json:"size"`
+		BitRate    string `json:"bit_rate"`
+	} `json:"format"`
+	Streams []struct {
+		CodecType string `json:"codec_type"`
+		CodecName string `json:"codec_name"`
+		Width     int64  `json:"width"`
+		Height    int64  `json:"height"`
+	} `json:"streams"`
+}
+
+func (t *ffmpegTools) Probe(src string) (*mediaInfo, error) {
+	out, err := runTool(t.FFprobe, "-v", "error", "-show_format", "-show_streams", "-of", "json", src)
+	if err != nil {
+		return nil, err
+	}
+	var o ffprobeOutput
+	if err := json.Unmarshal(out, &o); err != nil {
+		return nil, err
+	}
+	m := &mediaInfo{Container: o.Format.FormatName}
+	if sec, err := strconv.ParseFloat(o.Format.Duration, 64); err == nil {
+		m.DurationMs = int64(sec * 1000)
+	}
+	m.FileSize, _ = strconv.ParseInt(o.Format.Size, 10, 64)
+	m.Bitrate, _ = strconv.ParseInt(o.Format.BitRate, 10, 64)
+	// 複数ある場合は最初のストリームを使う
+	for _, s := range o.Streams {
+		switch {
+		case s.CodecType == "video" && m.VideoCodec == "":
+			m.VideoCodec = s.CodecName
+			m.Width = s.Width
+			m.Height = s.Height
+		case s.CodecType == "audio" && m.AudioCodec == "":
+			m.AudioCodec = s.CodecName
+		}
+	}
+	if m.Container == "" {
+		return nil, errors.New("unknown container format")
+	}
+	return m, nil
+}
+
+/*
+ * 冒頭は黒い画面のことが多いため, 動画の1割の位置(最大10秒)から切り出す.
+ */
+func (t *ffmpegTools) PosterFrame(src string, dst string) error {
+	var at time.Duration
+	if info, err := t.Probe(src); err == nil {
+		at = time.Duration(info.DurationMs) * time.Millisecond / 10
+		if at > 10*time.Second {
+			at = 10 * time.Second
+		}
+	}
+	_, err := runTool(t.FFmpeg, "-v", "error", "-y", "-ss", strconv.FormatFloat(at.Seconds(), 'f', 3, 64), "-i", src,
+		"-frames:v", "1", "-vf", "scale=640:-2", "-q:v", "3", "-f", "image2", dst)
+	if err != nil {
+		return err
+	}
+	if fi, err := os.Stat(dst); err != nil || fi.Size() == 0 {
+		return errors.New("no frame extracted")
+	}
+	return nil
+}
+
+/*
+ * 保存先のファイルをローカルのファイルとしてfnに渡す.
+ * ローカルディレクトリ以外の保存先の場合は一時ファイルにコピーする.
+ */
+func withLocalFile(name string, fn func(localPath string) error) error {
+	if s, ok := movieStorage.(*localStorage); ok {
+		p, err := s.path(name)
+		if err != nil {
+			return err
+		}
+		return fn(p)
+	}
+	obj, err := movieStorage.Open(name)
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+	f, err := ioutil.TempFile("", "video_album-*"+path.Ext(name))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = io.Copy(f, obj)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return fn(f.Name())
+}
+
+/*
+ * 動画のファイル名からサムネイルのファイル名を決める.
+ */
+func thumbnailName(moviePath string) string {
+	return strings.TrimSuffix(moviePath, path.Ext(moviePath)) + ".jpg"
+}
+
+/*
+ * ページの現在の動画からサムネイルを作成して保存先に置き, ページに登録する.
+ */
+func (s *Store) createThumbnail(p *page) error {
+	if p.MoviePath == "" {
+		return nil
+	}
+	moviePath := p.MoviePath
+	f, err := ioutil.TempFile("", "video_album-*.jpg")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	err = withLocalFile(moviePath, func(src string) error {
+		return mediaTool.PosterFrame(src, f.Name())
+	})
+	if err != nil {
+		return err
+	}
+	img, err := os.Open(f.Name())
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+	name := thumbnailName(moviePath)
+	if _, err := movieStorage.Put(name, img); err != nil {
+		return err
+	}
+	if err := s.SetPageThumbnail(p, moviePath, name); err != nil {
+		movieStorage.Delete(name)
+		return err
+	}
+	return nil
+}
+
+/*
+ * ページの現在の動画の長さや解像度などを調べ, ページに登録する.
+ */
+func (s *Store) probeMedia(p *page) error {
+	if p.MoviePath == "" {
+		return nil
+	}
+	moviePath := p.MoviePath
+	var info *mediaInfo
+	err := withLocalFile(moviePath, func(src string) error {
+		var err error
+		info, err = mediaTool.Probe(src)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if fi, err := movieStorage.Stat(moviePath); err == nil {
+		info.FileSize = fi.Size
+	}
+	return s.SetPageMediaInfo(p, moviePath, info)
+}
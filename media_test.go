@@ -0,0 +1,368 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+/*
+ * 外部ツールを使わないテスト用の実装.
+ * 受け取った動画ファイルの内容をそのまま画像として書き出し,
+ * 動画の情報はファイルの大きさから決める.
+ */
+type fakeMediaTools struct{}
+
+func (fakeMediaTools) PosterFrame(src string, dst string) error {
+	b, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dst, append([]byte("poster:"), b...), 0666)
+}
+
+func (fakeMediaTools) Probe(src string) (*mediaInfo, error) {
+	fi, err := os.Stat(src)
+	if err != nil {
+		return nil, err
+	}
+	n := fi.Size()
+	return &mediaInfo{
+		DurationMs: n * 1000,
+		Width:      n * 16,
+		Height:     n * 9,
+		VideoCodec: "h264",
+		AudioCodec: "aac",
+		Bitrate:    n * 1000,
+		Container:  "mov,mp4,m4a,3gp,3g2,mj2",
+	}, nil
+}
+
+func useFakeMediaTools() func() {
+	orig := mediaTool
+	mediaTool = fakeMediaTools{}
+	return func() { mediaTool = orig }
+}
+
+func TestCreateThumbnail(t *testing.T) {
+	defer truncateTables()
+	s, cleanup := useTempStorage(t)
+	defer cleanup()
+	defer useFakeMediaTools()()
+
+	m := &album{Title: "test title1"}
+	if err := testStore.SaveAlbum(m); err != nil {
+		t.Fatal(err)
+	}
+	p := &page{AlbumId: m.Id, Title: "test page title", Description: "desc"}
+	if err := testStore.SavePage(p); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{"v1.mp4", "v2.mp4"} {
+		if _, err := s.Put(file, strings.NewReader(file)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	v1, err := testStore.AddPageVideo(p, "v1.mp4", 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pages, _ := testStore.FindPagesWithoutThumbnail(); len(pages) != 1 {
+		t.Errorf("サムネイルの無いページが見つかりません.")
+	}
+	if err := testStore.createThumbnail(p); err != nil {
+		t.Fatal(err)
+	}
+	found, err := testStore.FindPageById(p.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.Thumbnail != "v1.jpg" {
+		t.Errorf("ページにサムネイルが登録されていません.Actual: %v", found.Thumbnail)
+	}
+	obj, err := s.Open("v1.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(obj)
+	obj.Close()
+	if string(b) != "poster:v1.mp4" {
+		t.Errorf("サムネイルの内容が異なります.Actual: %v", string(b))
+	}
+	if readable, err := testStore.canReadMovie("v1.jpg", nil); err != nil || !readable {
+		t.Errorf("サムネイルを参照できません.err: %v", err)
+	}
+
+	// 新しい版ではサムネイルが作り直され, 以前の版に戻すと以前のサムネイルに戻る
+	if _, err := testStore.AddPageVideo(p, "v2.mp4", 0, ""); err != nil {
+		t.Fatal(err)
+	}
+	if p.Thumbnail != "" {
+		t.Errorf("新しい版に以前の版のサムネイルが残っています.")
+	}
+	if err := testStore.createThumbnail(p); err != nil {
+		t.Fatal(err)
+	}
+	if err := testStore.RevertPageVideo(p, v1.Id); err != nil {
+		t.Fatal(err)
+	}
+	if found, _ := testStore.FindPageById(p.Id); found.Thumbnail != "v1.jpg" {
+		t.Errorf("以前の版のサムネイルに戻っていません.Actual: %v", found.Thumbnail)
+	}
+
+	if err := testStore.RemovePage(p); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{"v1.jpg", "v2.jpg"} {
+		if _, err := s.Stat(file); !os.IsNotExist(err) {
+			t.Errorf("削除したページのサムネイルが残っています.file: %v, err: %v", file, err)
+		}
+	}
+}
+
+func TestProbeMedia(t *testing.T) {
+	defer truncateTables()
+	s, cleanup := useTempStorage(t)
+	defer cleanup()
+	defer useFakeMediaTools()()
+
+	m := &album{Title: "test title1"}
+	if err := testStore.SaveAlbum(m); err != nil {
+		t.Fatal(err)
+	}
+	p := &page{AlbumId: m.Id, Title: "test page title", Description: "desc"}
+	if err := testStore.SavePage(p); err != nil {
+		t.Fatal(err)
+	}
+	// 長さ10秒, 720pの動画と長さ80秒, 1440pの動画になる
+	files := map[string]string{"short.mp4": strings.Repeat("a", 10), "long.mp4": strings.Repeat("b", 80)}
+	for file, body := range files {
+		if _, err := s.Put(file, strings.NewReader(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	v1, err := testStore.AddPageVideo(p, "short.mp4", 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pages, _ := testStore.FindPagesWithoutMediaInfo(); len(pages) != 1 {
+		t.Errorf("動画の情報の無いページが見つかりません.")
+	}
+	if err := testStore.probeMedia(p); err != nil {
+		t.Fatal(err)
+	}
+	found, err := testStore.FindPageById(p.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.Media == nil || found.Media.DurationMs != 10000 || found.Media.Height != 90 || found.Media.FileSize != 10 {
+		t.Errorf("ページに動画の情報が登録されていません.Actual: %v", found.Media)
+	}
+	if pages, _ := testStore.FindPagesWithoutMediaInfo(); len(pages) != 0 {
+		t.Errorf("動画の情報を登録したページが残っています.")
+	}
+
+	// 新しい版では調べ直し, 以前の版に戻すと以前の情報に戻る
+	if _, err := testStore.AddPageVideo(p, "long.mp4", 0, ""); err != nil {
+		t.Fatal(err)
+	}
+	if found, _ := testStore.FindPageById(p.Id); found.Media != nil {
+		t.Errorf("新しい版に以前の版の動画の情報が残っています.")
+	}
+	if err := testStore.probeMedia(p); err != nil {
+		t.Fatal(err)
+	}
+	videos, err := testStore.FindPageVideosByPageId(p.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(videos) != 2 || videos[0].Media == nil || videos[0].Media.DurationMs != 80000 || videos[1].Media == nil || videos[1].Media.DurationMs != 10000 {
+		t.Errorf("版毎の動画の情報が異なります.")
+	}
+	if err := testStore.RevertPageVideo(p, v1.Id); err != nil {
+		t.Fatal(err)
+	}
+	if found, _ := testStore.FindPageById(p.Id); found.Media == nil || found.Media.DurationMs != 10000 {
+		t.Errorf("以前の版の動画の情報に戻っていません.Actual: %v", found.Media)
+	}
+}
+
+func TestFindPageByFilter(t *testing.T) {
+	defer truncateTables()
+
+	m := &album{Title: "test title1"}
+	if err := testStore.SaveAlbum(m); err != nil {
+		t.Fatal(err)
+	}
+	infos := []*mediaInfo{
+		{DurationMs: 10000, Width: 1280, Height: 720, VideoCodec: "h264", AudioCodec: "aac", Container: "mov,mp4,m4a,3gp,3g2,mj2"},
+		{DurationMs: 60000, Width: 1920, Height: 1080, VideoCodec: "hevc", AudioCodec: "", Container: "mov,mp4,m4a,3gp,3g2,mj2"},
+		{DurationMs: 300000, Width: 640, Height: 480, VideoCodec: "vp9", AudioCodec: "opus", Container: "matroska,webm"},
+	}
+	files := []string{"a.mp4", "b.mp4", "c.webm"}
+	pages := make([]*page, 0)
+	for i, info := range infos {
+		p := &page{AlbumId: m.Id, Title: "test page title", Description: "desc", MoviePath: files[i]}
+		if err := testStore.SavePage(p); err != nil {
+			t.Fatal(err)
+		}
+		if err := testStore.SetPageMediaInfo(p, p.MoviePath, info); err != nil {
+			t.Fatal(err)
+		}
+		pages = append(pages, p)
+	}
+	// 動画の情報の無いページは条件を指定すると除かれる
+	noVideo := &page{AlbumId: m.Id, Title: "no video", Description: "desc"}
+	if err := testStore.SavePage(noVideo); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		filter pageFilter
+		expect []*page
+	}{
+		{pageFilter{}, append(pages, noVideo)},
+		{pageFilter{MinDurationMs: 60000}, pages[1:]},
+		{pageFilter{MaxDurationMs: 60000}, pages[:2]},
+		{pageFilter{MinHeight: 720, MaxHeight: 720}, pages[:1]},
+		{pageFilter{VideoCodec: "hevc"}, pages[1:2]},
+		{pageFilter{AudioCodec: "opus"}, pages[2:]},
+		{pageFilter{Container: "mp4"}, pages[:2]},
+		{pageFilter{Container: "webm", MinDurationMs: 1000}, pages[2:]},
+		{pageFilter{Container: "web"}, nil},
+	}
+	for _, test := range tests {
+		found, err := testStore.FindPageByFilter(m.Id, &test.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ok := len(found) == len(test.expect)
+		for i := 0; ok && i < len(found); i++ {
+			ok = found[i].Id == test.expect[i].Id
+		}
+		if !ok {
+			t.Errorf("絞り込んだページが異なります.filter: %+v, Expect: %d件, Actual: %d件", test.filter, len(test.expect), len(found))
+		}
+	}
+}
+
+func TestAlbumCover(t *testing.T) {
+	defer truncateTables()
+
+	m := &album{Title: "test title1"}
+	if err := testStore.SaveAlbum(m); err != nil {
+		t.Fatal(err)
+	}
+	other := &album{Title: "test title2"}
+	if err := testStore.SaveAlbum(other); err != nil {
+		t.Fatal(err)
+	}
+	pages := make([]*page, 3)
+	files := []string{"a.mp4", "b.mp4", "c.mp4"}
+	for i, albumId := range []int64{m.Id, m.Id, other.Id} {
+		pages[i] = &page{AlbumId: albumId, Title: "test page title", Description: "desc", MoviePath: files[i]}
+		if err := testStore.SavePage(pages[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// サムネイルが無ければ表紙も無い
+	if found, _ := testStore.FindAlbumById(m.Id); found.Cover != "" {
+		t.Errorf("サムネイルの無いアルバムに表紙があります.Actual: %v", found.Cover)
+	}
+	for _, p := range pages {
+		if err := testStore.SetPageThumbnail(p, p.MoviePath, thumbnailName(p.MoviePath)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 未選択ならサムネイルのある最初のページ
+	if found, _ := testStore.FindAlbumById(m.Id); found.Cover != "a.jpg" {
+		t.Errorf("表紙が最初のページのサムネイルになっていません.Actual: %v", found.Cover)
+	}
+	if err := testStore.SetAlbumCover(m, pages[1].Id); err != nil {
+		t.Fatal(err)
+	}
+	albums, err := testStore.FindAlbum("title1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(albums) != 1 || albums[0].Cover != "b.jpg" || albums[0].CoverPageId != pages[1].Id {
+		t.Errorf("選択したページが表紙になっていません.Actual: %v", albums[0])
+	}
+	if err := testStore.SetAlbumCover(m, pages[2].Id); err == nil {
+		t.Errorf("他のアルバムのページを表紙にできました.")
+	}
+
+	// 表紙のページを削除すると未選択に戻る
+	if err := testStore.RemovePage(pages[1]); err != nil {
+		t.Fatal(err)
+	}
+	if found, _ := testStore.FindAlbumById(m.Id); found.CoverPageId != 0 || found.Cover != "a.jpg" {
+		t.Errorf("表紙のページを削除した後の表紙が異なります.Actual: %v", found)
+	}
+}
+
+func TestFFmpegPosterFrame(t *testing.T) {
+	tools := &ffmpegTools{FFmpeg: "ffmpeg", FFprobe: "ffprobe"}
+	if _, err := exec.LookPath(tools.FFmpeg); err != nil {
+		t.Skip("ffmpeg is not installed")
+	}
+	if _, err := exec.LookPath(tools.FFprobe); err != nil {
+		t.Skip("ffprobe is not installed")
+	}
+	dir, err := ioutil.TempDir("", "video_album_media")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "test.mp4")
+	if _, err := runTool(tools.FFmpeg, "-v", "error", "-f", "lavfi", "-i", "testsrc=duration=2:size=320x240:rate=10", "-pix_fmt", "yuv420p", src); err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(dir, "test.jpg")
+	if err := tools.PosterFrame(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) < 2 || b[0] != 0xff || b[1] != 0xd8 {
+		t.Errorf("JPEGが書き出されていません.")
+	}
+}
+
+func TestFFprobeProbe(t *testing.T) {
+	tools := &ffmpegTools{FFmpeg: "ffmpeg", FFprobe: "ffprobe"}
+	if _, err := exec.LookPath(tools.FFmpeg); err != nil {
+		t.Skip("ffmpeg is not installed")
+	}
+	if _, err := exec.LookPath(tools.FFprobe); err != nil {
+		t.Skip("ffprobe is not installed")
+	}
+	dir, err := ioutil.TempDir("", "video_album_media")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "test.mp4")
+	if _, err := runTool(tools.FFmpeg, "-v", "error", "-f", "lavfi", "-i", "testsrc=duration=2:size=320x240:rate=10", "-pix_fmt", "yuv420p", src); err != nil {
+		t.Fatal(err)
+	}
+	info, err := tools.Probe(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Width != 320 || info.Height != 240 || info.VideoCodec == "" || info.AudioCodec != "" {
+		t.Errorf("動画の情報が異なります.Actual: %+v", info)
+	}
+	if info.DurationMs < 1900 || info.DurationMs > 2100 {
+		t.Errorf("動画の長さが異なります.Actual: %v", info.DurationMs)
+	}
+	if !strings.Contains(info.Container, "mp4") {
+		t.Errorf("動画の形式が異なります.Actual: %v", info.Container)
+	}
+}
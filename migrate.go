@@ -0,0 +1,628 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	_ "github.com/mattn/go-sqlite3"
+	"time"
+)
+
+/*
+ * DBのスキーマの変更. Versionの順に一度だけ適用し, schema_migrationsに記録する.
+ * 適用済みの変更は書き換えず, スキーマを変える場合は末尾に追加する.
+ * PostgreSQLは長さを超えた文字列をエラーにするため, 文字列の列は長さを制限しないTEXTにし, 長さは保存前に確認する.
+ */
+type migration struct {
+	Version int64
+	Name    string
+	// SQLiteとPostgreSQLのそれぞれで実行するSQL
+	Script   string
+	Postgres string
+}
+
+var migrations = []*migration{{
+	Version: 1,
+	Name:    "create albums and pages",
+	Script: `
+		CREATE TABLE "albums" (
+			"id" INTEGER PRIMARY KEY AUTOINCREMENT,
+			"title" VARCHAR(32)
+		);
+		CREATE TABLE "pages" (
+			"id" INTEGER PRIMARY KEY AUTOINCREMENT,
+			"album_id" INTEGER NOT NULL,
+			"title" VARCHAR(128) NOT NULL,
+			"description" VARCHAR(1024) NOT NULL,
+			"filepath" VARCHAR(1024)
+		);
+	`,
+	Postgres: `
+		CREATE TABLE "albums" (
+			"id" BIGSERIAL PRIMARY KEY,
+			"title" TEXT
+		);
+		CREATE TABLE "pages" (
+			"id" BIGSERIAL PRIMARY KEY,
+			"album_id" BIGINT NOT NULL,
+			"title" TEXT NOT NULL,
+			"description" TEXT NOT NULL,
+			"filepath" TEXT
+		);
+	`,
+}, {
+	Version: 2,
+	Name:    "add users and sessions",
+	Script: `
+		CREATE TABLE "users" (
+			"id" INTEGER PRIMARY KEY AUTOINCREMENT,
+			"name" VARCHAR(32) NOT NULL UNIQUE,
+			"password_hash" VARCHAR(128) NOT NULL,
+			"role" VARCHAR(16) NOT NULL DEFAULT 'viewer'
+		);
+		CREATE TABLE "sessions" (
+			"id" VARCHAR(64) PRIMARY KEY,
+			"user_id" INTEGER NOT NULL,
+			"expires_at" INTEGER NOT NULL
+		);
+	`,
+	Postgres: `
+		CREATE TABLE "users" (
+			"id" BIGSERIAL PRIMARY KEY,
+			"name" TEXT NOT NULL UNIQUE,
+			"password_hash" TEXT NOT NULL,
+			"role" TEXT NOT NULL DEFAULT 'viewer'
+		);
+		CREATE TABLE "sessions" (
+			"id" TEXT PRIMARY KEY,
+			"user_id" BIGINT NOT NULL,
+			"expires_at" BIGINT NOT NULL
+		);
+	`,
+}, {
+	Version: 3,
+	Name:    "add groups and album members",
+	Script: `
+		CREATE TABLE "groups" (
+			"id" INTEGER PRIMARY KEY AUTOINCREMENT,
+			"name" VARCHAR(32) NOT NULL UNIQUE
+		);
+		CREATE TABLE "group_members" (
+			"group_id" INTEGER NOT NULL,
+			"user_id" INTEGER NOT NULL,
+			PRIMARY KEY ("group_id", "user_id")
+		);
+		CREATE TABLE "album_members" (
+			"id" INTEGER PRIMARY KEY AUTOINCREMENT,
+			"album_id" INTEGER NOT NULL,
+			"user_id" INTEGER,
+			"group_id" INTEGER,
+			"access" VARCHAR(8) NOT NULL
+		);
+	`,
+	Postgres: `
+		CREATE TABLE "groups" (
+			"id" BIGSERIAL PRIMARY KEY,
+			"name" TEXT NOT NULL UNIQUE
+		);
+		CREATE TABLE "group_members" (
+			"group_id" BIGINT NOT NULL,
+			"user_id" BIGINT NOT NULL,
+			PRIMARY KEY ("group_id", "user_id")
+		);
+		CREATE TABLE "album_members" (
+			"id" BIGSERIAL PRIMARY KEY,
+			"album_id" BIGINT NOT NULL,
+			"user_id" BIGINT,
+			"group_id" BIGINT,
+			"access" TEXT NOT NULL
+		);
+	`,
+}, {
+	Version: 4,
+	Name:    "add api tokens",
+	Script: `
+		CREATE TABLE "api_tokens" (
+			"id" INTEGER PRIMARY KEY AUTOINCREMENT,
+			"user_id" INTEGER NOT NULL,
+			"name" VARCHAR(32) NOT NULL,
+			"token_hash" VARCHAR(64) NOT NULL UNIQUE,
+			"created_at" INTEGER NOT NULL,
+			"last_used_at" INTEGER,
+			"expires_at" INTEGER
+		);
+	`,
+	Postgres: `
+		CREATE TABLE "api_tokens" (
+			"id" BIGSERIAL PRIMARY KEY,
+			"user_id" BIGINT NOT NULL,
+			"name" TEXT NOT NULL,
+			"token_hash" TEXT NOT NULL UNIQUE,
+			"created_at" BIGINT NOT NULL,
+			"last_used_at" BIGINT,
+			"expires_at" BIGINT
+		);
+	`,
+}, {
+	// SQLiteでは外部キー制約を付けるためpagesを作り直す. PostgreSQLは制約を追加できる
+	Version: 5,
+	Name:    "add page media information and album cover",
+	Script: `
+		CREATE TABLE "pages_new" (
+			"id" INTEGER PRIMARY KEY AUTOINCREMENT,
+			"album_id" INTEGER NOT NULL REFERENCES "albums" ("id") ON DELETE CASCADE,
+			"title" VARCHAR(128) NOT NULL,
+			"description" VARCHAR(1024) NOT NULL,
+			"filepath" VARCHAR(1024),
+			"mime_type" VARCHAR(64),
+			"thumbnail" VARCHAR(1024),
+			"duration_ms" INTEGER,
+			"width" INTEGER,
+			"height" INTEGER,
+			"video_codec" VARCHAR(32),
+			"audio_codec" VARCHAR(32),
+			"bitrate" INTEGER,
+			"container" VARCHAR(64),
+			"file_size" INTEGER
+		);
+		INSERT INTO pages_new (id, album_id, title, description, filepath)
+			SELECT id, album_id, title, description, filepath FROM pages;
+		DROP TABLE pages;
+		ALTER TABLE pages_new RENAME TO pages;
+		ALTER TABLE albums ADD COLUMN "cover_page_id" INTEGER REFERENCES "pages" ("id") ON DELETE SET NULL;
+	`,
+	Postgres: `
+		ALTER TABLE pages
+			ADD FOREIGN KEY ("album_id") REFERENCES "albums" ("id") ON DELETE CASCADE,
+			ADD COLUMN "mime_type" TEXT,
+			ADD COLUMN "thumbnail" TEXT,
+			ADD COLUMN "duration_ms" BIGINT,
+			ADD COLUMN "width" BIGINT,
+			ADD COLUMN "height" BIGINT,
+			ADD COLUMN "video_codec" TEXT,
+			ADD COLUMN "audio_codec" TEXT,
+			ADD COLUMN "bitrate" BIGINT,
+			ADD COLUMN "container" TEXT,
+			ADD COLUMN "file_size" BIGINT;
+		ALTER TABLE albums ADD COLUMN "cover_page_id" BIGINT REFERENCES "pages" ("id") ON DELETE SET NULL;
+	`,
+}, {
+	Version: 6,
+	Name:    "add page versions and revisions",
+	Script: `
+		CREATE TABLE "page_videos" (
+			"id" INTEGER PRIMARY KEY AUTOINCREMENT,
+			"page_id" INTEGER NOT NULL REFERENCES "pages" ("id") ON DELETE CASCADE,
+			"filepath" VARCHAR(1024) NOT NULL,
+			"mime_type" VARCHAR(64),
+			"retired_at" INTEGER,
+			"thumbnail" VARCHAR(1024),
+			"user_id" INTEGER,
+			"note" VARCHAR(256) NOT NULL DEFAULT '',
+			"created_at" INTEGER NOT NULL,
+			"status" VARCHAR(16) NOT NULL DEFAULT 'ready',
+			"stream_path" VARCHAR(1024),
+			"duration_ms" INTEGER,
+			"width" INTEGER,
+			"height" INTEGER,
+			"video_codec" VARCHAR(32),
+			"audio_codec" VARCHAR(32),
+			"bitrate" INTEGER,
+			"container" VARCHAR(64),
+			"file_size" INTEGER
+		);
+		CREATE TABLE "page_renditions" (
+			"id" INTEGER PRIMARY KEY AUTOINCREMENT,
+			"video_id" INTEGER NOT NULL REFERENCES "page_videos" ("id") ON DELETE CASCADE,
+			"height" INTEGER NOT NULL,
+			"filepath" VARCHAR(1024) NOT NULL,
+			"created_at" INTEGER NOT NULL
+		);
+		CREATE TABLE "page_stream_files" (
+			"id" INTEGER PRIMARY KEY AUTOINCREMENT,
+			"video_id" INTEGER NOT NULL REFERENCES "page_videos" ("id") ON DELETE CASCADE,
+			"filepath" VARCHAR(1024) NOT NULL
+		);
+		CREATE TABLE "page_revisions" (
+			"id" INTEGER PRIMARY KEY AUTOINCREMENT,
+			"page_id" INTEGER NOT NULL REFERENCES "pages" ("id") ON DELETE CASCADE,
+			"user_id" INTEGER,
+			"title" VARCHAR(128) NOT NULL,
+			"description" VARCHAR(1024) NOT NULL,
+			"created_at" INTEGER NOT NULL
+		);
+	`,
+	Postgres: `
+		CREATE TABLE "page_videos" (
+			"id" BIGSERIAL PRIMARY KEY,
+			"page_id" BIGINT NOT NULL REFERENCES "pages" ("id") ON DELETE CASCADE,
+			"filepath" TEXT NOT NULL,
+			"mime_type" TEXT,
+			"retired_at" BIGINT,
+			"thumbnail" TEXT,
+			"user_id" BIGINT,
+			"note" TEXT NOT NULL DEFAULT '',
+			"created_at" BIGINT NOT NULL,
+			"status" TEXT NOT NULL DEFAULT 'ready',
+			"stream_path" TEXT,
+			"duration_ms" BIGINT,
+			"width" BIGINT,
+			"height" BIGINT,
+			"video_codec" TEXT,
+			"audio_codec" TEXT,
+			"bitrate" BIGINT,
+			"container" TEXT,
+			"file_size" BIGINT
+		);
+		CREATE TABLE "page_renditions" (
+			"id" BIGSERIAL PRIMARY KEY,
+			"video_id" BIGINT NOT NULL REFERENCES "page_videos" ("id") ON DELETE CASCADE,
+			"height" BIGINT NOT NULL,
+			"filepath" TEXT NOT NULL,
+			"created_at" BIGINT NOT NULL
+		);
+		CREATE TABLE "page_stream_files" (
+			"id" BIGSERIAL PRIMARY KEY,
+			"video_id" BIGINT NOT NULL REFERENCES "page_videos" ("id") ON DELETE CASCADE,
+			"filepath" TEXT NOT NULL
+		);
+		CREATE TABLE "page_revisions" (
+			"id" BIGSERIAL PRIMARY KEY,
+			"page_id" BIGINT NOT NULL REFERENCES "pages" ("id") ON DELETE CASCADE,
+			"user_id" BIGINT,
+			"title" TEXT NOT NULL,
+			"description" TEXT NOT NULL,
+			"created_at" BIGINT NOT NULL
+		);
+	`,
+}, {
+	Version: 7,
+	Name:    "add jobs",
+	Script: `
+		CREATE TABLE "jobs" (
+			"id" INTEGER PRIMARY KEY AUTOINCREMENT,
+			"kind" VARCHAR(16) NOT NULL,
+			"page_id" INTEGER NOT NULL,
+			"video_id" INTEGER NOT NULL,
+			"state" VARCHAR(16) NOT NULL DEFAULT 'queued',
+			"attempts" INTEGER NOT NULL DEFAULT 0,
+			"last_error" VARCHAR(1024) NOT NULL DEFAULT '',
+			"run_at" INTEGER NOT NULL,
+			"created_at" INTEGER NOT NULL,
+			"updated_at" INTEGER NOT NULL
+		);
+		CREATE INDEX "jobs_state_run_at" ON "jobs" ("state", "run_at");
+	`,
+	Postgres: `
+		CREATE TABLE "jobs" (
+			"id" BIGSERIAL PRIMARY KEY,
+			"kind" TEXT NOT NULL,
+			"page_id" BIGINT NOT NULL,
+			"video_id" BIGINT NOT NULL,
+			"state" TEXT NOT NULL DEFAULT 'queued',
+			"attempts" BIGINT NOT NULL DEFAULT 0,
+			"last_error" TEXT NOT NULL DEFAULT '',
+			"run_at" BIGINT NOT NULL,
+			"created_at" BIGINT NOT NULL,
+			"updated_at" BIGINT NOT NULL
+		);
+		CREATE INDEX "jobs_state_run_at" ON "jobs" ("state", "run_at");
+	`,
+}, {
+	Version: 8,
+	Name:    "add resumable uploads",
+	Script: `
+		CREATE TABLE "uploads" (
+			"id" INTEGER PRIMARY KEY AUTOINCREMENT,
+			"user_id" INTEGER NOT NULL,
+			"album_id" INTEGER NOT NULL,
+			"page_id" INTEGER NOT NULL DEFAULT 0,
+			"title" VARCHAR(128) NOT NULL,
+			"description" VARCHAR(1024) NOT NULL,
+			"note" VARCHAR(256) NOT NULL,
+			"filename" VARCHAR(1024) NOT NULL,
+			"length" INTEGER NOT NULL,
+			"received" INTEGER NOT NULL DEFAULT 0,
+			"checksum" VARCHAR(64) NOT NULL,
+			"created_at" INTEGER NOT NULL,
+			"expires_at" INTEGER NOT NULL,
+			"completed_at" INTEGER
+		);
+		CREATE TABLE "upload_chunks" (
+			"id" INTEGER PRIMARY KEY AUTOINCREMENT,
+			"upload_id" INTEGER NOT NULL REFERENCES "uploads" ("id") ON DELETE CASCADE,
+			"start" INTEGER NOT NULL,
+			"size" INTEGER NOT NULL,
+			"filepath" VARCHAR(1024) NOT NULL
+		);
+	`,
+	Postgres: `
+		CREATE TABLE "uploads" (
+			"id" BIGSERIAL PRIMARY KEY,
+			"user_id" BIGINT NOT NULL,
+			"album_id" BIGINT NOT NULL,
+			"page_id" BIGINT NOT NULL DEFAULT 0,
+			"title" TEXT NOT NULL,
+			"description" TEXT NOT NULL,
+			"note" TEXT NOT NULL,
+			"filename" TEXT NOT NULL,
+			"length" BIGINT NOT NULL,
+			"received" BIGINT NOT NULL DEFAULT 0,
+			"checksum" TEXT NOT NULL,
+			"created_at" BIGINT NOT NULL,
+			"expires_at" BIGINT NOT NULL,
+			"completed_at" BIGINT
+		);
+		CREATE TABLE "upload_chunks" (
+			"id" BIGSERIAL PRIMARY KEY,
+			"upload_id" BIGINT NOT NULL REFERENCES "uploads" ("id") ON DELETE CASCADE,
+			"start" BIGINT NOT NULL,
+			"size" BIGINT NOT NULL,
+			"filepath" TEXT NOT NULL
+		);
+	`,
+}, {
+	Version: 9,
+	Name:    "add storage quotas",
+	Script: `
+		ALTER TABLE albums ADD COLUMN "quota" INTEGER;
+		ALTER TABLE users ADD COLUMN "quota" INTEGER;
+	`,
+	Postgres: `
+		ALTER TABLE albums ADD COLUMN "quota" BIGINT;
+		ALTER TABLE users ADD COLUMN "quota" BIGINT;
+	`,
+}, {
+	Version: 10,
+	Name:    "add content addressed blobs",
+	Script: `
+		CREATE TABLE "blobs" (
+			"sha256" VARCHAR(64) PRIMARY KEY,
+			"filepath" VARCHAR(1024) NOT NULL UNIQUE,
+			"size" INTEGER NOT NULL,
+			"ref_count" INTEGER NOT NULL,
+			"created_at" INTEGER NOT NULL
+		);
+	`,
+	Postgres: `
+		CREATE TABLE "blobs" (
+			"sha256" TEXT PRIMARY KEY,
+			"filepath" TEXT NOT NULL UNIQUE,
+			"size" BIGINT NOT NULL,
+			"ref_count" BIGINT NOT NULL,
+			"created_at" BIGINT NOT NULL
+		);
+	`,
+}}
+
+// schema_migrationsが無いDBのうち, 変更の記録を始める前の最後の版で作られたもの
+const unversionedSchemaVersion = 10
+
+/*
+ * 変更の適用状況.
+ */
+type migrationStatus struct {
+	*migration
+	// 未適用ならゼロ値
+	AppliedAt time.Time
+}
+
+func (m *migrationStatus) Applied() bool {
+	return !m.AppliedAt.IsZero()
+}
+
+/*
+ * スキーマの変更に使う接続を開く. 使い終わったらcloseを呼ぶ.
+ * SQLiteでは外部キー制約を無効にした接続で行う.
+ * テーブルを作り直す際に, 参照しているテーブルの行が消えないようにするため.
+ */
+func (s *Store) openMigrationDB() (db *storeDB, close func(), err error) {
+	if s.db.dialect != dialectSQLite {
+		return s.db, func() {}, nil
+	}
+	db, err = openDB(dialectSQLite, "file:"+s.path+"?_foreign_keys=0&_busy_timeout=5000")
+	if err != nil {
+		return nil, nil, err
+	}
+	return db, func() { db.Close() }, nil
+}
+
+/*
+ * 未適用の変更を順に適用し, 適用したものを返す.
+ * DBが無ければ作成する.
+ */
+func (s *Store) MigrateUp() ([]*migration, error) {
+	db, close, err := s.openMigrationDB()
+	if err != nil {
+		return nil, err
+	}
+	defer close()
+
+	return applyMigrations(db)
+}
+
+func applyMigrations(db *storeDB) ([]*migration, error) {
+	if err := initSchemaMigrations(db); err != nil {
+		return nil, err
+	}
+	ret := make([]*migration, 0)
+	for _, m := range migrations {
+		applied, err := m.apply(db)
+		if err != nil {
+			return ret, fmt.Errorf("migration %d (%s): %v", m.Version, m.Name, err)
+		}
+		if applied {
+			ret = append(ret, m)
+		}
+	}
+	return ret, nil
+}
+
+/*
+ * 未適用であれば適用する.
+ * 複数のサーバーが同時に起動しても一度だけ適用されるよう, 適用済みかどうかはロックを取ってから確認する.
+ */
+func (m *migration) apply(db *storeDB) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	if err := lockMigrations(tx); err != nil {
+		return false, err
+	}
+	var n int64
+	if err := tx.QueryRow("SELECT COUNT(*) FROM schema_migrations WHERE version = ?", m.Version).Scan(&n); err != nil || n > 0 {
+		return false, err
+	}
+	script := m.Script
+	if tx.dialect == dialectPostgres {
+		script = m.Postgres
+	}
+	if _, err := tx.Exec(script); err != nil {
+		return false, err
+	}
+	if err := recordMigration(tx, m); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+/*
+ * トランザクションが終わるまで, 他のサーバーがスキーマを変更しないようにする.
+ * SQLiteは1つのサーバーからしか使わない.
+ */
+func lockMigrations(tx *storeTx) error {
+	if tx.dialect != dialectPostgres {
+		return nil
+	}
+	_, err := tx.Exec("SELECT pg_advisory_xact_lock(?)", migrationLockId)
+	return err
+}
+
+// pg_advisory_xact_lockのキー. 他の用途のロックと重ならない値
+const migrationLockId = 0x76615f6d6967
+
+func recordMigration(tx *storeTx, m *migration) error {
+	query := `
+		INSERT INTO schema_migrations (version, name, applied_at) values(?, ?, ?)
+	`
+	_, err := tx.Exec(query, m.Version, m.Name, time.Now().Unix())
+	return err
+}
+
+/*
+ * schema_migrationsを作成する.
+ * 記録を始める前に作られたDBは, テーブルから版を判断して適用済みとして記録する.
+ */
+func initSchemaMigrations(db *storeDB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := lockMigrations(tx); err != nil {
+		return err
+	}
+	exists, err := tableExists(tx, "schema_migrations")
+	if err != nil || exists {
+		return err
+	}
+	var version int64
+	if ok, err := tableExists(tx, "blobs"); err != nil {
+		return err
+	} else if ok {
+		version = unversionedSchemaVersion
+	} else if ok, err := tableExists(tx, "albums"); err != nil {
+		return err
+	} else if ok {
+		// 2016年の最初の版. albumsとpagesだけがある
+		if ok, err := tableExists(tx, "users"); err != nil {
+			return err
+		} else if ok {
+			return errors.New("unknown database schema. back up album.db and recreate it with -i")
+		}
+		version = 1
+	}
+	query := `
+		CREATE TABLE "schema_migrations" (
+			"version" INTEGER PRIMARY KEY,
+			"name" VARCHAR(128) NOT NULL,
+			"applied_at" INTEGER NOT NULL
+		);
+	`
+	if tx.dialect == dialectPostgres {
+		query = `
+			CREATE TABLE "schema_migrations" (
+				"version" BIGINT PRIMARY KEY,
+				"name" TEXT NOT NULL,
+				"applied_at" BIGINT NOT NULL
+			);
+		`
+	}
+	if _, err := tx.Exec(query); err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if m.Version > version {
+			break
+		}
+		if err := recordMigration(tx, m); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func tableExists(tx *storeTx, name string) (bool, error) {
+	query := "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?"
+	if tx.dialect == dialectPostgres {
+		query = "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = ?"
+	}
+	var n int64
+	err := tx.QueryRow(query, name).Scan(&n)
+	return n > 0, err
+}
+
+func appliedMigrations(db *storeDB) (map[int64]time.Time, error) {
+	rows, err := db.Query("SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ret := make(map[int64]time.Time)
+	for rows.Next() {
+		var version, appliedAt int64
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		ret[version] = time.Unix(appliedAt, 0)
+	}
+	return ret, rows.Err()
+}
+
+/*
+ * 全ての変更の適用状況を返す. 空のDBでは全て未適用.
+ */
+func (s *Store) FindMigrationStatus() ([]*migrationStatus, error) {
+	db, close, err := s.openMigrationDB()
+	if err != nil {
+		return nil, err
+	}
+	defer close()
+
+	if err := initSchemaMigrations(db); err != nil {
+		return nil, err
+	}
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]*migrationStatus, len(migrations))
+	for i, m := range migrations {
+		ret[i] = &migrationStatus{migration: m, AppliedAt: applied[m.Version]}
+	}
+	return ret, nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// 2016年の最初の版で作られたalbum.db
+const schema2016 = `
+	CREATE TABLE "albums" (
+		"id" INTEGER PRIMARY KEY AUTOINCREMENT,
+		"title" VARCHAR(32)
+	);
+	CREATE TABLE "pages" (
+		"id" INTEGER PRIMARY KEY AUTOINCREMENT,
+		"album_id" INTEGER NOT NULL,
+		"title" VARCHAR(128) NOT NULL,
+		"description" VARCHAR(1024) NOT NULL,
+		"filepath" VARCHAR(1024)
+	);
+	INSERT INTO albums (id, title) VALUES (1, 'trip');
+	INSERT INTO pages (id, album_id, title, description, filepath) VALUES (1, 1, 'day 1', 'beach', 'abc123.mp4');
+	INSERT INTO pages (id, album_id, title, description, filepath) VALUES (2, 99, 'orphan', '', 'def456.mp4');
+`
+
+// テーブル毎のCREATE文. 空白の違いは無視する
+func schemaOf(t *testing.T, db *storeDB) map[string]string {
+	rows, err := db.Query("SELECT name, sql FROM sqlite_master WHERE sql IS NOT NULL AND name != 'schema_migrations'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	ret := make(map[string]string)
+	for rows.Next() {
+		var name, sql string
+		if err := rows.Scan(&name, &sql); err != nil {
+			t.Fatal(err)
+		}
+		ret[name] = strings.Join(strings.Fields(sql), " ")
+	}
+	return ret
+}
+
+func TestMigrate2016Database(t *testing.T) {
+	dir, err := ioutil.TempDir("", "video_album_migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "album.db")
+	old, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := old.Exec(schema2016); err != nil {
+		t.Fatal(err)
+	}
+	old.Close()
+	store, err := OpenStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	status, err := store.FindMigrationStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range status {
+		if m.Applied() != (m.Version == 1) {
+			t.Errorf("2016年のDBの適用状況が誤っています.Version: %v, Applied: %v", m.Version, m.Applied())
+		}
+	}
+	applied, err := store.MigrateUp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != len(migrations)-1 || applied[0].Version != 2 {
+		t.Errorf("適用した変更が誤っています.Actual: %v", len(applied))
+	}
+	if applied, err := store.MigrateUp(); err != nil || len(applied) != 0 {
+		t.Errorf("適用済みの変更をもう一度適用しました.Actual: %v, %v", len(applied), err)
+	}
+
+	// 新しく作ったDBと同じスキーマになる
+	expect := schemaOf(t, testStore.db)
+	actual := schemaOf(t, store.db)
+	for name, sql := range expect {
+		if actual[name] != sql {
+			t.Errorf("%sのスキーマが異なります.Expect: %v, Actual: %v", name, sql, actual[name])
+		}
+	}
+	if len(actual) != len(expect) {
+		t.Errorf("テーブルの数が異なります.Expect: %v, Actual: %v", len(expect), len(actual))
+	}
+
+	// 以前のデータはそのまま使える. 存在しないアルバムのページはfsckに任せて残す
+	p, err := store.FindPageById(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Title != "day 1" || p.MoviePath != "abc123.mp4" || p.AlbumId != 1 {
+		t.Errorf("ページが引き継がれていません.Actual: %+v", p)
+	}
+	if _, err := store.FindPageById(2); err != nil {
+		t.Errorf("存在しないアルバムのページが消えました.err: %v", err)
+	}
+	u := &user{Name: "alice", Role: roleEditor}
+	if err := u.SetPassword("correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SaveUser(u); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.AddPageVideo(p, "ghi789.mp4", u.Id, "new version"); err != nil {
+		t.Fatal(err)
+	}
+	videos, err := store.FindPageVideosByPageId(p.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(videos) != 2 {
+		t.Errorf("以前の動画が版として記録されていません.Actual: %v", len(videos))
+	}
+	m, err := store.FindAlbumById(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.CoverPageId = p.Id
+	if err := store.SaveAlbum(m); err != nil {
+		t.Fatal(err)
+	}
+	// 作り直したpagesにも外部キー制約が効く
+	if _, err := store.db.Exec("DELETE FROM albums WHERE id = 1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.FindPageById(1); err != sql.ErrNoRows {
+		t.Errorf("アルバムと一緒にページが削除されていません.err: %v", err)
+	}
+}
+
+func TestMigrateUnversionedDatabase(t *testing.T) {
+	dir, err := ioutil.TempDir("", "video_album_migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := openDB(dialectSQLite, filepath.Join(dir, "album.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// 変更の記録を始める前の最後の版で作ったDBは, 全て適用済みとする
+	if _, err := applyMigrations(db); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("DROP TABLE schema_migrations"); err != nil {
+		t.Fatal(err)
+	}
+	applied, err := applyMigrations(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != len(migrations)-unversionedSchemaVersion {
+		t.Errorf("適用済みの変更を適用しました.Actual: %v", len(applied))
+	}
+	versions, err := appliedMigrations(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != len(migrations) {
+		t.Errorf("適用済みとして記録されていません.Actual: %v", versions)
+	}
+
+	// どの版か分からないDBは変更しない
+	if _, err := db.Exec("DROP TABLE schema_migrations; DROP TABLE blobs"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := applyMigrations(db); err == nil {
+		t.Errorf("版の分からないDBに変更を適用しました")
+	}
+}
@@ -4,62 +4,73 @@ import (
 	"database/sql"
 	"errors"
 	_ "github.com/mattn/go-sqlite3"
+	"os"
+	"strings"
 	"unicode/utf8"
 )
 
-const dbFilePath = "album.db"
-
-func DBCreate() error {
-	db, err := sql.Open("sqlite3", dbFilePath)
-	if err != nil {
-		return err
-	}
-
-	_, err = db.Exec(`
-		CREATE TABLE "albums" (
-			"id" INTEGER PRIMARY KEY AUTOINCREMENT,
-			"title" VARCHAR(32)
-		);
-		CREATE TABLE "pages" (
-			"id" INTEGER PRIMARY KEY AUTOINCREMENT,
-			"album_id" INTEGER NOT NULL,
-			"title" VARCHAR(128) NOT NULL,
-			"description" VARCHAR(1024) NOT NULL,
-			"filepath" VARCHAR(1024)
-		);
-	`)
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
 type album struct {
-	Id    int64
-	Title string
+	Id    int64  `json:"id"`
+	Title string `json:"title"`
+	// 表紙に選んだページ. 未選択なら0
+	CoverPageId int64 `json:"cover_page_id"`
+	// 表紙の画像. 未選択ならサムネイルのある最初のページのもの. どちらも無ければ空
+	Cover string `json:"cover"`
 }
 
-func FindAlbum(title_cond string) ([]*album, error) {
+// アルバムの表紙の画像を取得するための列. albumsとcover(表紙のページ)を結合して使う
+const albumCoverColumn = `
+			COALESCE(
+				NULLIF(cover.thumbnail, ''),
+				(
+					SELECT
+						first.thumbnail
+					FROM
+						pages first
+					WHERE
+						first.album_id = albums.id
+						AND first.thumbnail IS NOT NULL
+						AND first.thumbnail <> ''
+					ORDER BY
+						first.id
+					LIMIT 1
+				),
+				''
+			) AS cover`
+
+/*
+ * タイトルの部分一致でアルバムを検索する.
+ * viewerが参照できないアルバムは結果に含めない. viewerがnilの場合は全件が対象.
+ */
+func (s *Store) FindAlbum(title_cond string, viewer *user) ([]*album, error) {
 	query := `
 		SELECT
-			id    AS id,
-			title AS title
+			albums.id    AS id,
+			albums.title AS title,
+			albums.cover_page_id AS cover_page_id,` + albumCoverColumn + `
 		FROM
 			albums
+			LEFT JOIN pages cover ON cover.id = albums.cover_page_id AND cover.album_id = albums.id
+		WHERE
+			1 = 1
 			`
+	// PostgreSQLのLIKEは大文字と小文字を区別するため, SQLiteに合わせて揃えてから比べる
 	option := `
-		WHERE
-			title LIKE ?
+			AND LOWER(albums.title) LIKE LOWER(?)
 	`
-	db, err := sql.Open("sqlite3", dbFilePath)
-	if err != nil {
-		return nil, err
-	}
+	db := s.db
 
+	args := make([]interface{}, 0)
 	if len(title_cond) > 0 {
 		query += option
+		args = append(args, "%"+title_cond+"%")
+	}
+	if viewer != nil && viewer.Role != roleAdmin {
+		query += " AND " + albumReadableCond
+		args = append(args, viewer.Id, viewer.Id)
 	}
-	rows, err := db.Query(query, "%"+title_cond+"%")
+	query += " ORDER BY albums.id"
+	rows, err := db.Query(query, args...)
 
 	if err != nil {
 		return nil, err
@@ -70,61 +81,58 @@ func FindAlbum(title_cond string) ([]*album, error) {
 	for rows.Next() {
 		var id int64
 		var title string
-		if err := rows.Scan(&id, &title); err != nil {
+		var coverPageId sql.NullInt64
+		var cover string
+		if err := rows.Scan(&id, &title, &coverPageId, &cover); err != nil {
 			return nil, err
 		}
-		m := &album{Id: id, Title: title}
+		m := &album{Id: id, Title: title, CoverPageId: coverPageId.Int64, Cover: cover}
 		ret = append(ret, m)
 	}
 
 	return ret, nil
 }
 
-func FindAlbumById(id int64) (*album, error) {
+func (s *Store) FindAlbumById(id int64) (*album, error) {
 	query := `
 		SELECT
-			title AS title
+			albums.title AS title,
+			albums.cover_page_id AS cover_page_id,` + albumCoverColumn + `
 		FROM
 			albums
+			LEFT JOIN pages cover ON cover.id = albums.cover_page_id AND cover.album_id = albums.id
 		WHERE
-			id = ?
+			albums.id = ?
 	`
-	db, err := sql.Open("sqlite3", dbFilePath)
-	if err != nil {
-		return nil, err
-	}
+	db := s.db
 	var title string
-	err = db.QueryRow(query, id).Scan(&title)
+	var coverPageId sql.NullInt64
+	var cover string
+	err := db.QueryRow(query, id).Scan(&title, &coverPageId, &cover)
 	if err != nil {
 		return nil, err
 	}
 
-	m := &album{Id: id, Title: title}
+	m := &album{Id: id, Title: title, CoverPageId: coverPageId.Int64, Cover: cover}
 
 	return m, nil
 }
 
-func (m *album) create() error {
+func (s *Store) createAlbum(m *album) error {
 	query := `
 		INSERT INTO albums (title) values(?)
 	`
-	db, err := sql.Open("sqlite3", dbFilePath)
-	if err != nil {
-		return err
-	}
-	res, err := db.Exec(query, m.Title)
-	if err != nil {
-		return err
-	}
-	m.Id, err = res.LastInsertId()
+	db := s.db
+	id, err := db.Insert(query, m.Title)
 	if err != nil {
 		return err
 	}
+	m.Id = id
 
 	return nil
 }
 
-func (m *album) update() error {
+func (s *Store) updateAlbum(m *album) error {
 	query := `
 		UPDATE
 			albums
@@ -133,11 +141,8 @@ func (m *album) update() error {
 		WHERE
 			id = ?
 	`
-	db, err := sql.Open("sqlite3", dbFilePath)
-	if err != nil {
-		return err
-	}
-	_, err = db.Exec(query, m.Title, m.Id)
+	db := s.db
+	_, err := db.Exec(query, m.Title, m.Id)
 	if err != nil {
 		return err
 	}
@@ -152,65 +157,385 @@ func (m *album) Validate() error {
 	return nil
 }
 
-func (m *album) Save() error {
-	_, err := FindAlbumById(m.Id)
+func (s *Store) SaveAlbum(m *album) error {
+	_, err := s.FindAlbumById(m.Id)
 	if err := m.Validate(); err != nil {
 		return err
 	}
 	if err == nil {
-		return m.update()
+		return s.updateAlbum(m)
 	} else {
-		return m.create()
+		return s.createAlbum(m)
 	}
 }
 
-func (m *album) Remove() error {
+/*
+ * アルバムの表紙にするページを選ぶ. pageIdが0なら選択を解除する.
+ * 他のアルバムのページを指定した場合はsql.ErrNoRowsを返す.
+ */
+func (s *Store) SetAlbumCover(m *album, pageId int64) error {
 	query := `
+		UPDATE
+			albums
+		SET
+			cover_page_id = ?
+		WHERE
+			id = ?
+	`
+	db := s.db
+
+	cover := sql.NullInt64{}
+	if pageId != 0 {
+		p, err := s.FindPageById(pageId)
+		if err != nil {
+			return err
+		}
+		if p.AlbumId != m.Id {
+			return sql.ErrNoRows
+		}
+		cover = sql.NullInt64{Int64: pageId, Valid: true}
+	}
+	if _, err := db.Exec(query, cover, m.Id); err != nil {
+		return err
+	}
+	m.CoverPageId = pageId
+	return nil
+}
+
+/*
+ * アルバムとそのページをまとめて削除する.
+ * 動画ファイルはDBの削除が確定してから消す.
+ */
+func (s *Store) RemoveAlbum(m *album) error {
+	filesQuery := `
+		SELECT
+			filepath AS filepath
+		FROM
+			pages
+		WHERE
+			album_id = ?
+		UNION ALL
+		SELECT
+			thumbnail AS filepath
+		FROM
+			pages
+		WHERE
+			album_id = ?
+		UNION ALL
+		SELECT
+			video.filepath AS filepath
+		FROM
+			page_videos video
+			INNER JOIN pages page ON page.id = video.page_id
+		WHERE
+			page.album_id = ?
+		UNION ALL
+		SELECT
+			video.thumbnail AS filepath
+		FROM
+			page_videos video
+			INNER JOIN pages page ON page.id = video.page_id
+		WHERE
+			page.album_id = ?
+		UNION ALL
+		SELECT
+			rendition.filepath AS filepath
+		FROM
+			page_renditions rendition
+			INNER JOIN page_videos video ON video.id = rendition.video_id
+			INNER JOIN pages page ON page.id = video.page_id
+		WHERE
+			page.album_id = ?
+		UNION ALL
+		SELECT
+			stream.filepath AS filepath
+		FROM
+			page_stream_files stream
+			INNER JOIN page_videos video ON video.id = stream.video_id
+			INNER JOIN pages page ON page.id = video.page_id
+		WHERE
+			page.album_id = ?
+	`
+	queries := []string{`
+		DELETE
+		FROM
+			page_renditions
+		WHERE
+			video_id IN (
+				SELECT video.id FROM page_videos video INNER JOIN pages page ON page.id = video.page_id WHERE page.album_id = ?
+			)
+	`, `
+		DELETE
+		FROM
+			page_stream_files
+		WHERE
+			video_id IN (
+				SELECT video.id FROM page_videos video INNER JOIN pages page ON page.id = video.page_id WHERE page.album_id = ?
+			)
+	`, `
+		DELETE
+		FROM
+			page_videos
+		WHERE
+			page_id IN (SELECT id FROM pages WHERE album_id = ?)
+	`, `
+		DELETE
+		FROM
+			page_revisions
+		WHERE
+			page_id IN (SELECT id FROM pages WHERE album_id = ?)
+	`, `
+		DELETE
+		FROM
+			pages
+		WHERE
+			album_id = ?
+	`, `
+		DELETE
+		FROM
+			album_members
+		WHERE
+			album_id = ?
+	`, `
 		DELETE
 		FROM
 			albums
 		WHERE
 			id = ?
-	`
-	db, err := sql.Open("sqlite3", dbFilePath)
+	`}
+	db := s.db
+
+	tx, err := db.Begin()
 	if err != nil {
 		return err
 	}
-	_, err = db.Exec(query, m.Id)
+	defer tx.Rollback()
+
+	files, err := queryMovieFiles(tx, filesQuery, m.Id, m.Id, m.Id, m.Id, m.Id, m.Id)
 	if err != nil {
 		return err
 	}
+	if err := cancelPageJobs(tx, "SELECT id FROM pages WHERE album_id = ?", m.Id); err != nil {
+		return err
+	}
+	if err := releaseBlobs(tx, "SELECT id FROM pages WHERE album_id = ?", m.Id); err != nil {
+		return err
+	}
+	for _, query := range queries {
+		if _, err := tx.Exec(query, m.Id); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return s.removeMovieFiles(files)
+}
 
-	return nil
+/*
+ * ファイル名を1列返すクエリを実行し, 空でないものを返す.
+ */
+func queryMovieFiles(tx *storeTx, query string, args ...interface{}) ([]string, error) {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	files := make([]string, 0)
+	for rows.Next() {
+		var file sql.NullString
+		if err := rows.Scan(&file); err != nil {
+			return nil, err
+		}
+		if file.String != "" {
+			files = append(files, file.String)
+		}
+	}
+	return files, nil
+}
+
+/*
+ * 動画ファイルを削除する. 既に無いファイルは無視する.
+ * 他のページが参照している動画と, その動画から作ったファイルは残す.
+ * 途中で失敗しても残りのファイルの削除は続ける.
+ */
+func (s *Store) removeMovieFiles(files []string) error {
+	var ret error
+	for _, file := range files {
+		if file == "" {
+			continue
+		}
+		if err := s.removeMovieFile(file); err != nil && !os.IsNotExist(err) && ret == nil {
+			ret = err
+		}
+	}
+	return ret
+}
+
+func (s *Store) removeMovieFile(file string) error {
+	sum := blobSum(file)
+	if sum == "" {
+		return movieStorage.Delete(file)
+	}
+	db := s.db
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := lockBlob(tx, sum); err != nil {
+		return err
+	}
+	if referenced, err := blobReferenced(tx, sum); err != nil || referenced {
+		return err
+	}
+	if err := movieStorage.Delete(file); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
 type page struct {
-	Id          int64
-	AlbumId     int64
-	Title       string
-	Description string
-	MoviePath   string
+	Id          int64  `json:"id"`
+	AlbumId     int64  `json:"album_id"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	MoviePath   string `json:"movie_path"`
+	// 動画のContent-Type. 動画が無ければ空
+	MimeType string `json:"mime_type"`
+	// 動画のポスター画像. 無ければ空
+	Thumbnail string `json:"thumbnail"`
+	// 現在の動画をブラウザ向けに変換中か
+	Processing bool `json:"processing"`
+	// 現在の動画のHLSのマスタープレイリスト. 無ければ空
+	StreamPath string `json:"stream_path"`
+	// 動画の長さや解像度など. 動画が無いか, まだ調べていなければnil
+	Media *mediaInfo `json:"media"`
+	// 保存したユーザー. 変更履歴に記録する
+	UpdatedBy int64 `json:"-"`
 }
 
-func FindPageByAlbumId(albumId int64) ([]*page, error) {
-	query := `
-		SELECT
-			page.id    AS id,
+func (s *Store) FindPageByAlbumId(albumId int64) ([]*page, error) {
+	return s.FindPageByFilter(albumId, &pageFilter{})
+}
+
+/*
+ * ページを動画の情報で絞り込む条件.
+ * 0や空の項目は条件にしない.
+ */
+type pageFilter struct {
+	MinDurationMs int64
+	MaxDurationMs int64
+	MinHeight     int64
+	MaxHeight     int64
+	VideoCodec    string
+	AudioCodec    string
+	// ffprobeのformat_nameの候補のいずれかに一致すればよい
+	Container string
+}
+
+func (f *pageFilter) where() (string, []interface{}) {
+	conds := make([]string, 0)
+	args := make([]interface{}, 0)
+	if f.MinDurationMs > 0 {
+		conds = append(conds, "page.duration_ms >= ?")
+		args = append(args, f.MinDurationMs)
+	}
+	if f.MaxDurationMs > 0 {
+		conds = append(conds, "page.duration_ms <= ?")
+		args = append(args, f.MaxDurationMs)
+	}
+	if f.MinHeight > 0 {
+		conds = append(conds, "page.height >= ?")
+		args = append(args, f.MinHeight)
+	}
+	if f.MaxHeight > 0 {
+		conds = append(conds, "page.height <= ?")
+		args = append(args, f.MaxHeight)
+	}
+	if f.VideoCodec != "" {
+		conds = append(conds, "page.video_codec = ?")
+		args = append(args, f.VideoCodec)
+	}
+	if f.AudioCodec != "" {
+		conds = append(conds, "page.audio_codec = ?")
+		args = append(args, f.AudioCodec)
+	}
+	if f.Container != "" {
+		conds = append(conds, "(',' || page.container || ',') LIKE ('%,' || CAST(? AS TEXT) || ',%')")
+		args = append(args, f.Container)
+	}
+	if len(conds) == 0 {
+		return "", args
+	}
+	return " AND " + strings.Join(conds, " AND "), args
+}
+
+const pageColumns = `
+			page.id AS id,
 			page.album_id AS album_id,
 			page.title AS title,
 			page.description AS description,
-			page.filepath AS filepath
+			page.filepath AS filepath,
+			page.mime_type AS mime_type,
+			page.thumbnail AS thumbnail,
+			EXISTS (
+				SELECT 1 FROM page_videos video WHERE video.page_id = page.id AND video.retired_at IS NULL AND video.status = 'processing'
+			) AS processing,
+			(
+				SELECT video.stream_path FROM page_videos video WHERE video.page_id = page.id AND video.retired_at IS NULL LIMIT 1
+			) AS stream_path,
+			page.duration_ms AS duration_ms,
+			page.width AS width,
+			page.height AS height,
+			page.video_codec AS video_codec,
+			page.audio_codec AS audio_codec,
+			page.bitrate AS bitrate,
+			page.container AS container,
+			page.file_size AS file_size
 		FROM
 			pages page
-		WHERE
-			page.album_id = ?
-			`
-	db, err := sql.Open("sqlite3", dbFilePath)
-	if err != nil {
+`
+
+func scanPage(row interface {
+	Scan(dest ...interface{}) error
+}) (*page, error) {
+	m := &page{}
+	var filepath sql.NullString
+	var mimeType sql.NullString
+	var thumbnail sql.NullString
+	var streamPath sql.NullString
+	var media nullMediaInfo
+	dest := append([]interface{}{&m.Id, &m.AlbumId, &m.Title, &m.Description, &filepath, &mimeType, &thumbnail, &m.Processing, &streamPath}, media.dest()...)
+	if err := row.Scan(dest...); err != nil {
 		return nil, err
 	}
+	m.StreamPath = streamPath.String
+	m.MoviePath = filepath.String
+	m.MimeType = videoMimeType(m.MoviePath, mimeType)
+	m.Thumbnail = thumbnail.String
+	m.Media = media.value()
+	return m, nil
+}
 
-	rows, err := db.Query(query, albumId)
+/*
+ * アルバムのページのうち, 条件に一致するものを返す.
+ */
+func (s *Store) FindPageByFilter(albumId int64, filter *pageFilter) ([]*page, error) {
+	where, args := filter.where()
+	query := `
+		SELECT` + pageColumns + `
+		WHERE
+			page.album_id = ?` + where + `
+		ORDER BY
+			page.id
+	`
+	db := s.db
+
+	rows, err := db.Query(query, append([]interface{}{albumId}, args...)...)
 
 	if err != nil {
 		return nil, err
@@ -219,86 +544,186 @@ func FindPageByAlbumId(albumId int64) ([]*page, error) {
 
 	ret := make([]*page, 0)
 	for rows.Next() {
-		var id int64
-		var albumId int64
-		var title string
-		var description string
-		var filepath sql.NullString
-		if err := rows.Scan(&id, &albumId, &title, &description, &filepath); err != nil {
+		m, err := scanPage(rows)
+		if err != nil {
 			return nil, err
 		}
-		filepathstr := ""
-		if filepath.Valid {
-			filepathstr = filepath.String
-		}
-		m := &page{Id: id, AlbumId: albumId, Title: title, Description: description, MoviePath: filepathstr}
 		ret = append(ret, m)
 	}
 
 	return ret, nil
 }
 
-func FindPageById(pageId int64) (*page, error) {
+func (s *Store) FindPageById(pageId int64) (*page, error) {
+	query := `
+		SELECT` + pageColumns + `
+		WHERE
+			page.id = ?
+			`
+	db := s.db
+
+	return scanPage(db.QueryRow(query, pageId))
+}
+
+/*
+ * 動画があるのにサムネイルの無いページを返す.
+ */
+func (s *Store) FindPagesWithoutThumbnail() ([]*page, error) {
 	query := `
 		SELECT
-			page.album_id AS album_id,
-			page.title AS title,
-			page.description AS description,
-			page.filepath AS filepath
+			page.id AS id
 		FROM
 			pages page
 		WHERE
-			page.id = ?
-			`
-	db, err := sql.Open("sqlite3", dbFilePath)
+			page.filepath IS NOT NULL
+			AND page.filepath <> ''
+			AND (page.thumbnail IS NULL OR page.thumbnail = '')
+		ORDER BY
+			page.id
+	`
+	db := s.db
+
+	rows, err := db.Query(query)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
-	rows, err := db.Query(query, pageId)
+	ids := make([]int64, 0)
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
 
-	if err != nil {
-		return nil, err
+	ret := make([]*page, 0)
+	for _, id := range ids {
+		m, err := s.FindPageById(id)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, m)
 	}
-	defer rows.Close()
+	return ret, nil
+}
 
-	var albumId int64
-	var title string
-	var description string
-	var filepath sql.NullString
-	err = db.QueryRow(query, pageId).Scan(&albumId, &title, &description, &filepath)
+/*
+ * 動画があるのに長さや解像度などを調べていないページを返す.
+ */
+func (s *Store) FindPagesWithoutMediaInfo() ([]*page, error) {
+	query := `
+		SELECT` + pageColumns + `
+		WHERE
+			page.filepath IS NOT NULL
+			AND page.filepath <> ''
+			AND page.container IS NULL
+		ORDER BY
+			page.id
+	`
+	db := s.db
+
+	rows, err := db.Query(query)
 	if err != nil {
 		return nil, err
 	}
-	filepathstr := ""
-	if filepath.Valid {
-		filepathstr = filepath.String
+	defer rows.Close()
+
+	ret := make([]*page, 0)
+	for rows.Next() {
+		m, err := scanPage(rows)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, m)
 	}
-	m := &page{Id: pageId, AlbumId: albumId, Title: title, Description: description, MoviePath: filepathstr}
-	return m, nil
+	return ret, nil
 }
 
-func (m *page) create() error {
+/*
+ * 動画やサムネイルのファイルをviewerが参照できるか.
+ * 同じ動画は複数のページで共有されるため, ファイルを持つページのいずれかが参照できるアルバムにあれば参照できる.
+ * 以前の版や変換後の動画, HLSのファイルも対象. どのページも持たないファイルの場合はsql.ErrNoRowsを返す.
+ */
+func (s *Store) canReadMovie(moviePath string, viewer *user) (bool, error) {
+	readable := "1"
+	args := make([]interface{}, 0)
+	if viewer != nil && viewer.Role != roleAdmin {
+		readable = "CASE WHEN " + albumReadableCond + " THEN 1 ELSE 0 END"
+		args = append(args, viewer.Id, viewer.Id)
+	}
 	query := `
-		INSERT INTO pages (album_id, title, description, filepath) values(?, ?, ?, ?)
+		SELECT
+			COUNT(*),
+			COALESCE(SUM(` + readable + `), 0)
+		FROM
+			pages page
+			INNER JOIN albums ON albums.id = page.album_id
+		WHERE
+			page.id IN (
+				SELECT
+					id
+				FROM
+					pages
+				WHERE
+					filepath = ?
+					OR thumbnail = ?
+				UNION
+				SELECT
+					page_id
+				FROM
+					page_videos
+				WHERE
+					filepath = ?
+					OR thumbnail = ?
+				UNION
+				SELECT
+					video.page_id
+				FROM
+					page_renditions rendition
+					INNER JOIN page_videos video ON video.id = rendition.video_id
+				WHERE
+					rendition.filepath = ?
+				UNION
+				SELECT
+					video.page_id
+				FROM
+					page_stream_files stream
+					INNER JOIN page_videos video ON video.id = stream.video_id
+				WHERE
+					stream.filepath = ?
+			)
 	`
-	db, err := sql.Open("sqlite3", dbFilePath)
-	if err != nil {
-		return err
+	db := s.db
+
+	for i := 0; i < 6; i++ {
+		args = append(args, moviePath)
 	}
-	res, err := db.Exec(query, m.AlbumId, m.Title, m.Description, m.MoviePath)
-	if err != nil {
-		return err
+	var pages, readablePages int64
+	if err := db.QueryRow(query, args...).Scan(&pages, &readablePages); err != nil {
+		return false, err
+	}
+	if pages == 0 {
+		return false, sql.ErrNoRows
 	}
-	m.Id, err = res.LastInsertId()
+	return readablePages > 0, nil
+}
+
+func createPage(tx *storeTx, m *page) error {
+	query := `
+		INSERT INTO pages (album_id, title, description, filepath) values(?, ?, ?, ?)
+	`
+	id, err := tx.Insert(query, m.AlbumId, m.Title, m.Description, m.MoviePath)
 	if err != nil {
 		return err
 	}
-
-	return nil
+	m.Id = id
+	return insertPageRevision(tx, m)
 }
 
-func (m *page) update() error {
+func updatePage(tx *storeTx, m *page) error {
 	query := `
 		UPDATE
 			pages
@@ -309,16 +734,14 @@ func (m *page) update() error {
 		WHERE
 			id = ?
 	`
-	db, err := sql.Open("sqlite3", dbFilePath)
-	if err != nil {
+	// 履歴の記録が始まる前のページは, 更新前の内容を編集者不明の版として残す
+	if err := insertInitialPageRevision(tx, m.Id); err != nil {
 		return err
 	}
-	_, err = db.Exec(query, m.AlbumId, m.Title, m.Description, m.Id)
-	if err != nil {
+	if _, err := tx.Exec(query, m.AlbumId, m.Title, m.Description, m.Id); err != nil {
 		return err
 	}
-
-	return nil
+	return insertPageRevision(tx, m)
 }
 
 func (m *page) Validate() error {
@@ -334,70 +757,247 @@ func (m *page) Validate() error {
 	return nil
 }
 
-func (m *page) Save() error {
+func (s *Store) SavePage(m *page) error {
+	db := s.db
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := savePage(tx, m); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+/*
+ * ページが既にあれば更新し, 無ければ作成する.
+ */
+func savePage(tx *storeTx, m *page) error {
 	if err := m.Validate(); err != nil {
 		return err
 	}
-	_, err := FindPageById(m.Id)
-	if err == nil {
-		return m.update()
-	} else {
-		return m.create()
+	var n int64
+	if err := tx.QueryRow("SELECT COUNT(*) FROM pages WHERE id = ?", m.Id).Scan(&n); err != nil {
+		return err
+	}
+	if n > 0 {
+		return updatePage(tx, m)
 	}
+	return createPage(tx, m)
 }
 
-func (m *page) Remove() error {
-	query := `
-		DELETE
+/*
+ * ページを削除し, 削除が確定してから動画ファイルを消す.
+ * 動画ファイルはmの値ではなくDBに保存されているものを, 以前の版とサムネイルも含めて消す.
+ */
+func (s *Store) RemovePage(m *page) error {
+	filesQuery := `
+		SELECT
+			filepath AS filepath
+		FROM
+			pages
+		WHERE
+			id = ?
+		UNION ALL
+		SELECT
+			thumbnail AS filepath
 		FROM
 			pages
 		WHERE
 			id = ?
+		UNION ALL
+		SELECT
+			filepath AS filepath
+		FROM
+			page_videos
+		WHERE
+			page_id = ?
+		UNION ALL
+		SELECT
+			thumbnail AS filepath
+		FROM
+			page_videos
+		WHERE
+			page_id = ?
+		UNION ALL
+		SELECT
+			rendition.filepath AS filepath
+		FROM
+			page_renditions rendition
+			INNER JOIN page_videos video ON video.id = rendition.video_id
+		WHERE
+			video.page_id = ?
+		UNION ALL
+		SELECT
+			stream.filepath AS filepath
+		FROM
+			page_stream_files stream
+			INNER JOIN page_videos video ON video.id = stream.video_id
+		WHERE
+			video.page_id = ?
 	`
-	db, err := sql.Open("sqlite3", dbFilePath)
+	queries := []string{`
+		UPDATE
+			albums
+		SET
+			cover_page_id = NULL
+		WHERE
+			cover_page_id = ?
+	`, `
+		DELETE
+		FROM
+			page_renditions
+		WHERE
+			video_id IN (SELECT id FROM page_videos WHERE page_id = ?)
+	`, `
+		DELETE
+		FROM
+			page_stream_files
+		WHERE
+			video_id IN (SELECT id FROM page_videos WHERE page_id = ?)
+	`, `
+		DELETE
+		FROM
+			page_videos
+		WHERE
+			page_id = ?
+	`, `
+		DELETE
+		FROM
+			page_revisions
+		WHERE
+			page_id = ?
+	`, `
+		DELETE
+		FROM
+			pages
+		WHERE
+			id = ?
+	`}
+	db := s.db
+
+	tx, err := db.Begin()
 	if err != nil {
 		return err
 	}
-	_, err = db.Exec(query, m.Id)
+	defer tx.Rollback()
+
+	files, err := queryMovieFiles(tx, filesQuery, m.Id, m.Id, m.Id, m.Id, m.Id, m.Id)
 	if err != nil {
 		return err
 	}
-	return nil
+	if err := cancelPageJobs(tx, "?", m.Id); err != nil {
+		return err
+	}
+	if err := releaseBlobs(tx, "?", m.Id); err != nil {
+		return err
+	}
+
+	for _, query := range queries {
+		if _, err := tx.Exec(query, m.Id); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return s.removeMovieFiles(files)
+}
+
+type albumListData struct {
+	Albums    []*album
+	LoginUser *user
 }
 
 type pageListData struct {
 	Album      *album
 	Pages      []*page
 	SelectPage *page
+	LoginUser  *user
+	// LoginUserがこのアルバムを更新できるか
+	Writable bool
+	// SelectPageの動画の版と, 表示する版
+	Videos      []*pageVideo
+	SelectVideo *pageVideo
+}
+
+/*
+ * SelectPageの動画の版を読み込み, 表示する版を選ぶ.
+ * videoIdが0の場合は現在の版を表示する.
+ */
+func (s *Store) SelectPageVersion(d *pageListData, videoId int64) error {
+	d.Videos = nil
+	d.SelectVideo = nil
+	if d.SelectPage == nil {
+		return nil
+	}
+	videos, err := s.FindPageVideosByPageId(d.SelectPage.Id)
+	if err != nil {
+		return err
+	}
+	d.Videos = videos
+	for _, v := range videos {
+		if (videoId == 0 && v.Current) || v.Id == videoId {
+			d.SelectVideo = v
+			v.Renditions, err = s.FindRenditionsByVideoId(v.Id)
+			return err
+		}
+	}
+	if videoId != 0 {
+		return sql.ErrNoRows
+	}
+	return nil
 }
 
-func FindPageListData(albumId int64) (*pageListData, error) {
-	album, err := FindAlbumById(albumId)
+/*
+ * アルバムとそのページ一覧を取得する.
+ * viewerがアルバムを参照できない場合はerrAlbumForbiddenを返す.
+ */
+func (s *Store) FindPageListData(albumId int64, viewer *user) (*pageListData, error) {
+	album, err := s.FindAlbumById(albumId)
 	if err != nil {
 		return nil, err
 	}
-	pages, err := FindPageByAlbumId(album.Id)
+	readable, err := s.canReadAlbum(album.Id, viewer)
 	if err != nil {
 		return nil, err
 	}
-	pld := &pageListData{Album: album, Pages: pages}
+	if !readable {
+		return nil, errAlbumForbidden
+	}
+	writable, err := s.canWriteAlbum(album.Id, viewer)
+	if err != nil {
+		return nil, err
+	}
+	pages, err := s.FindPageByAlbumId(album.Id)
+	if err != nil {
+		return nil, err
+	}
+	pld := &pageListData{Album: album, Pages: pages, LoginUser: viewer, Writable: writable}
 	if len(pages) > 0 {
 		pld.SelectPage = pages[0]
 	}
+	if err := s.SelectPageVersion(pld, 0); err != nil {
+		return nil, err
+	}
 	return pld, nil
 }
 
 type pageEditData struct {
 	Album      *album
 	SelectPage *page
+	LoginUser  *user
 }
 
-func FindPageEditData(albumId int64, pageId int64) (*pageEditData, error) {
-	album, err := FindAlbumById(albumId)
+func (s *Store) FindPageEditData(albumId int64, pageId int64) (*pageEditData, error) {
+	album, err := s.FindAlbumById(albumId)
 	if err != nil {
 		return nil, err
 	}
-	page, err := FindPageById(pageId)
+	page, err := s.FindPageById(pageId)
 	ped := &pageEditData{Album: album, SelectPage: page}
 	return ped, nil
 }
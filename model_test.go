@@ -1,23 +1,43 @@
 package main
 
 import (
-	"database/sql"
 	_ "github.com/mattn/go-sqlite3"
+	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
+// テスト用に一時ディレクトリに作ったDB
+var testStore *Store
+
+// VIDEO_ALBUM_TEST_POSTGRES_DSNで指定されたテスト用のDB. 指定が無ければnil
+var testPostgresStore *Store
+
+const testPostgresSkipReason = "VIDEO_ALBUM_TEST_POSTGRES_DSN is not set, the model tests are not run on PostgreSQL"
+
 // テスト事にDBをリセットするため
 func truncateTables() {
-	db, err := sql.Open("sqlite3", dbFilePath)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	_, err = db.Exec(`
+	_, err := testStore.db.Exec(`
 		DELETE FROM albums;
 		DELETE FROM pages;
+		DELETE FROM page_renditions;
+		DELETE FROM page_stream_files;
+		DELETE FROM page_videos;
+		DELETE FROM page_revisions;
+		DELETE FROM users;
+		DELETE FROM sessions;
+		DELETE FROM groups;
+		DELETE FROM group_members;
+		DELETE FROM album_members;
+		DELETE FROM api_tokens;
+		DELETE FROM jobs;
+		DELETE FROM upload_chunks;
+		DELETE FROM uploads;
+		DELETE FROM blobs;
 	`)
 	if err != nil {
 		log.Fatal(err)
@@ -25,335 +45,587 @@ func truncateTables() {
 }
 
 func TestMain(m *testing.M) {
-	if fileExists(dbFilePath) == true {
-		if err := os.Remove(dbFilePath); err != nil {
-			log.Fatal(err)
-		}
+	dir, err := ioutil.TempDir("", "video_album_db")
+	if err != nil {
+		log.Fatal(err)
 	}
-	if err := DBCreate(); err != nil {
+	testStore, err = OpenStore(filepath.Join(dir, "album.db"))
+	if err != nil {
 		log.Fatal(err)
 	}
-	os.Exit(m.Run())
+	if _, err := testStore.MigrateUp(); err != nil {
+		log.Fatal(err)
+	}
+	if dsn := os.Getenv("VIDEO_ALBUM_TEST_POSTGRES_DSN"); dsn != "" {
+		testPostgresStore = openTestPostgresStore(dsn)
+	} else {
+		log.Println(testPostgresSkipReason)
+	}
+	code := m.Run()
+	testStore.Close()
+	if testPostgresStore != nil {
+		testPostgresStore.Close()
+	}
+	os.RemoveAll(dir)
+	os.Exit(code)
 }
 
-func TestAlbumCreateBySave(t *testing.T) {
-	defer truncateTables()
-
-	expect := "test title"
-	m := &album{Title: expect}
-	if err := m.Save(); err != nil {
-		t.Fatal(err)
-	}
-	res, err := FindAlbumById(m.Id)
+/*
+ * テスト用のPostgreSQLを開く.
+ * テーブルの中身は削除される.
+ */
+func openTestPostgresStore(dsn string) *Store {
+	store, err := OpenStore(dsn)
 	if err != nil {
-		t.Errorf("Save関数で作成したアルバムが見つかりませんでした.")
+		log.Fatal(err)
 	}
-	if res.Title != expect {
-		t.Errorf("Save関数で作成したアルバムのタイトルが保存したものと異なります.Expect:%v, Actual:%v", res.Title, expect)
+	if _, err := store.MigrateUp(); err != nil {
+		log.Fatal(err)
 	}
+	sqlite := testStore
+	testStore = store
+	truncateTables()
+	testStore = sqlite
+	return store
+}
+
+// テスト用のDBを使ってハンドラーを呼び出す
+func serveTest(h http.HandlerFunc, w http.ResponseWriter, r *http.Request) {
+	testStore.Handler(h).ServeHTTP(w, r)
+}
+
+/*
+ * テストをテスト用のDBに対して実行する.
+ * VIDEO_ALBUM_TEST_POSTGRES_DSNにテスト用のPostgreSQLが指定されていれば, そちらに対しても実行し,
+ * 指定されていなければスキップしたことを表示する.
+ */
+func forEachStore(t *testing.T, f func(t *testing.T)) {
+	t.Run("SQLite", f)
+	t.Run("PostgreSQL", func(t *testing.T) {
+		if testPostgresStore == nil {
+			t.Skip(testPostgresSkipReason)
+		}
+		sqlite := testStore
+		testStore = testPostgresStore
+		defer func() { testStore = sqlite }()
+		f(t)
+	})
+}
+
+func TestAlbumCreateBySave(t *testing.T) {
+	forEachStore(t, func(t *testing.T) {
+		defer truncateTables()
+
+		expect := "test title"
+		m := &album{Title: expect}
+		if err := testStore.SaveAlbum(m); err != nil {
+			t.Fatal(err)
+		}
+		res, err := testStore.FindAlbumById(m.Id)
+		if err != nil {
+			t.Errorf("Save関数で作成したアルバムが見つかりませんでした.")
+		}
+		if res.Title != expect {
+			t.Errorf("Save関数で作成したアルバムのタイトルが保存したものと異なります.Expect:%v, Actual:%v", res.Title, expect)
+		}
+	})
 }
 
 func TestAlbumCreateValidate(t *testing.T) {
-	defer truncateTables()
+	forEachStore(t, func(t *testing.T) {
+		defer truncateTables()
 
-	tooLongTitle := "123456789012345678901234567890123"
-	m := &album{Title: tooLongTitle}
-	if err := m.Save(); err == nil {
-		t.Errorf("32文字制限であるはずのタイトルに33文字での登録が行われました")
-	}
+		tooLongTitle := "123456789012345678901234567890123"
+		m := &album{Title: tooLongTitle}
+		if err := testStore.SaveAlbum(m); err == nil {
+			t.Errorf("32文字制限であるはずのタイトルに33文字での登録が行われました")
+		}
+	})
 }
 
 func TestAlbumUpdateBySave(t *testing.T) {
-	defer truncateTables()
+	forEachStore(t, func(t *testing.T) {
+		defer truncateTables()
 
-	m := &album{Title: "test title"}
-	if err := m.Save(); err != nil {
-		t.Fatal(err)
-	}
-	res, err := FindAlbumById(m.Id)
-	if err != nil {
-		t.Errorf("Save関数で作成したアルバムが見つかりませんでした.")
-	}
+		m := &album{Title: "test title"}
+		if err := testStore.SaveAlbum(m); err != nil {
+			t.Fatal(err)
+		}
+		res, err := testStore.FindAlbumById(m.Id)
+		if err != nil {
+			t.Errorf("Save関数で作成したアルバムが見つかりませんでした.")
+		}
 
-	expect := "on update"
+		expect := "on update"
 
-	res.Title = expect
-	if err := res.Save(); err != nil {
-		t.Fatal(err)
-	}
-	res, err = FindAlbumById(m.Id)
-	if err != nil {
-		t.Errorf("Save関数で作成したアルバムが見つかりませんでした.")
-	}
-	if res.Title != expect {
-		t.Errorf("Save関数でTitleがアップデートされていません.")
-	}
+		res.Title = expect
+		if err := testStore.SaveAlbum(res); err != nil {
+			t.Fatal(err)
+		}
+		res, err = testStore.FindAlbumById(m.Id)
+		if err != nil {
+			t.Errorf("Save関数で作成したアルバムが見つかりませんでした.")
+		}
+		if res.Title != expect {
+			t.Errorf("Save関数でTitleがアップデートされていません.")
+		}
+	})
 }
 
 func TestAlbumFind(t *testing.T) {
-	defer truncateTables()
+	forEachStore(t, func(t *testing.T) {
+		defer truncateTables()
 
-	m := &album{Title: "test title1"}
-	if err := m.Save(); err != nil {
-		t.Fatal(err)
-	}
+		m := &album{Title: "test title1"}
+		if err := testStore.SaveAlbum(m); err != nil {
+			t.Fatal(err)
+		}
 
-	m = &album{Title: "test title2"}
-	if err := m.Save(); err != nil {
-		t.Fatal(err)
-	}
+		m = &album{Title: "test title2"}
+		if err := testStore.SaveAlbum(m); err != nil {
+			t.Fatal(err)
+		}
 
-	// 無条件
-	res, err := FindAlbum("")
-	if err != nil {
-		t.Fatal("FindAlbumでエラーが発生しました.", err)
-	}
-	expect := 2
-	actual := len(res)
-	if expect != actual {
-		t.Errorf("FindAlbumで取得したデータ数が登録したデータ数と合いませんでした.Expect: %v, Actual: %v", expect, actual)
-	}
+		// 無条件
+		res, err := testStore.FindAlbum("", nil)
+		if err != nil {
+			t.Fatal("FindAlbumでエラーが発生しました.", err)
+		}
+		expect := 2
+		actual := len(res)
+		if expect != actual {
+			t.Errorf("FindAlbumで取得したデータ数が登録したデータ数と合いませんでした.Expect: %v, Actual: %v", expect, actual)
+		}
 
-	// 条件あり(1件絞り込み)
-	res, err = FindAlbum("1")
-	if err != nil {
-		t.Fatal("FindAlbumでエラーが発生しました.", err)
-	}
-	expect = 1
-	actual = len(res)
-	if expect != actual {
-		t.Errorf("FindAlbumで取得したデータ数が登録したデータ数と合いませんでした.Expect: %v, Actual: %v", expect, actual)
-	}
+		// 条件あり(1件絞り込み)
+		res, err = testStore.FindAlbum("1", nil)
+		if err != nil {
+			t.Fatal("FindAlbumでエラーが発生しました.", err)
+		}
+		expect = 1
+		actual = len(res)
+		if expect != actual {
+			t.Errorf("FindAlbumで取得したデータ数が登録したデータ数と合いませんでした.Expect: %v, Actual: %v", expect, actual)
+		}
 
-	// 条件あり(該当なし)
-	res, err = FindAlbum("18")
-	if err != nil {
-		t.Fatal("FindAlbumでエラーが発生しました.", err)
-	}
-	expect = 0
-	actual = len(res)
-	if expect != actual {
-		t.Errorf("FindAlbumで取得したデータ数が登録したデータ数と合いませんでした.Expect: %v, Actual: %v", expect, actual)
-	}
+		// 条件あり(該当なし)
+		res, err = testStore.FindAlbum("18", nil)
+		if err != nil {
+			t.Fatal("FindAlbumでエラーが発生しました.", err)
+		}
+		expect = 0
+		actual = len(res)
+		if expect != actual {
+			t.Errorf("FindAlbumで取得したデータ数が登録したデータ数と合いませんでした.Expect: %v, Actual: %v", expect, actual)
+		}
+	})
 }
 
 func TestRemoveAlbum(t *testing.T) {
-	defer truncateTables()
+	forEachStore(t, func(t *testing.T) {
+		defer truncateTables()
 
-	m := &album{Title: "test title1"}
-	if err := m.Save(); err != nil {
-		t.Fatal(err)
-	}
+		m := &album{Title: "test title1"}
+		if err := testStore.SaveAlbum(m); err != nil {
+			t.Fatal(err)
+		}
 
-	m = &album{Title: "test title2"}
-	if err := m.Save(); err != nil {
-		t.Fatal(err)
-	}
+		m = &album{Title: "test title2"}
+		if err := testStore.SaveAlbum(m); err != nil {
+			t.Fatal(err)
+		}
 
-	if err := m.Remove(); err != nil {
-		t.Fatal("Removeでアルバムの削除に失敗しました", err)
-	}
+		if err := testStore.RemoveAlbum(m); err != nil {
+			t.Fatal("Removeでアルバムの削除に失敗しました", err)
+		}
+
+		res, err := testStore.FindAlbum("", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expect := 1
+		actual := len(res)
+		if expect != actual {
+			t.Errorf("Removeで削除した後のFindAlbumで取得したデータ数が登録したデータ数と合いませんでした.Expect: %v, Actual: %v", expect, actual)
+		}
+	})
+}
 
-	res, err := FindAlbum("")
+// テスト中だけ動画の保存先を一時ディレクトリに差し替える
+func useTempStorage(t *testing.T) (storage, func()) {
+	dir, err := ioutil.TempDir("", "video_album_movies")
 	if err != nil {
 		t.Fatal(err)
 	}
-	expect := 1
-	actual := len(res)
-	if expect != actual {
-		t.Errorf("Removeで削除した後のFindAlbumで取得したデータ数が登録したデータ数と合いませんでした.Expect: %v, Actual: %v", expect, actual)
+	orig := movieStorage
+	movieStorage = &localStorage{root: dir}
+	return movieStorage, func() {
+		movieStorage = orig
+		os.RemoveAll(dir)
 	}
 }
 
+func TestRemoveAlbumWithPages(t *testing.T) {
+	forEachStore(t, func(t *testing.T) {
+		defer truncateTables()
+		s, cleanup := useTempStorage(t)
+		defer cleanup()
+
+		m := &album{Title: "test title1"}
+		if err := testStore.SaveAlbum(m); err != nil {
+			t.Fatal(err)
+		}
+		other := &album{Title: "test title2"}
+		if err := testStore.SaveAlbum(other); err != nil {
+			t.Fatal(err)
+		}
+		files := []string{"a.mp4", "b.mp4", "c.mp4"}
+		for i, albumId := range []int64{m.Id, m.Id, other.Id} {
+			if _, err := s.Put(files[i], strings.NewReader("movie")); err != nil {
+				t.Fatal(err)
+			}
+			p := &page{AlbumId: albumId, Title: "test page title", Description: "desc", MoviePath: files[i]}
+			if err := testStore.SavePage(p); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := testStore.RemoveAlbum(m); err != nil {
+			t.Fatal("Removeでアルバムの削除に失敗しました", err)
+		}
+
+		pages, err := testStore.FindPageByAlbumId(m.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pages) != 0 {
+			t.Errorf("削除したアルバムのページが残っています.Actual: %v", len(pages))
+		}
+		for _, file := range files[:2] {
+			if _, err := s.Stat(file); !os.IsNotExist(err) {
+				t.Errorf("削除したアルバムの動画ファイルが残っています.file: %v, err: %v", file, err)
+			}
+		}
+		if _, err := s.Stat(files[2]); err != nil {
+			t.Errorf("別のアルバムの動画ファイルが削除されました.err: %v", err)
+		}
+		if pages, _ := testStore.FindPageByAlbumId(other.Id); len(pages) != 1 {
+			t.Errorf("別のアルバムのページが削除されました.")
+		}
+	})
+}
+
+func TestPageReplaceMovie(t *testing.T) {
+	forEachStore(t, func(t *testing.T) {
+		defer truncateTables()
+		s, cleanup := useTempStorage(t)
+		defer cleanup()
+
+		m := &album{Title: "test title1"}
+		if err := testStore.SaveAlbum(m); err != nil {
+			t.Fatal(err)
+		}
+		for _, file := range []string{"old.mp4", "new.mp4"} {
+			if _, err := s.Put(file, strings.NewReader("movie")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		p := &page{AlbumId: m.Id, Title: "test page title", Description: "desc", MoviePath: "old.mp4"}
+		if err := testStore.SavePage(p); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := testStore.AddPageVideo(p, "new.mp4", 0, ""); err != nil {
+			t.Fatal(err)
+		}
+		found, err := testStore.FindPageById(p.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found.MoviePath != "new.mp4" {
+			t.Errorf("動画が差し替えられていません.Expect: new.mp4, Actual: %v", found.MoviePath)
+		}
+		videos, err := testStore.FindPageVideosByPageId(p.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(videos) != 2 || videos[1].MoviePath != "old.mp4" || videos[1].Current || videos[1].RetiredAt.IsZero() {
+			t.Errorf("差し替え前の動画が以前の版として残っていません.Actual: %v", videos)
+		}
+		if !videos[0].Current || !videos[0].RetiredAt.IsZero() {
+			t.Errorf("差し替えた動画が現在の版になっていません.Actual: %+v", videos[0])
+		}
+		if _, err := s.Stat("old.mp4"); err != nil {
+			t.Errorf("差し替え前の動画ファイルが削除されました.err: %v", err)
+		}
+
+		// 以前の版に戻すと, 戻す前の版が以前の版になる
+		if err := testStore.RevertPageVideo(p, videos[1].Id); err != nil {
+			t.Fatal(err)
+		}
+		videos, err = testStore.FindPageVideosByPageId(p.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if videos[0].Current || videos[0].RetiredAt.IsZero() || !videos[1].Current || !videos[1].RetiredAt.IsZero() {
+			t.Errorf("戻した版が現在の版になっていません.Actual: %+v, %+v", videos[0], videos[1])
+		}
+
+		// ページの削除で以前の版のファイルも消える
+		if err := testStore.RemovePage(p); err != nil {
+			t.Fatal(err)
+		}
+		for _, file := range []string{"old.mp4", "new.mp4"} {
+			if _, err := s.Stat(file); !os.IsNotExist(err) {
+				t.Errorf("削除したページの動画ファイルが残っています.file: %v, err: %v", file, err)
+			}
+		}
+		if videos, _ := testStore.FindPageVideosByPageId(p.Id); len(videos) != 0 {
+			t.Errorf("削除したページの以前の版が残っています.")
+		}
+	})
+}
+
+func TestPageCreateWithoutAlbum(t *testing.T) {
+	forEachStore(t, func(t *testing.T) {
+		defer truncateTables()
+
+		p := &page{AlbumId: 12345, Title: "test page title", Description: "desc"}
+		if err := testStore.SavePage(p); err == nil {
+			t.Errorf("存在しないアルバムにページを登録できました.")
+		}
+	})
+}
+
 func TestPageCreateBySave(t *testing.T) {
-	defer truncateTables()
+	forEachStore(t, func(t *testing.T) {
+		defer truncateTables()
 
-	m := &album{Title: "test title1"}
-	if err := m.Save(); err != nil {
-		t.Fatal(err)
-	}
+		m := &album{Title: "test title1"}
+		if err := testStore.SaveAlbum(m); err != nil {
+			t.Fatal(err)
+		}
 
-	p := &page{AlbumId: m.Id, Title: "test page title", Description: "desc"}
-	if err := p.Save(); err != nil {
-		t.Fatal(err)
-	}
-	findp, err := FindPageById(p.Id)
-	if err != nil {
-		t.Fatal(err)
-	}
+		p := &page{AlbumId: m.Id, Title: "test page title", Description: "desc"}
+		if err := testStore.SavePage(p); err != nil {
+			t.Fatal(err)
+		}
+		findp, err := testStore.FindPageById(p.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
 
-	if p.Id != findp.Id {
-		t.Errorf("Page.Saveで作成したページとFindPageByIdで取得したページのIDが一致しませんでした.Expect: %v, Actual: %v", p.Id, findp.Id)
-	}
-	if p.AlbumId != findp.AlbumId {
-		t.Errorf("Page.Saveで作成したページとFindPageByIdで取得したページのAlbumIDが一致しませんでした.Expect: %v, Actual: %v", p.AlbumId, findp.AlbumId)
-	}
-	if p.Title != findp.Title {
-		t.Errorf("Page.Saveで作成したページとFindPageByIdで取得したページのTitleが一致しませんでした.Expect: %v, Actual: %v", p.Title, findp.Title)
-	}
-	if p.Description != findp.Description {
-		t.Errorf("Page.Saveで作成したページとFindPageByIdで取得したページのDescriptionが一致しませんでした.Expect: %v, Actual: %v", p.Description, findp.Description)
-	}
+		if p.Id != findp.Id {
+			t.Errorf("Page.Saveで作成したページとFindPageByIdで取得したページのIDが一致しませんでした.Expect: %v, Actual: %v", p.Id, findp.Id)
+		}
+		if p.AlbumId != findp.AlbumId {
+			t.Errorf("Page.Saveで作成したページとFindPageByIdで取得したページのAlbumIDが一致しませんでした.Expect: %v, Actual: %v", p.AlbumId, findp.AlbumId)
+		}
+		if p.Title != findp.Title {
+			t.Errorf("Page.Saveで作成したページとFindPageByIdで取得したページのTitleが一致しませんでした.Expect: %v, Actual: %v", p.Title, findp.Title)
+		}
+		if p.Description != findp.Description {
+			t.Errorf("Page.Saveで作成したページとFindPageByIdで取得したページのDescriptionが一致しませんでした.Expect: %v, Actual: %v", p.Description, findp.Description)
+		}
+	})
 }
 
 func TestPageUpdateBySave(t *testing.T) {
-	defer truncateTables()
+	forEachStore(t, func(t *testing.T) {
+		defer truncateTables()
 
-	m := &album{Title: "test title1"}
-	if err := m.Save(); err != nil {
-		t.Fatal(err)
-	}
+		m := &album{Title: "test title1"}
+		if err := testStore.SaveAlbum(m); err != nil {
+			t.Fatal(err)
+		}
 
-	p := &page{AlbumId: m.Id, Title: "test page title", Description: "desc"}
-	if err := p.Save(); err != nil {
-		t.Fatal(err)
-	}
-	findp, err := FindPageById(p.Id)
-	if err != nil {
-		t.Fatal(err)
-	}
+		p := &page{AlbumId: m.Id, Title: "test page title", Description: "desc"}
+		if err := testStore.SavePage(p); err != nil {
+			t.Fatal(err)
+		}
+		findp, err := testStore.FindPageById(p.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
 
-	expect_title := "updated title"
-	expect_desc := "updated desc"
+		expect_title := "updated title"
+		expect_desc := "updated desc"
 
-	p.Title = expect_title
-	p.Description = expect_desc
-	if err := p.Save(); err != nil {
-		t.Fatal(err)
-	}
-	findp, err = FindPageById(p.Id)
-	if err != nil {
-		t.Fatal(err)
-	}
+		p.Title = expect_title
+		p.Description = expect_desc
+		if err := testStore.SavePage(p); err != nil {
+			t.Fatal(err)
+		}
+		findp, err = testStore.FindPageById(p.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
 
-	if findp.Title != expect_title {
-		t.Errorf("Page.Saveで更新したページとFindPageByIdで取得したページのTitleが一致しませんでした.Expect: %v, Actual: %v", p.Title, findp.Title)
-	}
-	if findp.Description != expect_desc {
-		t.Errorf("Page.Saveで更新したページとFindPageByIdで取得したページのDescriptionが一致しませんでした.Expect: %v, Actual: %v", p.Description, findp.Description)
-	}
+		if findp.Title != expect_title {
+			t.Errorf("Page.Saveで更新したページとFindPageByIdで取得したページのTitleが一致しませんでした.Expect: %v, Actual: %v", p.Title, findp.Title)
+		}
+		if findp.Description != expect_desc {
+			t.Errorf("Page.Saveで更新したページとFindPageByIdで取得したページのDescriptionが一致しませんでした.Expect: %v, Actual: %v", p.Description, findp.Description)
+		}
+	})
 }
 
 func TestPageCreateValidate(t *testing.T) {
-	defer truncateTables()
+	forEachStore(t, func(t *testing.T) {
+		defer truncateTables()
 
-	m := &album{Title: "test title1"}
-	if err := m.Save(); err != nil {
-		t.Fatal(err)
-	}
+		m := &album{Title: "test title1"}
+		if err := testStore.SaveAlbum(m); err != nil {
+			t.Fatal(err)
+		}
 
-	p := &page{Title: "123456789012345678901234567890123"}
-	if err := p.Save(); err == nil {
-		t.Errorf("page.Saveで32文字制限のはずのタイトルに33文字登録することができました")
-	}
-	p = &page{Title: ""}
-	if err := p.Save(); err == nil {
-		t.Errorf("page.Saveで必須入力のはずのタイトルに空文字での登録を行うことができました")
-	}
+		p := &page{Title: "123456789012345678901234567890123"}
+		if err := testStore.SavePage(p); err == nil {
+			t.Errorf("page.Saveで32文字制限のはずのタイトルに33文字登録することができました")
+		}
+		p = &page{Title: ""}
+		if err := testStore.SavePage(p); err == nil {
+			t.Errorf("page.Saveで必須入力のはずのタイトルに空文字での登録を行うことができました")
+		}
 
-	s := "0123456789"
-	overstr := "s"
-	for i := 0; i < 100; i++ {
-		overstr += s
-	}
-	p = &page{Title: "test", Description: overstr}
-	if err := p.Save(); err == nil {
-		t.Errorf("page.Saveで1000文字までの説明分に1001文字の登録を行うことができました")
-	}
+		s := "0123456789"
+		overstr := "s"
+		for i := 0; i < 100; i++ {
+			overstr += s
+		}
+		p = &page{Title: "test", Description: overstr}
+		if err := testStore.SavePage(p); err == nil {
+			t.Errorf("page.Saveで1000文字までの説明分に1001文字の登録を行うことができました")
+		}
+	})
 }
 
 func TestPageRemove(t *testing.T) {
-	defer truncateTables()
+	forEachStore(t, func(t *testing.T) {
+		defer truncateTables()
 
-	m := &album{Title: "test title1"}
-	if err := m.Save(); err != nil {
-		t.Fatal(err)
-	}
+		m := &album{Title: "test title1"}
+		if err := testStore.SaveAlbum(m); err != nil {
+			t.Fatal(err)
+		}
 
-	p := &page{AlbumId: m.Id, Title: "test page title", Description: "desc"}
-	if err := p.Save(); err != nil {
-		t.Fatal(err)
-	}
-	findp, err := FindPageById(p.Id)
-	if err != nil {
-		t.Fatal(err)
-	}
+		p := &page{AlbumId: m.Id, Title: "test page title", Description: "desc"}
+		if err := testStore.SavePage(p); err != nil {
+			t.Fatal(err)
+		}
+		findp, err := testStore.FindPageById(p.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
 
-	if err := findp.Remove(); err != nil {
-		t.Fatal("登録済みのpageの削除に失敗しました.", err)
-	}
+		if err := testStore.RemovePage(findp); err != nil {
+			t.Fatal("登録済みのpageの削除に失敗しました.", err)
+		}
 
-	if bad_find, err := FindPageById(p.Id); err == nil {
-		t.Errorf("削除したはずのpageデータが残っています.Expect: nil, Actual:%v", bad_find)
-	}
+		if bad_find, err := testStore.FindPageById(p.Id); err == nil {
+			t.Errorf("削除したはずのpageデータが残っています.Expect: nil, Actual:%v", bad_find)
+		}
+	})
+}
+
+func TestPageRemoveDeletesMovie(t *testing.T) {
+	forEachStore(t, func(t *testing.T) {
+		defer truncateTables()
+		s, cleanup := useTempStorage(t)
+		defer cleanup()
+
+		m := &album{Title: "test title1"}
+		if err := testStore.SaveAlbum(m); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Put("a.mp4", strings.NewReader("movie")); err != nil {
+			t.Fatal(err)
+		}
+		p := &page{AlbumId: m.Id, Title: "test page title", Description: "desc", MoviePath: "a.mp4"}
+		if err := testStore.SavePage(p); err != nil {
+			t.Fatal(err)
+		}
+
+		// 動画のパスを持たないページを渡してもDBに保存されているファイルを消す
+		if err := testStore.RemovePage(&page{Id: p.Id}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Stat("a.mp4"); !os.IsNotExist(err) {
+			t.Errorf("削除したページの動画ファイルが残っています.err: %v", err)
+		}
+	})
 }
 
 func TestFindPage(t *testing.T) {
-	defer truncateTables()
+	forEachStore(t, func(t *testing.T) {
+		defer truncateTables()
 
-	m := &album{Title: "test title1"}
-	if err := m.Save(); err != nil {
-		t.Fatal(err)
-	}
-	p1 := &page{AlbumId: m.Id, Title: "test page title1", Description: "desc1"}
-	if err := p1.Save(); err != nil {
-		t.Fatal(err)
-	}
-	p2 := &page{AlbumId: m.Id, Title: "test page title2", Description: "desc2"}
-	if err := p2.Save(); err != nil {
-		t.Fatal(err)
-	}
+		m := &album{Title: "test title1"}
+		if err := testStore.SaveAlbum(m); err != nil {
+			t.Fatal(err)
+		}
+		p1 := &page{AlbumId: m.Id, Title: "test page title1", Description: "desc1"}
+		if err := testStore.SavePage(p1); err != nil {
+			t.Fatal(err)
+		}
+		p2 := &page{AlbumId: m.Id, Title: "test page title2", Description: "desc2"}
+		if err := testStore.SavePage(p2); err != nil {
+			t.Fatal(err)
+		}
 
-	pages, err := FindPageByAlbumId(m.Id)
-	if err != nil {
-		t.Fatal("FindPageByAlbumIdでエラーが発生しました.", err)
-	}
+		pages, err := testStore.FindPageByAlbumId(m.Id)
+		if err != nil {
+			t.Fatal("FindPageByAlbumIdでエラーが発生しました.", err)
+		}
 
-	if len(pages) != 2 {
-		t.Errorf("FindPageByAlbumIdで検索されたデータ数が登録したデータ数と異なります.")
-	}
-	if pages[0].Title != p1.Title && pages[1].Title != p1.Title {
-		t.Errorf("FindPageByAlbumIdで検索されたTitleが登録したデータと異なります.")
-	}
-	if pages[0].Description != p1.Description && pages[1].Description != p1.Description {
-		t.Errorf("FindPageByAlbumIdで検索されたDescriptionが登録したデータと異なります.")
-	}
+		if len(pages) != 2 {
+			t.Errorf("FindPageByAlbumIdで検索されたデータ数が登録したデータ数と異なります.")
+		}
+		if pages[0].Title != p1.Title && pages[1].Title != p1.Title {
+			t.Errorf("FindPageByAlbumIdで検索されたTitleが登録したデータと異なります.")
+		}
+		if pages[0].Description != p1.Description && pages[1].Description != p1.Description {
+			t.Errorf("FindPageByAlbumIdで検索されたDescriptionが登録したデータと異なります.")
+		}
+	})
 }
 
 func TestFindPageListData(t *testing.T) {
-	defer truncateTables()
+	forEachStore(t, func(t *testing.T) {
+		defer truncateTables()
 
-	expect_title := "test title1"
-	m := &album{Title: expect_title}
-	if err := m.Save(); err != nil {
-		t.Fatal(err)
-	}
-	p1 := &page{AlbumId: m.Id, Title: "test page title1", Description: "desc1"}
-	if err := p1.Save(); err != nil {
-		t.Fatal(err)
-	}
-	p2 := &page{AlbumId: m.Id, Title: "test page title2", Description: "desc2"}
-	if err := p2.Save(); err != nil {
-		t.Fatal(err)
-	}
+		expect_title := "test title1"
+		m := &album{Title: expect_title}
+		if err := testStore.SaveAlbum(m); err != nil {
+			t.Fatal(err)
+		}
+		p1 := &page{AlbumId: m.Id, Title: "test page title1", Description: "desc1"}
+		if err := testStore.SavePage(p1); err != nil {
+			t.Fatal(err)
+		}
+		p2 := &page{AlbumId: m.Id, Title: "test page title2", Description: "desc2"}
+		if err := testStore.SavePage(p2); err != nil {
+			t.Fatal(err)
+		}
 
-	awp, err := FindPageListData(m.Id)
-	if err != nil {
-		t.Fatal("FindPageListDataでエラーが発生しました.", err)
-	}
+		awp, err := testStore.FindPageListData(m.Id, nil)
+		if err != nil {
+			t.Fatal("FindPageListDataでエラーが発生しました.", err)
+		}
 
-	if awp.Album.Title != expect_title {
-		t.Errorf("FindPageListDataで取得したアルバム名が登録したアルバム名と一致しませんでした.Expect:%v, Actual:%v", expect_title, awp.Album.Title)
-	}
+		if awp.Album.Title != expect_title {
+			t.Errorf("FindPageListDataで取得したアルバム名が登録したアルバム名と一致しませんでした.Expect:%v, Actual:%v", expect_title, awp.Album.Title)
+		}
 
-	if len(awp.Pages) != 2 {
-		t.Errorf("FindPageListDataで検索されたデータ数が登録したデータ数と異なります.")
-	}
+		if len(awp.Pages) != 2 {
+			t.Errorf("FindPageListDataで検索されたデータ数が登録したデータ数と異なります.")
+		}
 
-	if awp.Pages[0].Title != p1.Title && awp.Pages[1].Title != p1.Title {
-		t.Errorf("FindPageListDataで検索されたTitleが登録したデータと異なります.")
-	}
-	if awp.Pages[0].Description != p1.Description && awp.Pages[1].Description != p1.Description {
-		t.Errorf("FindPageListDataで検索されたDescriptionが登録したデータと異なります.")
-	}
+		if awp.Pages[0].Title != p1.Title && awp.Pages[1].Title != p1.Title {
+			t.Errorf("FindPageListDataで検索されたTitleが登録したデータと異なります.")
+		}
+		if awp.Pages[0].Description != p1.Description && awp.Pages[1].Description != p1.Description {
+			t.Errorf("FindPageListDataで検索されたDescriptionが登録したデータと異なります.")
+		}
+	})
 }
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type jsonObject map[string]interface{}
+
+// APIで扱うリソースのスキーマ
+var apiSchemas = jsonObject{
+	"Album": jsonObject{
+		"type":     "object",
+		"required": []string{"id", "title", "cover_page_id", "cover"},
+		"properties": jsonObject{
+			"id":            jsonObject{"type": "integer", "format": "int64"},
+			"title":         jsonObject{"type": "string", "maxLength": 32},
+			"cover_page_id": jsonObject{"type": "integer", "format": "int64", "description": "page chosen as the cover. 0 if not chosen."},
+			"cover": jsonObject{
+				"type":        "string",
+				"description": "file name of the cover image served under /movies/. empty if the album has no thumbnail.",
+			},
+		},
+	},
+	"AlbumList": jsonObject{
+		"type":  "array",
+		"items": schemaRef("Album"),
+	},
+	"AlbumRequest": jsonObject{
+		"type":     "object",
+		"required": []string{"title"},
+		"properties": jsonObject{
+			"title": jsonObject{"type": "string", "maxLength": 32},
+		},
+	},
+	"Page": jsonObject{
+		"type":     "object",
+		"required": []string{"id", "album_id", "title", "description", "movie_path", "mime_type", "thumbnail", "processing", "stream_path", "media"},
+		"properties": jsonObject{
+			"id":          jsonObject{"type": "integer", "format": "int64"},
+			"album_id":    jsonObject{"type": "integer", "format": "int64"},
+			"title":       jsonObject{"type": "string", "maxLength": 32},
+			"description": jsonObject{"type": "string", "maxLength": 1000},
+			"movie_path": jsonObject{
+				"type":        "string",
+				"description": "file name of the video served under /movies/. empty if the page has no video.",
+			},
+			"mime_type": jsonObject{
+				"type":        "string",
+				"description": "content type of the video detected on upload, e.g. video/mp4. empty if the page has no video.",
+			},
+			"thumbnail": jsonObject{
+				"type":        "string",
+				"description": "file name of the poster image served under /movies/. empty if not extracted.",
+			},
+			"processing": jsonObject{"type": "boolean", "description": "true while the current video is being transcoded for browsers."},
+			"stream_path": jsonObject{
+				"type":        "string",
+				"description": "HLS master playlist of the current video served under /streams/. empty until transcoded.",
+			},
+			"media": jsonObject{
+				"allOf":       []interface{}{schemaRef("Media")},
+				"nullable":    true,
+				"description": "metadata of the current video. null if the page has no video or it is not probed yet.",
+			},
+		},
+	},
+	"Media": jsonObject{
+		"type":     "object",
+		"required": []string{"duration_ms", "width", "height", "video_codec", "audio_codec", "bitrate", "container", "file_size"},
+		"properties": jsonObject{
+			"duration_ms": jsonObject{"type": "integer", "format": "int64"},
+			"width":       jsonObject{"type": "integer", "format": "int64"},
+			"height":      jsonObject{"type": "integer", "format": "int64"},
+			"video_codec": jsonObject{"type": "string"},
+			"audio_codec": jsonObject{"type": "string", "description": "empty if the video has no audio."},
+			"bitrate":     jsonObject{"type": "integer", "format": "int64", "description": "bits per second."},
+			"container":   jsonObject{"type": "string", "description": "format name reported by ffprobe, e.g. mov,mp4,m4a,3gp,3g2,mj2."},
+			"file_size":   jsonObject{"type": "integer", "format": "int64", "description": "bytes."},
+		},
+	},
+	"PageList": jsonObject{
+		"type":  "array",
+		"items": schemaRef("Page"),
+	},
+	"PageRequest": jsonObject{
+		"type":     "object",
+		"required": []string{"title"},
+		"properties": jsonObject{
+			"title":       jsonObject{"type": "string", "minLength": 1, "maxLength": 32},
+			"description": jsonObject{"type": "string", "maxLength": 1000},
+		},
+	},
+	"PageUpload": jsonObject{
+		"type":     "object",
+		"required": []string{"title"},
+		"properties": jsonObject{
+			"title":       jsonObject{"type": "string", "minLength": 1, "maxLength": 32},
+			"description": jsonObject{"type": "string", "maxLength": 1000},
+			"video":       jsonObject{"type": "string", "format": "binary", "description": "MP4, MOV, WebM, Matroska, Ogg or AVI. other files are rejected with 400."},
+			"note":        jsonObject{"type": "string", "maxLength": 256, "description": "note of the uploaded version"},
+		},
+	},
+	"Error": jsonObject{
+		"type":     "object",
+		"required": []string{"error"},
+		"properties": jsonObject{
+			"error": jsonObject{"type": "string"},
+		},
+	},
+}
+
+// apiRoute.Errorsに書くステータスコードの説明
+var apiErrorDescriptions = map[int]string{
+	http.StatusBadRequest:            "invalid request",
+	http.StatusNotFound:              "resource not found",
+	http.StatusConflict:              "Upload-Offset does not match the received bytes",
+	http.StatusPreconditionFailed:    "unsupported Tus-Resumable version",
+	http.StatusRequestEntityTooLarge: "video exceeds the maximum upload size",
+	http.StatusUnsupportedMediaType:  "Content-Type is not application/offset+octet-stream",
+	statusChecksumMismatch:           "checksum of the uploaded bytes does not match",
+	http.StatusInsufficientStorage:   "storage quota of the user or album exceeded, or not enough free disk space",
+}
+
+func schemaRef(name string) jsonObject {
+	return jsonObject{"$ref": "#/components/schemas/" + name}
+}
+
+func errorResponse(description string) jsonObject {
+	return jsonObject{
+		"description": description,
+		"content": jsonObject{
+			"application/json": jsonObject{"schema": schemaRef("Error")},
+		},
+	}
+}
+
+/*
+ * ルートのパス中の{name}をパスパラメータとして列挙し, クエリパラメータとヘッダーを続ける.
+ */
+func openAPIParameters(route apiRoute) []jsonObject {
+	params := make([]jsonObject, 0)
+	for _, seg := range strings.Split(route.Path, "/") {
+		if strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "}") {
+			params = append(params, jsonObject{
+				"name":     seg[1 : len(seg)-1],
+				"in":       "path",
+				"required": true,
+				"schema":   jsonObject{"type": "integer", "format": "int64"},
+			})
+		}
+	}
+	for _, q := range route.Query {
+		params = append(params, jsonObject{
+			"name":   q,
+			"in":     "query",
+			"schema": jsonObject{"type": "string"},
+		})
+	}
+	for _, h := range route.Headers {
+		params = append(params, jsonObject{
+			"name":   h,
+			"in":     "header",
+			"schema": jsonObject{"type": "string"},
+		})
+	}
+	return params
+}
+
+func openAPIOperation(route apiRoute) jsonObject {
+	success := jsonObject{"description": http.StatusText(route.Status)}
+	if route.Response != "" {
+		success["content"] = jsonObject{
+			"application/json": jsonObject{"schema": schemaRef(route.Response)},
+		}
+	}
+	responses := jsonObject{
+		strconv.Itoa(route.Status): success,
+		"401":                      errorResponse("not logged in or invalid token"),
+		"403":                      errorResponse("no permission"),
+		"500":                      errorResponse("internal error"),
+	}
+	if strings.Contains(route.Path, "{") {
+		responses["404"] = errorResponse("resource not found")
+	}
+	op := jsonObject{
+		"summary":    route.Summary,
+		"parameters": openAPIParameters(route),
+		"responses":  responses,
+	}
+	if route.Request != "" {
+		content := jsonObject{
+			"application/json": jsonObject{"schema": schemaRef(route.Request)},
+		}
+		if route.Upload != "" {
+			content["multipart/form-data"] = jsonObject{"schema": schemaRef(route.Upload)}
+		}
+		op["requestBody"] = jsonObject{"required": true, "content": content}
+		responses["400"] = errorResponse("invalid request")
+	}
+	if route.Body != "" {
+		op["requestBody"] = jsonObject{"required": true, "content": jsonObject{
+			route.Body: jsonObject{"schema": jsonObject{"type": "string", "format": "binary"}},
+		}}
+		responses["400"] = errorResponse("invalid request")
+	}
+	for _, status := range route.Errors {
+		responses[strconv.Itoa(status)] = errorResponse(apiErrorDescriptions[status])
+	}
+	return op
+}
+
+/*
+ * apiRoutesからOpenAPI 3のドキュメントを生成する.
+ */
+func buildOpenAPI() jsonObject {
+	paths := jsonObject{}
+	for _, route := range apiRoutes {
+		p := apiPrefix + route.Path
+		item, ok := paths[p].(jsonObject)
+		if !ok {
+			item = jsonObject{}
+			paths[p] = item
+		}
+		item[strings.ToLower(route.Method)] = openAPIOperation(route)
+	}
+	return jsonObject{
+		"openapi": "3.0.3",
+		"info": jsonObject{
+			"title":   "video album API",
+			"version": "1",
+		},
+		"paths": paths,
+		"components": jsonObject{
+			"schemas": apiSchemas,
+			"securitySchemes": jsonObject{
+				"sessionCookie": jsonObject{
+					"type": "apiKey",
+					"in":   "cookie",
+					"name": sessionCookieName,
+				},
+				"bearerToken": jsonObject{
+					"type":        "http",
+					"scheme":      "bearer",
+					"description": "personal API token issued from the settings page or the token command.",
+				},
+			},
+		},
+		"security": []jsonObject{
+			{"sessionCookie": []string{}},
+			{"bearerToken": []string{}},
+		},
+	}
+}
+
+func get_openapi(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, http.StatusOK, buildOpenAPI())
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// ドキュメント中の$refを全て集める
+func collectRefs(v interface{}, refs map[string]bool) {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, c := range t {
+			if k == "$ref" {
+				refs[c.(string)] = true
+			}
+			collectRefs(c, refs)
+		}
+	case []interface{}:
+		for _, c := range t {
+			collectRefs(c, refs)
+		}
+	}
+}
+
+func getOpenAPIDocument(t *testing.T) map[string]interface{} {
+	w := httptest.NewRecorder()
+	get_openapi(w, httptest.NewRequest("GET", "/api/openapi.json", nil))
+	if w.Code != 200 {
+		t.Fatalf("OpenAPIドキュメントの取得に失敗しました.Status: %v", w.Code)
+	}
+	doc := map[string]interface{}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+		t.Fatal("OpenAPIドキュメントがJSONとして不正です.", err)
+	}
+	return doc
+}
+
+func TestOpenAPIDocumentCoversRoutes(t *testing.T) {
+	doc := getOpenAPIDocument(t)
+	paths := doc["paths"].(map[string]interface{})
+
+	documented := 0
+	for _, item := range paths {
+		documented += len(item.(map[string]interface{}))
+	}
+	if documented != len(apiRoutes) {
+		t.Errorf("ドキュメントの操作数が登録されたルート数と一致しません.Expect: %v, Actual: %v", len(apiRoutes), documented)
+	}
+
+	for _, route := range apiRoutes {
+		name := route.Method + " " + apiPrefix + route.Path
+		item, ok := paths[apiPrefix+route.Path].(map[string]interface{})
+		if !ok {
+			t.Errorf("%vのパスがドキュメントにありません.", name)
+			continue
+		}
+		op, ok := item[strings.ToLower(route.Method)].(map[string]interface{})
+		if !ok {
+			t.Errorf("%vの操作がドキュメントにありません.", name)
+			continue
+		}
+		if op["summary"] == "" {
+			t.Errorf("%vのsummaryが空です.", name)
+		}
+		responses := op["responses"].(map[string]interface{})
+		if _, ok := responses[strconv.Itoa(route.Status)]; !ok || route.Status == 0 {
+			t.Errorf("%vの成功時レスポンスがドキュメントにありません.", name)
+		}
+		params := map[string]bool{}
+		for _, p := range op["parameters"].([]interface{}) {
+			params[p.(map[string]interface{})["name"].(string)] = true
+		}
+		for _, seg := range strings.Split(route.Path, "/") {
+			if strings.HasPrefix(seg, "{") && !params[strings.Trim(seg, "{}")] {
+				t.Errorf("%vのパスパラメータ%vがドキュメントにありません.", name, seg)
+			}
+		}
+	}
+
+	schemas := doc["components"].(map[string]interface{})["schemas"].(map[string]interface{})
+	refs := map[string]bool{}
+	collectRefs(doc, refs)
+	for ref := range refs {
+		if _, ok := schemas[strings.TrimPrefix(ref, "#/components/schemas/")]; !ok {
+			t.Errorf("参照先のスキーマが定義されていません.%v", ref)
+		}
+	}
+}
+
+func TestOpenAPIDocumentStatuses(t *testing.T) {
+	// ハンドラが実際に返すステータスコード. apiRoutesから作らずに手で書いておく
+	expects := map[string][]int{
+		"GET /albums":                   {200, 401, 403, 500},
+		"POST /albums":                  {201, 400, 401, 403, 500},
+		"GET /albums/{album_id}":        {200, 401, 403, 404, 500},
+		"PUT /albums/{album_id}":        {200, 400, 401, 403, 404, 500},
+		"DELETE /albums/{album_id}":     {204, 401, 403, 404, 500},
+		"GET /albums/{album_id}/pages":  {200, 400, 401, 403, 404, 500},
+		"POST /albums/{album_id}/pages": {201, 400, 401, 403, 404, 413, 500, 507},
+		"GET /pages/{page_id}":          {200, 401, 403, 404, 500},
+		"PUT /pages/{page_id}":          {200, 400, 401, 403, 404, 500},
+		"DELETE /pages/{page_id}":       {204, 401, 403, 404, 500},
+		"OPTIONS /uploads":              {204, 401, 403, 500},
+		"POST /uploads":                 {201, 400, 401, 403, 404, 412, 413, 500, 507},
+		"HEAD /uploads/{upload_id}":     {200, 401, 403, 404, 412, 500},
+		"PATCH /uploads/{upload_id}":    {204, 400, 401, 403, 404, 409, 412, 415, 460, 500, 507},
+		"DELETE /uploads/{upload_id}":   {204, 401, 403, 404, 412, 500},
+	}
+	doc := getOpenAPIDocument(t)
+	paths := doc["paths"].(map[string]interface{})
+	for name, statuses := range expects {
+		parts := strings.SplitN(name, " ", 2)
+		item, ok := paths[apiPrefix+parts[1]].(map[string]interface{})
+		if !ok {
+			t.Errorf("%vのパスがドキュメントにありません.", name)
+			continue
+		}
+		op, ok := item[strings.ToLower(parts[0])].(map[string]interface{})
+		if !ok {
+			t.Errorf("%vの操作がドキュメントにありません.", name)
+			continue
+		}
+		responses := op["responses"].(map[string]interface{})
+		actual := []int{}
+		for code, res := range responses {
+			status, _ := strconv.Atoi(code)
+			actual = append(actual, status)
+			if res.(map[string]interface{})["description"] == "" {
+				t.Errorf("%vの%vのdescriptionが空です.", name, code)
+			}
+		}
+		sort.Ints(actual)
+		if !reflect.DeepEqual(actual, statuses) {
+			t.Errorf("%vのレスポンスのステータスコードが正しくありません.Expect: %v, Actual: %v", name, statuses, actual)
+		}
+	}
+
+	// api_create_pageがmultipart/form-dataから読む項目
+	upload := doc["components"].(map[string]interface{})["schemas"].(map[string]interface{})["PageUpload"].(map[string]interface{})
+	properties := upload["properties"].(map[string]interface{})
+	for _, field := range []string{"title", "description", "video", "note"} {
+		if _, ok := properties[field]; !ok {
+			t.Errorf("PageUploadに%vがありません.", field)
+		}
+	}
+}
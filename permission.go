@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+)
+
+// ユーザーの権限区分
+const (
+	roleViewer = "viewer" // 閲覧のみ
+	roleEditor = "editor" // アルバム/ページの追加・編集・削除
+	roleAdmin  = "admin"  // editorの権限に加えてユーザー管理
+)
+
+var roles = []string{roleViewer, roleEditor, roleAdmin}
+
+type permission int
+
+const (
+	permView permission = iota
+	permEdit
+	permManageUsers
+)
+
+func validRole(role string) bool {
+	for _, r := range roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *user) Can(p permission) bool {
+	switch p {
+	case permView:
+		return validRole(m.Role)
+	case permEdit:
+		return m.Role == roleEditor || m.Role == roleAdmin
+	case permManageUsers:
+		return m.Role == roleAdmin
+	}
+	return false
+}
+
+// テンプレートから参照するためのヘルパ
+func (m *user) CanEdit() bool {
+	return m.Can(permEdit)
+}
+
+func (m *user) CanManageUsers() bool {
+	return m.Can(permManageUsers)
+}
+
+func checkPermission(p permission, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !currentUser(r).Can(p) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	}
+}
+
+/*
+ * ログインを要求した上で, 権限の無いリクエストをForbiddenにするミドルウェア.
+ */
+func requirePermission(p permission, h http.HandlerFunc) http.HandlerFunc {
+	return requireLogin(checkPermission(p, h))
+}
+
+/*
+ * requirePermissionと同様だが, APIトークンでの認証も受け付ける.
+ */
+func requireTokenPermission(p permission, h http.HandlerFunc) http.HandlerFunc {
+	return requireLoginOrToken(checkPermission(p, h))
+}
+
+/*
+ * ログインユーザーがアルバムを更新できるか確認する.
+ * 更新できない場合はForbiddenを返してfalseになる.
+ */
+func checkAlbumWritable(w http.ResponseWriter, r *http.Request, albumId int64) bool {
+	writable, err := storeOf(r).canWriteAlbum(albumId, currentUser(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	if !writable {
+		http.Error(w, errAlbumForbidden.Error(), http.StatusForbidden)
+		return false
+	}
+	return true
+}
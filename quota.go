@@ -0,0 +1,406 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	_ "github.com/mattn/go-sqlite3"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+/*
+ * バイト数を表すフラグの値. "500M"や"4G"のように1024倍の単位を付けられる.
+ */
+type byteSize int64
+
+func (s *byteSize) String() string {
+	return strconv.FormatInt(int64(*s), 10)
+}
+
+func (s *byteSize) Set(v string) error {
+	n, err := parseByteSize(v)
+	if err != nil {
+		return err
+	}
+	*s = byteSize(n)
+	return nil
+}
+
+func parseByteSize(v string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(v)), "B"))
+	unit := int64(1)
+	for i, suffix := range []string{"K", "M", "G", "T"} {
+		if strings.HasSuffix(s, suffix) {
+			unit = 1 << (10 * uint(i+1))
+			s = strings.TrimSuffix(s, suffix)
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, errors.New("invalid size: " + v)
+	}
+	return n * unit, nil
+}
+
+func formatByteSize(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1f GB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", n)
+}
+
+// アップロードの制限. 起動時に指定し, 0は無制限
+var (
+	// 動画1つの大きさ
+	maxUploadSize byteSize = 4 << 30
+	// ユーザー, アルバム毎に個別の指定が無い場合の容量
+	defaultUserQuota  byteSize
+	defaultAlbumQuota byteSize
+	// 空き容量がこれを下回るアップロードは断る
+	minFreeSpace byteSize = 1 << 30
+)
+
+var (
+	errUploadTooLarge     = errors.New("video exceeds the maximum upload size")
+	errUserQuotaExceeded  = errors.New("storage quota of the user exceeded")
+	errAlbumQuotaExceeded = errors.New("storage quota of the album exceeded")
+	errDiskFull           = errors.New("not enough free disk space")
+)
+
+/*
+ * アップロードのエラーに応じたステータスコード.
+ */
+func uploadErrorStatus(err error) int {
+	switch err {
+	case errNotVideo:
+		return http.StatusBadRequest
+	case errUploadTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case errUserQuotaExceeded, errAlbumQuotaExceeded, errDiskFull:
+		return http.StatusInsufficientStorage
+	}
+	return http.StatusInternalServerError
+}
+
+/*
+ * ユーザーやアルバムが使っている容量と上限.
+ */
+type storageQuota struct {
+	Used int64
+	// 0は無制限
+	Limit int64
+}
+
+func (m *storageQuota) Remaining() int64 {
+	if m.Limit == 0 {
+		return -1
+	}
+	if m.Used >= m.Limit {
+		return 0
+	}
+	return m.Limit - m.Used
+}
+
+func (m *storageQuota) UsedText() string {
+	return formatByteSize(m.Used)
+}
+
+func (m *storageQuota) LimitText() string {
+	if m.Limit == 0 {
+		return "無制限"
+	}
+	return formatByteSize(m.Limit)
+}
+
+/*
+ * ユーザーがアップロードした動画の容量と上限を返す.
+ * 以前の版と, アップロード途中の動画の予定の大きさも含める.
+ */
+func (s *Store) FindUserStorage(userId int64) (*storageQuota, error) {
+	query := `
+		SELECT
+			quota,
+			(SELECT COALESCE(SUM(file_size), 0) FROM page_videos WHERE user_id = u.id),
+			(SELECT COALESCE(SUM(length), 0) FROM uploads WHERE user_id = u.id AND completed_at IS NULL)
+		FROM
+			users u
+		WHERE
+			u.id = ?
+	`
+	return s.findStorageQuota(query, userId, defaultUserQuota)
+}
+
+/*
+ * アルバムの動画の容量と上限を返す.
+ * 以前の版と, アップロード途中の動画の予定の大きさも含める.
+ */
+func (s *Store) FindAlbumStorage(albumId int64) (*storageQuota, error) {
+	query := `
+		SELECT
+			quota,
+			(
+				SELECT
+					COALESCE(SUM(video.file_size), 0)
+				FROM
+					page_videos video
+					INNER JOIN pages page ON page.id = video.page_id
+				WHERE
+					page.album_id = album.id
+			),
+			(SELECT COALESCE(SUM(length), 0) FROM uploads WHERE album_id = album.id AND completed_at IS NULL)
+		FROM
+			albums album
+		WHERE
+			album.id = ?
+	`
+	return s.findStorageQuota(query, albumId, defaultAlbumQuota)
+}
+
+func (s *Store) findStorageQuota(query string, id int64, defaultQuota byteSize) (*storageQuota, error) {
+	db := s.db
+
+	var quota sql.NullInt64
+	var used, uploading int64
+	if err := db.QueryRow(query, id).Scan(&quota, &used, &uploading); err != nil {
+		return nil, err
+	}
+	m := &storageQuota{Used: used + uploading, Limit: int64(defaultQuota)}
+	if quota.Valid {
+		m.Limit = quota.Int64
+	}
+	return m, nil
+}
+
+/*
+ * ユーザーとアルバムの容量の上限を個別に指定する.
+ * quotaが無効な値の場合は起動時の指定に戻す.
+ */
+func (s *Store) SetUserQuota(userId int64, quota sql.NullInt64) error {
+	return s.setQuota("UPDATE users SET quota = ? WHERE id = ?", userId, quota)
+}
+
+func (s *Store) SetAlbumQuota(albumId int64, quota sql.NullInt64) error {
+	return s.setQuota("UPDATE albums SET quota = ? WHERE id = ?", albumId, quota)
+}
+
+func (s *Store) setQuota(query string, id int64, quota sql.NullInt64) error {
+	db := s.db
+
+	res, err := db.Exec(query, quota, id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+/*
+ * アップロードで書き込む場所の空き容量のうち, 最も少ないもの.
+ * SQLiteのDBと一時ファイルの置き場所, ローカルの保存先を確認する.
+ */
+func (s *Store) freeDiskSpace() (int64, error) {
+	dirs := []string{os.TempDir()}
+	if s.path != "" {
+		dirs = append(dirs, filepath.Dir(s.path))
+	}
+	if l, ok := movieStorage.(*localStorage); ok {
+		dirs = append(dirs, l.root)
+	}
+	ret := int64(-1)
+	for _, dir := range dirs {
+		free, err := diskFree(dir)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if ret < 0 || free < ret {
+			ret = free
+		}
+	}
+	return ret, nil
+}
+
+/*
+ * 空き容量のうち, minFreeSpaceを残してアップロードに使える大きさ. 分からない場合は-1.
+ */
+func (s *Store) uploadableDiskSpace() (int64, error) {
+	free, err := s.freeDiskSpace()
+	if err != nil || free < 0 {
+		return free, err
+	}
+	free -= int64(minFreeSpace)
+	if free < 0 {
+		free = 0
+	}
+	return free, nil
+}
+
+/*
+ * これからアップロードできる大きさ.
+ * 最大サイズ, ユーザーとアルバムの残り容量, 空き容量のうち最も小さいものになる.
+ */
+type uploadAllowance struct {
+	// -1は無制限
+	Limit int64
+	// Limitを超えた場合のエラー
+	Err error
+}
+
+/*
+ * userId, albumIdが0の場合はその容量を確認しない.
+ */
+func (s *Store) newUploadAllowance(userId int64, albumId int64) (*uploadAllowance, error) {
+	a := &uploadAllowance{Limit: -1}
+	if maxUploadSize > 0 {
+		a.restrict(int64(maxUploadSize), errUploadTooLarge)
+	}
+	if userId != 0 {
+		q, err := s.FindUserStorage(userId)
+		if err != nil {
+			return nil, err
+		}
+		a.restrict(q.Remaining(), errUserQuotaExceeded)
+	}
+	if albumId != 0 {
+		q, err := s.FindAlbumStorage(albumId)
+		if err != nil {
+			return nil, err
+		}
+		a.restrict(q.Remaining(), errAlbumQuotaExceeded)
+	}
+	free, err := s.uploadableDiskSpace()
+	if err != nil {
+		return nil, err
+	}
+	a.restrict(free, errDiskFull)
+	return a, nil
+}
+
+func (a *uploadAllowance) restrict(n int64, err error) {
+	if n < 0 {
+		return
+	}
+	if a.Limit < 0 || n < a.Limit {
+		a.Limit = n
+		a.Err = err
+	}
+}
+
+/*
+ * sizeバイトをアップロードできるか.
+ */
+func (a *uploadAllowance) Check(size int64) error {
+	if a.Limit >= 0 && size > a.Limit {
+		return a.Err
+	}
+	return nil
+}
+
+/*
+ * 許容量を超えて読もうとするとエラーになるReaderを返す.
+ * 超えたかどうかは戻り値のErrで確認する.
+ */
+func (a *uploadAllowance) Reader(r io.Reader) *allowanceReader {
+	return &allowanceReader{r: r, a: a, remaining: a.Limit}
+}
+
+type allowanceReader struct {
+	r         io.Reader
+	a         *uploadAllowance
+	remaining int64
+	Err       error
+}
+
+func (r *allowanceReader) Read(p []byte) (int, error) {
+	if r.Err != nil {
+		return 0, r.Err
+	}
+	if r.remaining < 0 {
+		return r.r.Read(p)
+	}
+	// 許容量ちょうどで終わるファイルを受け付けるため, 1バイト多く読んで確かめる
+	if int64(len(p)) > r.remaining+1 {
+		p = p[:r.remaining+1]
+	}
+	n, err := r.r.Read(p)
+	if int64(n) > r.remaining {
+		r.Err = r.a.Err
+		return int(r.remaining), r.Err
+	}
+	r.remaining -= int64(n)
+	return n, err
+}
+
+// multipart/form-dataのうち動画以外の項目に許す大きさ
+const uploadFormOverhead = 1 << 20
+
+// multipart/form-dataの解析時にメモリに置く大きさ. 超えた分は一時ファイルに書かれる
+const uploadFormMemory = 32 << 20
+
+/*
+ * 動画を含むフォームを解析する.
+ * 解析の時点で一時ファイルに書かれるため, アルバムが分かる前にユーザーの許容量で制限する.
+ */
+func parseUploadForm(w http.ResponseWriter, r *http.Request) error {
+	if u := currentUser(r); u != nil {
+		a, err := storeOf(r).newUploadAllowance(u.Id, 0)
+		if err != nil {
+			return err
+		}
+		if a.Limit >= 0 {
+			r.Body = http.MaxBytesReader(w, r.Body, a.Limit+uploadFormOverhead)
+		}
+		err = r.ParseMultipartForm(uploadFormMemory)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return a.Err
+		}
+		if err != nil && err != http.ErrNotMultipart {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+ * フォームのvideoを保存先に置く. 動画が無ければ空文字を返す.
+ * アルバムの容量も含めた許容量を超える場合は保存しない.
+ */
+func saveFormVideo(r *http.Request, albumId int64) (string, error) {
+	file, header, err := r.FormFile("video")
+	if err != nil {
+		return "", nil
+	}
+	defer file.Close()
+	s := storeOf(r)
+	a, err := s.newUploadAllowance(currentUser(r).Id, albumId)
+	if err != nil {
+		return "", err
+	}
+	if err := a.Check(header.Size); err != nil {
+		return "", err
+	}
+	lr := a.Reader(file)
+	moviePath, err := s.filesave(lr)
+	if lr.Err != nil {
+		return "", lr.Err
+	}
+	return moviePath, err
+}
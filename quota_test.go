@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// ログイン済みのCookieを付けて動画をmultipart/form-dataで送る
+func callAPIMultipart(t *testing.T, u *user, path string, fields map[string]string, video string) *httptest.ResponseRecorder {
+	sessionKey = []byte("0123456789abcdef0123456789abcdef")
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	for k, v := range fields {
+		mw.WriteField(k, v)
+	}
+	fw, err := mw.CreateFormFile("video", "video.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write([]byte(video))
+	mw.Close()
+
+	r := httptest.NewRequest("POST", path, body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	s, err := testStore.CreateSession(u.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.AddCookie(&http.Cookie{Name: sessionCookieName, Value: signSessionId(s.Id)})
+	w := httptest.NewRecorder()
+	serveTest(api_dispatch, w, r)
+	return w
+}
+
+// テスト中だけアップロードの制限を変える
+func useUploadLimits(maxSize byteSize, userQuota byteSize, albumQuota byteSize, minFree byteSize) func() {
+	saved := []byteSize{maxUploadSize, defaultUserQuota, defaultAlbumQuota, minFreeSpace}
+	maxUploadSize, defaultUserQuota, defaultAlbumQuota, minFreeSpace = maxSize, userQuota, albumQuota, minFree
+	return func() {
+		maxUploadSize, defaultUserQuota, defaultAlbumQuota, minFreeSpace = saved[0], saved[1], saved[2], saved[3]
+	}
+}
+
+func TestParseByteSize(t *testing.T) {
+	cases := map[string]int64{
+		"0":    0,
+		"1024": 1024,
+		"500K": 500 << 10,
+		"500m": 500 << 20,
+		"4G":   4 << 30,
+		"4GB":  4 << 30,
+		"1T":   1 << 40,
+		" 2M ": 2 << 20,
+	}
+	for v, expect := range cases {
+		if n, err := parseByteSize(v); err != nil || n != expect {
+			t.Errorf("%qの解釈が誤っています.Expect: %v, Actual: %v, %v", v, expect, n, err)
+		}
+	}
+	for _, v := range []string{"", "G", "-1", "1.5G", "10X"} {
+		if _, err := parseByteSize(v); err == nil {
+			t.Errorf("不正な大きさ%qがエラーになりませんでした", v)
+		}
+	}
+}
+
+func TestUploadSizeLimit(t *testing.T) {
+	defer truncateTables()
+	_, cleanup := useTempStorage(t)
+	defer cleanup()
+	defer useUploadLimits(1000, 0, 0, 0)()
+
+	editor := createTestUser(t, "alice", roleEditor)
+	m := &album{Title: "album"}
+	if err := testStore.SaveAlbum(m); err != nil {
+		t.Fatal(err)
+	}
+	pagesPath := "/api/v1/albums/" + strconv.FormatInt(m.Id, 10) + "/pages"
+	fields := map[string]string{"title": "page", "description": "desc"}
+
+	w := callAPIMultipart(t, editor, pagesPath, fields, testUploadVideo())
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("最大サイズを超える動画が413になりませんでした.Actual: %v, Body: %v", w.Code, w.Body.String())
+	}
+	if pages, _ := testStore.FindPageListData(m.Id, editor); len(pages.Pages) != 0 {
+		t.Errorf("最大サイズを超えた動画のページが作られています.Actual: %v", len(pages.Pages))
+	}
+
+	maxUploadSize = 1 << 20
+	video := testUploadVideo()
+	w = callAPIMultipart(t, editor, pagesPath, fields, video)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("最大サイズ以下の動画を登録できません.Status: %v, Body: %v", w.Code, w.Body.String())
+	}
+	q, err := testStore.FindUserStorage(editor.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Used != int64(len(video)) {
+		t.Errorf("ユーザーの使用量が動画の大きさと一致しません.Expect: %v, Actual: %v", len(video), q.Used)
+	}
+	q, err = testStore.FindAlbumStorage(m.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Used != int64(len(video)) {
+		t.Errorf("アルバムの使用量が動画の大きさと一致しません.Expect: %v, Actual: %v", len(video), q.Used)
+	}
+
+	// 許容量ちょうどの動画は受け付ける
+	a := &uploadAllowance{Limit: int64(len(video)), Err: errUploadTooLarge}
+	lr := a.Reader(strings.NewReader(video))
+	buf := &bytes.Buffer{}
+	if _, err := buf.ReadFrom(lr); err != nil || lr.Err != nil || buf.Len() != len(video) {
+		t.Errorf("許容量ちょうどの動画を読めません.Actual: %v, %v", buf.Len(), lr.Err)
+	}
+	a.Limit--
+	lr = a.Reader(strings.NewReader(video))
+	if _, err := buf.ReadFrom(lr); err != errUploadTooLarge || lr.Err != errUploadTooLarge {
+		t.Errorf("許容量を超えた読み込みがエラーになりませんでした.Actual: %v", err)
+	}
+}
+
+func TestStorageQuota(t *testing.T) {
+	defer truncateTables()
+	_, cleanup := useTempStorage(t)
+	defer cleanup()
+	video := testUploadVideo()
+	defer useUploadLimits(0, byteSize(len(video)*2), 0, 0)()
+
+	editor := createTestUser(t, "alice", roleEditor)
+	other := createTestUser(t, "bob", roleEditor)
+	m := &album{Title: "album"}
+	if err := testStore.SaveAlbum(m); err != nil {
+		t.Fatal(err)
+	}
+	pagesPath := "/api/v1/albums/" + strconv.FormatInt(m.Id, 10) + "/pages"
+	fields := map[string]string{"title": "page", "description": "desc"}
+
+	for i := 0; i < 2; i++ {
+		if w := callAPIMultipart(t, editor, pagesPath, fields, video); w.Code != http.StatusCreated {
+			t.Fatalf("容量内の動画を登録できません.Status: %v, Body: %v", w.Code, w.Body.String())
+		}
+	}
+	w := callAPIMultipart(t, editor, pagesPath, fields, video)
+	if w.Code != http.StatusInsufficientStorage || !strings.Contains(w.Body.String(), errUserQuotaExceeded.Error()) {
+		t.Errorf("ユーザーの容量を超えるアップロードが507になりませんでした.Actual: %v, Body: %v", w.Code, w.Body.String())
+	}
+	// 動画の無いページは容量に関係なく作れる
+	if w := callAPI(t, editor, "POST", pagesPath, `{"title":"page","description":"desc"}`); w.Code != http.StatusCreated {
+		t.Errorf("容量を使い切ったユーザーが動画の無いページを作れません.Actual: %v", w.Code)
+	}
+
+	// 個別の指定は起動時の指定より優先する
+	if err := testStore.SetUserQuota(editor.Id, sql.NullInt64{Int64: 0, Valid: true}); err != nil {
+		t.Fatal(err)
+	}
+	if w := callAPIMultipart(t, editor, pagesPath, fields, video); w.Code != http.StatusCreated {
+		t.Errorf("無制限にしたユーザーが動画を登録できません.Actual: %v, Body: %v", w.Code, w.Body.String())
+	}
+	if err := testStore.SetUserQuota(editor.Id, sql.NullInt64{}); err != nil {
+		t.Fatal(err)
+	}
+	q, err := testStore.FindUserStorage(editor.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Limit != int64(defaultUserQuota) || q.Used != int64(len(video)*3) {
+		t.Errorf("ユーザーの容量が誤っています.Actual: %+v", q)
+	}
+
+	if err := testStore.SetAlbumQuota(m.Id, sql.NullInt64{Int64: int64(len(video) * 3), Valid: true}); err != nil {
+		t.Fatal(err)
+	}
+	w = callAPIMultipart(t, other, pagesPath, fields, video)
+	if w.Code != http.StatusInsufficientStorage || !strings.Contains(w.Body.String(), errAlbumQuotaExceeded.Error()) {
+		t.Errorf("アルバムの容量を超えるアップロードが507になりませんでした.Actual: %v, Body: %v", w.Code, w.Body.String())
+	}
+	if err := testStore.SetAlbumQuota(99999, sql.NullInt64{}); err != sql.ErrNoRows {
+		t.Errorf("存在しないアルバムの容量を指定できました.Actual: %v", err)
+	}
+}
+
+func TestUploadQuotaResumable(t *testing.T) {
+	defer truncateTables()
+	_, cleanup := useTempStorage(t)
+	defer cleanup()
+	video := testUploadVideo()
+	defer useUploadLimits(byteSize(len(video)), byteSize(len(video)*2), 0, 0)()
+
+	editor := createTestUser(t, "alice", roleEditor)
+	m := &album{Title: "album"}
+	if err := testStore.SaveAlbum(m); err != nil {
+		t.Fatal(err)
+	}
+	meta := uploadMetadata("album_id", strconv.FormatInt(m.Id, 10), "title", "page")
+
+	w := callTus(t, editor, "POST", "/api/v1/uploads", map[string]string{"Upload-Length": strconv.Itoa(len(video) + 1), "Upload-Metadata": meta}, nil)
+	if w.Code != http.StatusRequestEntityTooLarge || w.Header().Get("Tus-Max-Size") != strconv.Itoa(len(video)) {
+		t.Errorf("最大サイズを超えるアップロードが413になりませんでした.Actual: %v, %v", w.Code, w.Header())
+	}
+
+	// 開始したアップロードは宣言された長さを使用量に数える
+	createTestUpload(t, editor, len(video), meta)
+	location := createTestUpload(t, editor, len(video), meta)
+	w = callTus(t, editor, "POST", "/api/v1/uploads", map[string]string{"Upload-Length": strconv.Itoa(len(video)), "Upload-Metadata": meta}, nil)
+	if w.Code != http.StatusInsufficientStorage {
+		t.Errorf("容量を超えるアップロードの開始が507になりませんでした.Actual: %v, Body: %v", w.Code, w.Body.String())
+	}
+
+	// 空き容量が足りなければ続きを受け取らない
+	free, err := testStore.freeDiskSpace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	minFreeSpace = byteSize(free) + 1<<30
+	w = callTus(t, editor, "PATCH", location, map[string]string{"Upload-Offset": "0"}, strings.NewReader(video))
+	if w.Code != http.StatusInsufficientStorage {
+		t.Errorf("空き容量が足りないアップロードが507になりませんでした.Actual: %v, Body: %v", w.Code, w.Body.String())
+	}
+	minFreeSpace = 0
+	w = callTus(t, editor, "PATCH", location, map[string]string{"Upload-Offset": "0"}, strings.NewReader(video))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("アップロードを完了できません.Status: %v, Body: %v", w.Code, w.Body.String())
+	}
+	q, err := testStore.FindUserStorage(editor.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Used != int64(len(video)*2) {
+		t.Errorf("完了したアップロードの使用量が誤っています.Expect: %v, Actual: %v", len(video)*2, q.Used)
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"database/sql"
+	_ "github.com/mattn/go-sqlite3"
+	"strings"
+	"time"
+)
+
+/*
+ * ページのタイトルと説明の変更履歴.
+ * ページを保存する度に保存後の内容を1件記録する.
+ */
+type pageRevision struct {
+	Id          int64
+	PageId      int64
+	UserId      int64 // 編集者が不明な場合は0
+	EditorName  string
+	Title       string
+	Description string
+	CreatedAt   time.Time
+}
+
+func insertPageRevision(tx *storeTx, m *page) error {
+	query := `
+		INSERT INTO page_revisions (page_id, user_id, title, description, created_at) values(?, ?, ?, ?, ?)
+	`
+	editor := sql.NullInt64{Int64: m.UpdatedBy, Valid: m.UpdatedBy != 0}
+	_, err := tx.Exec(query, m.Id, editor, m.Title, m.Description, time.Now().Unix())
+	return err
+}
+
+/*
+ * 履歴が1件も無いページの現在の内容を, 編集者不明の版として記録する.
+ */
+func insertInitialPageRevision(tx *storeTx, pageId int64) error {
+	query := `
+		INSERT INTO page_revisions (page_id, user_id, title, description, created_at)
+		SELECT
+			page.id,
+			CAST(NULL AS BIGINT),
+			page.title,
+			page.description,
+			CAST(? AS BIGINT)
+		FROM
+			pages page
+		WHERE
+			page.id = ?
+			AND NOT EXISTS (SELECT 1 FROM page_revisions rev WHERE rev.page_id = page.id)
+	`
+	_, err := tx.Exec(query, time.Now().Unix(), pageId)
+	return err
+}
+
+const pageRevisionColumns = `
+			rev.id AS id,
+			rev.page_id AS page_id,
+			rev.user_id AS user_id,
+			editor.name AS editor_name,
+			rev.title AS title,
+			rev.description AS description,
+			rev.created_at AS created_at
+		FROM
+			page_revisions rev
+			LEFT JOIN users editor ON editor.id = rev.user_id
+`
+
+func scanPageRevision(row interface {
+	Scan(dest ...interface{}) error
+}) (*pageRevision, error) {
+	m := &pageRevision{}
+	var userId sql.NullInt64
+	var editorName sql.NullString
+	var createdAt int64
+	if err := row.Scan(&m.Id, &m.PageId, &userId, &editorName, &m.Title, &m.Description, &createdAt); err != nil {
+		return nil, err
+	}
+	m.UserId = userId.Int64
+	m.EditorName = editorName.String
+	m.CreatedAt = time.Unix(createdAt, 0)
+	return m, nil
+}
+
+/*
+ * ページの変更履歴を新しい順に返す.
+ */
+func (s *Store) FindPageRevisionsByPageId(pageId int64) ([]*pageRevision, error) {
+	query := `
+		SELECT` + pageRevisionColumns + `
+		WHERE
+			rev.page_id = ?
+		ORDER BY
+			rev.id DESC
+	`
+	db := s.db
+
+	rows, err := db.Query(query, pageId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ret := make([]*pageRevision, 0)
+	for rows.Next() {
+		m, err := scanPageRevision(rows)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, m)
+	}
+	return ret, nil
+}
+
+/*
+ * ページを指定した版のタイトルと説明に戻す.
+ * 戻した内容も新しい版として記録する.
+ * 他のページの版を指定した場合はsql.ErrNoRowsを返す.
+ */
+func (s *Store) RestorePageRevision(m *page, revisionId int64, userId int64) error {
+	query := `
+		SELECT` + pageRevisionColumns + `
+		WHERE
+			rev.id = ?
+			AND rev.page_id = ?
+	`
+	db := s.db
+
+	rev, err := scanPageRevision(db.QueryRow(query, revisionId, m.Id))
+	if err != nil {
+		return err
+	}
+	m.Title = rev.Title
+	m.Description = rev.Description
+	m.UpdatedBy = userId
+	return s.SavePage(m)
+}
+
+/*
+ * 左右に並べて表示する差分の1行.
+ */
+const (
+	diffSame    = "same"
+	diffChanged = "changed"
+	diffAdded   = "added"
+	diffRemoved = "removed"
+)
+
+type diffRow struct {
+	Kind  string
+	Left  string
+	Right string
+}
+
+/*
+ * 2つの文字列を行単位で比較し, 左右に並べた差分を返す.
+ * 続けて削除と追加がある行は変更として1行にまとめる.
+ */
+func diffLines(left, right string) []*diffRow {
+	a := strings.Split(left, "\n")
+	b := strings.Split(right, "\n")
+
+	// lcs[i][j]はa[i:]とb[j:]の最長共通部分列の長さ
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	ret := make([]*diffRow, 0)
+	var removed, added []string
+	flush := func() {
+		for k := 0; k < len(removed) || k < len(added); k++ {
+			switch {
+			case k < len(removed) && k < len(added):
+				ret = append(ret, &diffRow{Kind: diffChanged, Left: removed[k], Right: added[k]})
+			case k < len(removed):
+				ret = append(ret, &diffRow{Kind: diffRemoved, Left: removed[k]})
+			default:
+				ret = append(ret, &diffRow{Kind: diffAdded, Right: added[k]})
+			}
+		}
+		removed, added = nil, nil
+	}
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			flush()
+			ret = append(ret, &diffRow{Kind: diffSame, Left: a[i], Right: b[j]})
+			i++
+			j++
+		case j >= len(b) || (i < len(a) && lcs[i+1][j] >= lcs[i][j+1]):
+			removed = append(removed, a[i])
+			i++
+		default:
+			added = append(added, b[j])
+			j++
+		}
+	}
+	flush()
+	return ret
+}
+
+type pageHistoryData struct {
+	Album      *album
+	SelectPage *page
+	LoginUser  *user
+	// LoginUserがこのページを元に戻せるか
+	Writable  bool
+	Revisions []*pageRevision
+	// 表示する版と, 比較対象のその1つ前の版(最初の版ではnil)
+	SelectRevision  *pageRevision
+	PrevRevision    *pageRevision
+	TitleDiff       []*diffRow
+	DescriptionDiff []*diffRow
+}
+
+/*
+ * ページの変更履歴と, 指定した版とその前の版との差分を取得する.
+ * revisionIdが0の場合は最新の版を表示する.
+ */
+func (s *Store) FindPageHistoryData(pageId int64, revisionId int64, viewer *user) (*pageHistoryData, error) {
+	p, err := s.FindPageById(pageId)
+	if err != nil {
+		return nil, err
+	}
+	readable, err := s.canReadAlbum(p.AlbumId, viewer)
+	if err != nil {
+		return nil, err
+	}
+	if !readable {
+		return nil, errAlbumForbidden
+	}
+	writable, err := s.canWriteAlbum(p.AlbumId, viewer)
+	if err != nil {
+		return nil, err
+	}
+	a, err := s.FindAlbumById(p.AlbumId)
+	if err != nil {
+		return nil, err
+	}
+	revisions, err := s.FindPageRevisionsByPageId(p.Id)
+	if err != nil {
+		return nil, err
+	}
+	phd := &pageHistoryData{Album: a, SelectPage: p, LoginUser: viewer, Writable: writable, Revisions: revisions}
+	for i, rev := range revisions {
+		if (revisionId == 0 && i == 0) || rev.Id == revisionId {
+			phd.SelectRevision = rev
+			if i+1 < len(revisions) {
+				phd.PrevRevision = revisions[i+1]
+			}
+			break
+		}
+	}
+	if phd.SelectRevision == nil {
+		if revisionId != 0 {
+			return nil, sql.ErrNoRows
+		}
+		return phd, nil
+	}
+	prevTitle, prevDescription := "", ""
+	if phd.PrevRevision != nil {
+		prevTitle, prevDescription = phd.PrevRevision.Title, phd.PrevRevision.Description
+	}
+	phd.TitleDiff = diffLines(prevTitle, phd.SelectRevision.Title)
+	phd.DescriptionDiff = diffLines(prevDescription, phd.SelectRevision.Description)
+	return phd, nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"database/sql"
+	_ "github.com/mattn/go-sqlite3"
+	"testing"
+)
+
+func TestDiffLines(t *testing.T) {
+	rows := diffLines("1行目\n2行目\n3行目\n4行目", "1行目\n2行目を修正\n3行目\n追加\n4行目")
+	expect := []string{diffSame, diffChanged, diffSame, diffAdded, diffSame}
+	if len(rows) != len(expect) {
+		t.Fatalf("差分の行数が異なります.Expect: %v, Actual: %v", len(expect), len(rows))
+	}
+	for i, row := range rows {
+		if row.Kind != expect[i] {
+			t.Errorf("%v行目の差分の種類が異なります.Expect: %v, Actual: %v", i+1, expect[i], row.Kind)
+		}
+	}
+	if rows[1].Left != "2行目" || rows[1].Right != "2行目を修正" {
+		t.Errorf("変更行の左右が異なります.Actual: %v", rows[1])
+	}
+
+	rows = diffLines("a\nb", "a")
+	if len(rows) != 2 || rows[1].Kind != diffRemoved || rows[1].Left != "b" {
+		t.Errorf("削除行が検出されません.Actual: %v", rows)
+	}
+}
+
+func TestPageRevisions(t *testing.T) {
+	defer truncateTables()
+
+	u := createTestUser(t, "alice", roleEditor)
+	m := &album{Title: "test title1"}
+	if err := testStore.SaveAlbum(m); err != nil {
+		t.Fatal(err)
+	}
+	p := &page{AlbumId: m.Id, Title: "title1", Description: "desc1", UpdatedBy: u.Id}
+	if err := testStore.SavePage(p); err != nil {
+		t.Fatal(err)
+	}
+	p.Title = "title2"
+	p.Description = "desc2"
+	if err := testStore.SavePage(p); err != nil {
+		t.Fatal(err)
+	}
+
+	revisions, err := testStore.FindPageRevisionsByPageId(p.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) != 2 {
+		t.Fatalf("保存毎に履歴が記録されていません.Expect: 2, Actual: %v", len(revisions))
+	}
+	if revisions[0].Title != "title2" || revisions[1].Title != "title1" {
+		t.Errorf("履歴が新しい順になっていません.Actual: %v, %v", revisions[0].Title, revisions[1].Title)
+	}
+	if revisions[1].EditorName != "alice" {
+		t.Errorf("履歴に編集者が記録されていません.Actual: %v", revisions[1].EditorName)
+	}
+
+	phd, err := testStore.FindPageHistoryData(p.Id, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if phd.SelectRevision.Id != revisions[0].Id || phd.PrevRevision.Id != revisions[1].Id {
+		t.Errorf("最新の版とその前の版が比較されていません.")
+	}
+	if len(phd.DescriptionDiff) != 1 || phd.DescriptionDiff[0].Kind != diffChanged {
+		t.Errorf("説明の差分が異なります.Actual: %v", phd.DescriptionDiff)
+	}
+
+	// 以前の版に戻すと, 戻した内容が新しい版として記録される
+	if err := testStore.RestorePageRevision(p, revisions[1].Id, u.Id); err != nil {
+		t.Fatal(err)
+	}
+	found, err := testStore.FindPageById(p.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.Title != "title1" || found.Description != "desc1" {
+		t.Errorf("以前の版に戻っていません.Actual: %v", found)
+	}
+	if revisions, _ := testStore.FindPageRevisionsByPageId(p.Id); len(revisions) != 3 {
+		t.Errorf("戻した内容が履歴に記録されていません.")
+	}
+}
+
+func TestPageRevisionOfLegacyPage(t *testing.T) {
+	defer truncateTables()
+
+	m := &album{Title: "test title1"}
+	if err := testStore.SaveAlbum(m); err != nil {
+		t.Fatal(err)
+	}
+	// 履歴の記録が始まる前に作られたページ
+	res, err := testStore.db.Exec(`INSERT INTO pages (album_id, title, description, filepath) values(?, 'old', 'old desc', '')`, m.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := res.LastInsertId()
+
+	p, err := testStore.FindPageById(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Title = "new"
+	if err := testStore.SavePage(p); err != nil {
+		t.Fatal(err)
+	}
+	revisions, err := testStore.FindPageRevisionsByPageId(p.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) != 2 || revisions[1].Title != "old" || revisions[1].UserId != 0 {
+		t.Errorf("更新前の内容が編集者不明の版として残っていません.Actual: %v", revisions)
+	}
+
+	other := &page{AlbumId: m.Id, Title: "other", Description: ""}
+	if err := testStore.SavePage(other); err != nil {
+		t.Fatal(err)
+	}
+	if err := testStore.RestorePageRevision(other, revisions[1].Id, 0); err != sql.ErrNoRows {
+		t.Errorf("他のページの版に戻すことができました.err: %v", err)
+	}
+}
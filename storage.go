@@ -0,0 +1,198 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+type storageInfo struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// http.ServeContentで配信できるようにSeekも必要
+type storageObject interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+/*
+ * 動画ファイルの保存先.
+ * nameは"/"区切りの相対パスで, 存在しない場合はos.ErrNotExistを返す.
+ */
+type storage interface {
+	Put(name string, r io.Reader) (int64, error)
+	Open(name string) (storageObject, error)
+	Stat(name string) (*storageInfo, error)
+	Delete(name string) error
+	List() ([]*storageInfo, error)
+}
+
+/*
+ * 再生時に保存先のURLへリダイレクトできる保存先.
+ * RedirectURLが空文字を返した場合はアプリ経由で配信する.
+ */
+type redirectingStorage interface {
+	RedirectURL(name string) (string, error)
+}
+
+// 起動時に-storageの指定で差し替える
+var movieStorage storage = &localStorage{root: moviesRoot}
+
+var errInvalidStorageName = errors.New("invalid storage name")
+
+type storageConfig struct {
+	Kind string // local または s3
+	Dir  string // localの保存先ディレクトリ
+	S3   s3Config
+}
+
+/*
+ * 起動時の指定から保存先を生成する.
+ */
+func newStorage(cfg storageConfig) (storage, error) {
+	switch cfg.Kind {
+	case "", "local":
+		return &localStorage{root: cfg.Dir}, nil
+	case "s3":
+		return newS3Storage(cfg.S3)
+	}
+	return nil, errors.New("unknown storage: " + cfg.Kind)
+}
+
+/*
+ * 保存先の名前を正規化する.
+ * ルートの外を指す名前はエラー.
+ */
+func cleanStorageName(name string) (string, error) {
+	clean := strings.TrimPrefix(path.Clean("/"+name), "/")
+	if clean == "" || clean != strings.TrimPrefix(name, "/") {
+		return "", errInvalidStorageName
+	}
+	return clean, nil
+}
+
+/*
+ * ローカルディレクトリへの保存.
+ */
+type localStorage struct {
+	root string
+}
+
+func (s *localStorage) path(name string) (string, error) {
+	clean, err := cleanStorageName(name)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(s.root, filepath.FromSlash(clean)), nil
+}
+
+/*
+ * 一時ファイルに書き込んでからリネームするため,
+ * 書き込み途中のファイルが配信されることは無い.
+ */
+func (s *localStorage) Put(name string, r io.Reader) (int64, error) {
+	p, err := s.path(name)
+	if err != nil {
+		return 0, err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0777); err != nil {
+		return 0, err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(p), ".upload-")
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return 0, err
+	}
+	if err := os.Chmod(f.Name(), 0666); err != nil {
+		os.Remove(f.Name())
+		return 0, err
+	}
+	if err := os.Rename(f.Name(), p); err != nil {
+		os.Remove(f.Name())
+		return 0, err
+	}
+	return n, nil
+}
+
+func (s *localStorage) Open(name string) (storageObject, error) {
+	p, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	if fi, err := f.Stat(); err != nil || fi.IsDir() {
+		f.Close()
+		return nil, os.ErrNotExist
+	}
+	return f, nil
+}
+
+func (s *localStorage) Stat(name string) (*storageInfo, error) {
+	p, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return nil, os.ErrNotExist
+	}
+	clean, _ := cleanStorageName(name)
+	return &storageInfo{Name: clean, Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
+
+func (s *localStorage) Delete(name string) error {
+	p, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(p)
+}
+
+/*
+ * 保存されている全ファイルを名前順に返す.
+ * 書き込み途中の一時ファイルは含めない.
+ */
+func (s *localStorage) List() ([]*storageInfo, error) {
+	ret := make([]*storageInfo, 0)
+	err := filepath.Walk(s.root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() || strings.HasPrefix(fi.Name(), ".upload-") {
+			return nil
+		}
+		rel, err := filepath.Rel(s.root, p)
+		if err != nil {
+			return err
+		}
+		ret = append(ret, &storageInfo{Name: filepath.ToSlash(rel), Size: fi.Size(), ModTime: fi.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	return ret, nil
+}
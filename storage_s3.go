@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// 大きなファイルはこのサイズ毎のマルチパートアップロードで送る
+const s3PartSize = 16 * 1024 * 1024
+
+type s3Config struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	Prefix    string
+	AccessKey string
+	SecretKey string
+	// trueならhttpで接続する. ローカルのMinIO向け
+	Insecure bool
+	// 0より大きければ再生時に署名付きURLへリダイレクトする. 0ならアプリ経由で配信する
+	Presign time.Duration
+}
+
+/*
+ * S3互換のオブジェクトストレージへの保存.
+ */
+type s3Storage struct {
+	client *minio.Client
+	bucket string
+	prefix string
+	// 0より大きければ再生時に署名付きURLへリダイレクトする
+	presign time.Duration
+}
+
+func newS3Storage(cfg s3Config) (*s3Storage, error) {
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		return nil, errors.New("s3 endpoint and bucket are nesecery.")
+	}
+	client, err := minio.New(cfg.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(cfg.AccessKey, cfg.SecretKey, ""),
+		Secure: !cfg.Insecure,
+		Region: cfg.Region,
+	})
+	if err != nil {
+		return nil, err
+	}
+	prefix := strings.Trim(cfg.Prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return &s3Storage{client: client, bucket: cfg.Bucket, prefix: prefix, presign: cfg.Presign}, nil
+}
+
+func (s *s3Storage) key(name string) (string, error) {
+	clean, err := cleanStorageName(name)
+	if err != nil {
+		return "", err
+	}
+	return s.prefix + clean, nil
+}
+
+/*
+ * S3のエラーのうち, オブジェクトが無いことを示すものをos.ErrNotExistに変換する.
+ */
+func s3Error(err error) error {
+	if err == nil {
+		return nil
+	}
+	switch minio.ToErrorResponse(err).Code {
+	case "NoSuchKey", "NotFound":
+		return os.ErrNotExist
+	}
+	return err
+}
+
+/*
+ * サイズ不明のまま送るため, minio-goがs3PartSize毎のマルチパートアップロードで
+ * ストリーミングしながら書き込む.
+ */
+func (s *s3Storage) Put(name string, r io.Reader) (int64, error) {
+	key, err := s.key(name)
+	if err != nil {
+		return 0, err
+	}
+	opts := minio.PutObjectOptions{
+		PartSize:    s3PartSize,
+		ContentType: contentTypeOf(name),
+	}
+	info, err := s.client.PutObject(context.Background(), s.bucket, key, r, -1, opts)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size, nil
+}
+
+func (s *s3Storage) Open(name string) (storageObject, error) {
+	key, err := s.key(name)
+	if err != nil {
+		return nil, err
+	}
+	obj, err := s.client.GetObject(context.Background(), s.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, s3Error(err)
+	}
+	// GetObjectは実際に読むまでエラーにならないため, ここで存在を確認しておく
+	if _, err := obj.Stat(); err != nil {
+		obj.Close()
+		return nil, s3Error(err)
+	}
+	return obj, nil
+}
+
+func (s *s3Storage) Stat(name string) (*storageInfo, error) {
+	key, err := s.key(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := s.client.StatObject(context.Background(), s.bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		return nil, s3Error(err)
+	}
+	return &storageInfo{Name: strings.TrimPrefix(info.Key, s.prefix), Size: info.Size, ModTime: info.LastModified}, nil
+}
+
+func (s *s3Storage) Delete(name string) error {
+	key, err := s.key(name)
+	if err != nil {
+		return err
+	}
+	return s3Error(s.client.RemoveObject(context.Background(), s.bucket, key, minio.RemoveObjectOptions{}))
+}
+
+func (s *s3Storage) List() ([]*storageInfo, error) {
+	ret := make([]*storageInfo, 0)
+	opts := minio.ListObjectsOptions{Prefix: s.prefix, Recursive: true}
+	for obj := range s.client.ListObjects(context.Background(), s.bucket, opts) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		ret = append(ret, &storageInfo{Name: strings.TrimPrefix(obj.Key, s.prefix), Size: obj.Size, ModTime: obj.LastModified})
+	}
+	return ret, nil
+}
+
+/*
+ * 再生用の署名付きURLを返す.
+ * 署名付きURLを使わない設定の場合は空文字を返し, アプリ経由で配信する.
+ */
+func (s *s3Storage) RedirectURL(name string) (string, error) {
+	if s.presign <= 0 {
+		return "", nil
+	}
+	key, err := s.key(name)
+	if err != nil {
+		return "", err
+	}
+	u, err := s.client.PresignedGetObject(context.Background(), s.bucket, key, s.presign, url.Values{})
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
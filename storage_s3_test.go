@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"github.com/minio/minio-go/v7"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+ * ローカルのMinIOに対して実行する. 例:
+ *
+ *   minio server /tmp/minio-data &
+ *   VIDEO_ALBUM_TEST_S3_ENDPOINT=localhost:9000 \
+ *   VIDEO_ALBUM_TEST_S3_ACCESS_KEY=minioadmin \
+ *   VIDEO_ALBUM_TEST_S3_SECRET_KEY=minioadmin go test -run S3
+ */
+func TestS3Storage(t *testing.T) {
+	endpoint := os.Getenv("VIDEO_ALBUM_TEST_S3_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("VIDEO_ALBUM_TEST_S3_ENDPOINT is not set")
+	}
+	bucket := os.Getenv("VIDEO_ALBUM_TEST_S3_BUCKET")
+	if bucket == "" {
+		bucket = "video-album-test"
+	}
+	s, err := newS3Storage(s3Config{
+		Endpoint:  endpoint,
+		Bucket:    bucket,
+		Prefix:    "test-" + strconv.FormatInt(time.Now().UnixNano(), 36),
+		AccessKey: os.Getenv("VIDEO_ALBUM_TEST_S3_ACCESS_KEY"),
+		SecretKey: os.Getenv("VIDEO_ALBUM_TEST_S3_SECRET_KEY"),
+		Insecure:  true,
+		Presign:   time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	exists, err := s.client.BucketExists(ctx, bucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists {
+		if err := s.client.MakeBucket(ctx, bucket, minio.MakeBucketOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testStorageBackend(t, s)
+
+	if _, err := s.Put("c.mp4", strings.NewReader("movie")); err != nil {
+		t.Fatal(err)
+	}
+	u, err := s.RedirectURL("c.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u == "" {
+		t.Errorf("署名付きURLが発行されませんでした.")
+	}
+	s.Delete("c.mp4")
+}
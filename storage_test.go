@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLocalStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "video_album_storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	testStorageBackend(t, &localStorage{root: dir})
+
+	s := &localStorage{root: dir}
+	s.Put("a/b.mp4", strings.NewReader("movie"))
+	if _, err := s.Open("a"); !os.IsNotExist(err) {
+		t.Errorf("ディレクトリをOpenできてしまいました.err: %v", err)
+	}
+}
+
+// 保存先の実装に共通の振る舞いを確認する
+func testStorageBackend(t *testing.T, s storage) {
+	n, err := s.Put("a/b.mp4", strings.NewReader("movie"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 5 {
+		t.Errorf("Putで書き込んだサイズが一致しません.Expect: 5, Actual: %v", n)
+	}
+	info, err := s.Stat("a/b.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != 5 || info.Name != "a/b.mp4" {
+		t.Errorf("Statの結果が正しくありません.Actual: %v", info)
+	}
+	obj, err := s.Open("a/b.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(obj)
+	obj.Close()
+	if string(b) != "movie" {
+		t.Errorf("Openで読み込んだ内容が一致しません.Actual: %v", string(b))
+	}
+
+	list, err := s.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Name != "a/b.mp4" {
+		t.Errorf("Listの結果が正しくありません.Actual: %v", list)
+	}
+
+	if _, err := s.Put("../escape.mp4", strings.NewReader("x")); err == nil {
+		t.Errorf("保存先の外へ書き込むことができました.")
+	}
+
+	if err := s.Delete("a/b.mp4"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Stat("a/b.mp4"); !os.IsNotExist(err) {
+		t.Errorf("削除したファイルのStatがos.ErrNotExistになりません.err: %v", err)
+	}
+	if _, err := s.Open("a/b.mp4"); !os.IsNotExist(err) {
+		t.Errorf("削除したファイルのOpenがos.ErrNotExistになりません.err: %v", err)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// DBの種類. database/sqlのドライバー名
+const (
+	dialectSQLite   = "sqlite3"
+	dialectPostgres = "postgres"
+)
+
+/*
+ * DBへの接続. プロセスで1つだけ開き, アルバムやページなどの読み書きはStoreのメソッドで行う.
+ * ハンドラーへはリクエストのコンテキストで, それ以外へは引数で渡す.
+ */
+type Store struct {
+	db *storeDB
+	// SQLiteのDBのファイル. 変更の適用や空き容量の確認に使う. PostgreSQLでは空
+	path string
+}
+
+/*
+ * dsnのDBを開く.
+ * postgres://で始まる場合はPostgreSQLに接続し, それ以外はSQLiteのファイルとして開く. 無ければ作成する.
+ */
+func OpenStore(dsn string) (*Store, error) {
+	if isPostgresDSN(dsn) {
+		db, err := openDB(dialectPostgres, dsn)
+		if err != nil {
+			return nil, err
+		}
+		return &Store{db: db}, nil
+	}
+	// 外部キー制約は接続毎に有効にする必要があるため接続文字列で指定する.
+	// WALにして読み込みと書き込みを並行させ, 書き込みが重なった場合は待つ.
+	// トランザクションは開始時に書き込みのロックを取り, 途中で待ちが発生しないようにする.
+	db, err := openDB(dialectSQLite, "file:"+dsn+"?_foreign_keys=1&_journal_mode=WAL&_busy_timeout=5000&_txlock=immediate")
+	if err != nil {
+		return nil, err
+	}
+	return &Store{db: db, path: dsn}, nil
+}
+
+func isPostgresDSN(dsn string) bool {
+	return strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://")
+}
+
+func openDB(dialect string, dsn string) (*storeDB, error) {
+	db, err := sql.Open(dialect, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &storeDB{DB: db, dialect: dialect}, nil
+}
+
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+/*
+ * ハンドラーからstoreOfでStoreを取り出せるようにするミドルウェア.
+ */
+func (s *Store) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), storeContextKey, s)))
+	})
+}
+
+/*
+ * Store.Handlerを通過したリクエストのStoreを返す.
+ */
+func storeOf(r *http.Request) *Store {
+	s, _ := r.Context().Value(storeContextKey).(*Store)
+	return s
+}
+
+/*
+ * クエリはSQLiteとPostgreSQLの両方で動くように書き, プレースホルダーには?を使う.
+ * storeDBとstoreTxはDBの種類に合わせてプレースホルダーを書き換えてから実行する.
+ */
+type storeDB struct {
+	*sql.DB
+	dialect string
+}
+
+func (db *storeDB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return db.DB.Exec(rebind(db.dialect, query), args...)
+}
+
+func (db *storeDB) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return db.DB.Query(rebind(db.dialect, query), args...)
+}
+
+func (db *storeDB) QueryRow(query string, args ...interface{}) *sql.Row {
+	return db.DB.QueryRow(rebind(db.dialect, query), args...)
+}
+
+func (db *storeDB) Begin() (*storeTx, error) {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &storeTx{Tx: tx, dialect: db.dialect}, nil
+}
+
+/*
+ * INSERTを実行し, 追加した行のidを返す.
+ */
+func (db *storeDB) Insert(query string, args ...interface{}) (int64, error) {
+	return insertId(db.dialect, db.Exec, db.QueryRow, query, args...)
+}
+
+type storeTx struct {
+	*sql.Tx
+	dialect string
+}
+
+func (tx *storeTx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return tx.Tx.Exec(rebind(tx.dialect, query), args...)
+}
+
+func (tx *storeTx) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return tx.Tx.Query(rebind(tx.dialect, query), args...)
+}
+
+func (tx *storeTx) QueryRow(query string, args ...interface{}) *sql.Row {
+	return tx.Tx.QueryRow(rebind(tx.dialect, query), args...)
+}
+
+func (tx *storeTx) Insert(query string, args ...interface{}) (int64, error) {
+	return insertId(tx.dialect, tx.Exec, tx.QueryRow, query, args...)
+}
+
+/*
+ * PostgreSQLのドライバーはLastInsertIdに対応していないため, RETURNINGでidを受け取る.
+ */
+func insertId(dialect string, exec func(string, ...interface{}) (sql.Result, error), queryRow func(string, ...interface{}) *sql.Row, query string, args ...interface{}) (int64, error) {
+	if dialect == dialectPostgres {
+		var id int64
+		err := queryRow(query+" RETURNING id", args...).Scan(&id)
+		return id, err
+	}
+	res, err := exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+/*
+ * PostgreSQLではプレースホルダーの?を$1, $2, ...に置き換える.
+ * 文字列リテラルの中の?は置き換えない.
+ */
+func rebind(dialect string, query string) string {
+	if dialect != dialectPostgres || !strings.Contains(query, "?") {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	quoted := false
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		if c == '\'' {
+			quoted = !quoted
+		} else if c == '?' && !quoted {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestStoreSettings(t *testing.T) {
+	var mode string
+	if err := testStore.db.QueryRow("PRAGMA journal_mode").Scan(&mode); err != nil {
+		t.Fatal(err)
+	}
+	if mode != "wal" {
+		t.Errorf("WALになっていません.Actual: %v", mode)
+	}
+	var fk int
+	if err := testStore.db.QueryRow("PRAGMA foreign_keys").Scan(&fk); err != nil {
+		t.Fatal(err)
+	}
+	if fk != 1 {
+		t.Errorf("外部キー制約が有効になっていません.Actual: %v", fk)
+	}
+}
+
+func TestStoreConcurrentWrites(t *testing.T) {
+	defer truncateTables()
+
+	// 書き込みが重なってもロック待ちで失敗しない
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- testStore.SaveAlbum(&album{Title: "album"})
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("同時に書き込めませんでした.err: %v", err)
+		}
+	}
+	albums, err := testStore.FindAlbum("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(albums) != 20 {
+		t.Errorf("アルバムの数が誤っています.Actual: %v", len(albums))
+	}
+}
+
+func TestStoreHandler(t *testing.T) {
+	var actual *Store
+	h := testStore.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		actual = storeOf(r)
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if actual != testStore {
+		t.Errorf("ハンドラーにStoreが渡されていません")
+	}
+}
+
+func TestRebind(t *testing.T) {
+	tests := []struct {
+		dialect string
+		query   string
+		expect  string
+	}{
+		{dialectSQLite, "SELECT * FROM pages WHERE id = ? AND album_id = ?", "SELECT * FROM pages WHERE id = ? AND album_id = ?"},
+		{dialectPostgres, "SELECT * FROM pages WHERE id = ? AND album_id = ?", "SELECT * FROM pages WHERE id = $1 AND album_id = $2"},
+		{dialectPostgres, "SELECT 1 WHERE title = '?' OR title = ?", "SELECT 1 WHERE title = '?' OR title = $1"},
+		{dialectPostgres, "SELECT 1 WHERE title = 'it''s?' AND id = ?", "SELECT 1 WHERE title = 'it''s?' AND id = $1"},
+		{dialectPostgres, "DELETE FROM blobs WHERE ref_count <= 0", "DELETE FROM blobs WHERE ref_count <= 0"},
+	}
+	for _, tt := range tests {
+		if actual := rebind(tt.dialect, tt.query); actual != tt.expect {
+			t.Errorf("プレースホルダーの置き換えが誤っています.dialect: %v, Expect: %v, Actual: %v", tt.dialect, tt.expect, actual)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	_ "github.com/mattn/go-sqlite3"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// 変換後の動画からHLSも作成するか. 起動時に-hlsで指定する
+var hlsEnabled = true
+
+// HLSのセグメント1つの長さ(秒)
+const hlsSegmentSeconds = 6
+
+const hlsMasterPlaylist = "master.m3u8"
+
+/*
+ * 変換後の動画をHLSのセグメントに分割する.
+ * dirにname.m3u8とname_000.tsのようなセグメントを書き出す.
+ * 変換済のH.264/AACのため再エンコードはしない.
+ */
+func (t *ffmpegTools) SegmentHLS(src string, dir string, name string) error {
+	_, err := runTool(t.FFmpeg, "-v", "error", "-y", "-i", src, "-c", "copy",
+		"-f", "hls", "-hls_time", fmt.Sprint(hlsSegmentSeconds), "-hls_playlist_type", "vod",
+		"-hls_segment_filename", filepath.Join(dir, name+"_%03d.ts"), filepath.Join(dir, name+".m3u8"))
+	return err
+}
+
+/*
+ * マスタープレイリストに並べる画質.
+ */
+type hlsVariant struct {
+	Name   string
+	Height int64
+	// ビット/秒
+	Bandwidth int64
+}
+
+/*
+ * 動画の版のHLSを置くディレクトリ. 末尾は"/"
+ */
+func streamDir(moviePath string) string {
+	return strings.TrimSuffix(moviePath, path.Ext(moviePath)) + "_hls/"
+}
+
+/*
+ * 画質の高い順に並べたマスタープレイリストを作る.
+ */
+func masterPlaylist(variants []*hlsVariant) string {
+	sorted := append([]*hlsVariant{}, variants...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Height > sorted[j].Height })
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n")
+	for _, v := range sorted {
+		fmt.Fprintf(&b, "#EXT-X-STREAM-INF:BANDWIDTH=%d\n%s.m3u8\n", v.Bandwidth, v.Name)
+	}
+	return b.String()
+}
+
+/*
+ * dirに書き出したHLSのファイルとマスタープレイリストを保存先に置き, 動画の版に登録する.
+ * 保存先に置いたファイルを返す.
+ */
+func (s *Store) saveStreams(v *pageVideo, dir string, variants []*hlsVariant) ([]string, error) {
+	saved := make([]string, 0)
+	if err := ioutil.WriteFile(filepath.Join(dir, hlsMasterPlaylist), []byte(masterPlaylist(variants)), 0666); err != nil {
+		return saved, err
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return saved, err
+	}
+	prefix := streamDir(v.MoviePath)
+	for _, e := range entries {
+		name := prefix + e.Name()
+		if err := putLocalFile(name, filepath.Join(dir, e.Name())); err != nil {
+			return saved, err
+		}
+		saved = append(saved, name)
+	}
+	return saved, s.setVideoStreams(v.Id, prefix+hlsMasterPlaylist, saved)
+}
+
+func putLocalFile(name string, localPath string) error {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = movieStorage.Put(name, f)
+	return err
+}
+
+/*
+ * 動画の版のHLSのファイルを記録する.
+ */
+func (s *Store) setVideoStreams(videoId int64, streamPath string, files []string) error {
+	insertQuery := `
+		INSERT INTO page_stream_files (video_id, filepath) values(?, ?)
+	`
+	updateQuery := `
+		UPDATE
+			page_videos
+		SET
+			stream_path = ?
+		WHERE
+			id = ?
+	`
+	db := s.db
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, file := range files {
+		if _, err := tx.Exec(insertQuery, videoId, file); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(updateQuery, streamPath, videoId); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+/*
+ * HLSのファイルとして配信してよいか.
+ */
+func isStreamFile(name string) bool {
+	_, ok := streamContentTypes[strings.ToLower(path.Ext(name))]
+	return ok
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMasterPlaylist(t *testing.T) {
+	actual := masterPlaylist([]*hlsVariant{
+		{Name: "360p", Height: 360, Bandwidth: 800000},
+		{Name: "720p", Height: 720, Bandwidth: 2500000},
+	})
+	expect := "#EXTM3U\n#EXT-X-VERSION:3\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=2500000\n720p.m3u8\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=800000\n360p.m3u8\n"
+	if actual != expect {
+		t.Errorf("マスタープレイリストが異なります.Expect: %q, Actual: %q", expect, actual)
+	}
+}
+
+func TestGetStream(t *testing.T) {
+	defer truncateTables()
+	s, cleanup := useTempStorage(t)
+	defer cleanup()
+	defer useFakeTranscoder(&fakeTranscoder{})()
+
+	m := &album{Title: "test title1"}
+	if err := testStore.SaveAlbum(m); err != nil {
+		t.Fatal(err)
+	}
+	p := &page{AlbumId: m.Id, Title: "test page title", Description: "desc"}
+	if err := testStore.SavePage(p); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Put("a.mp4", strings.NewReader("h264")); err != nil {
+		t.Fatal(err)
+	}
+	v, err := testStore.AddPageVideo(p, "a.mp4", 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testStore.SetPageMediaInfo(p, "a.mp4", &mediaInfo{Height: 360, Container: "mov,mp4,m4a,3gp,3g2,mj2"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := testStore.transcodeVideo(v.Id); err != nil {
+		t.Fatal(err)
+	}
+
+	sessionKey = []byte("0123456789abcdef0123456789abcdef")
+	u := createTestUser(t, "alice", roleAdmin)
+	session, err := testStore.CreateSession(u.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(path string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path, nil)
+		r.AddCookie(&http.Cookie{Name: sessionCookieName, Value: signSessionId(session.Id)})
+		w := httptest.NewRecorder()
+		serveTest(requirePermission(permView, get_stream), w, r)
+		return w
+	}
+
+	tests := []struct {
+		path        string
+		status      int
+		contentType string
+		cache       string
+	}{
+		{"/streams/a_hls/master.m3u8", http.StatusOK, "application/vnd.apple.mpegurl", "private, max-age=300"},
+		{"/streams/a_hls/360p.m3u8", http.StatusOK, "application/vnd.apple.mpegurl", "private, max-age=300"},
+		{"/streams/a_hls/360p_000.ts", http.StatusOK, "video/mp2t", "private, max-age=31536000, immutable"},
+		{"/streams/a.mp4", http.StatusNotFound, "", ""},
+		{"/streams/b_hls/master.m3u8", http.StatusNotFound, "", ""},
+	}
+	for _, test := range tests {
+		w := get(test.path)
+		if w.Code != test.status {
+			t.Errorf("ステータスが異なります.path: %v, Expect: %v, Actual: %v", test.path, test.status, w.Code)
+			continue
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+		if ct := w.Header().Get("Content-Type"); ct != test.contentType {
+			t.Errorf("Content-Typeが異なります.path: %v, Actual: %v", test.path, ct)
+		}
+		if cc := w.Header().Get("Cache-Control"); cc != test.cache {
+			t.Errorf("Cache-Controlが異なります.path: %v, Actual: %v", test.path, cc)
+		}
+	}
+	if body := get("/streams/a_hls/master.m3u8").Body.String(); !strings.Contains(body, "360p.m3u8") {
+		t.Errorf("マスタープレイリストの内容が異なります.Actual: %v", body)
+	}
+}
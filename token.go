@@ -0,0 +1,209 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	_ "github.com/mattn/go-sqlite3"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// APIトークンの接頭辞. ログ等に漏れた際に判別しやすくするため
+const apiTokenPrefix = "va_"
+
+/*
+ * スクリプトからのアクセス用の個人APIトークン.
+ * トークン自体は作成時に一度だけ返し, DBにはSHA-256のハッシュのみ保存する.
+ */
+type apiToken struct {
+	Id         int64
+	UserId     int64
+	Name       string
+	CreatedAt  time.Time
+	LastUsedAt time.Time // 未使用ならゼロ値
+	ExpiresAt  time.Time // 無期限ならゼロ値
+}
+
+func hashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func unixOrNull(t time.Time) sql.NullInt64 {
+	if t.IsZero() {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: t.Unix(), Valid: true}
+}
+
+func timeOrZero(n sql.NullInt64) time.Time {
+	if !n.Valid {
+		return time.Time{}
+	}
+	return time.Unix(n.Int64, 0)
+}
+
+func (m *apiToken) Expired() bool {
+	return !m.ExpiresAt.IsZero() && !time.Now().Before(m.ExpiresAt)
+}
+
+func (m *apiToken) Validate() error {
+	if utf8.RuneCountInString(m.Name) == 0 {
+		return errors.New("name is nesecery.")
+	}
+	if utf8.RuneCountInString(m.Name) > 32 {
+		return errors.New("name is too long")
+	}
+	return nil
+}
+
+/*
+ * トークンを発行して保存する.
+ * 戻り値の文字列がトークン本体で, 後から取得することはできない.
+ */
+func (s *Store) CreateAPIToken(m *apiToken) (string, error) {
+	if err := m.Validate(); err != nil {
+		return "", err
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := apiTokenPrefix + hex.EncodeToString(b)
+
+	query := `
+		INSERT INTO api_tokens (user_id, name, token_hash, created_at, expires_at) values(?, ?, ?, ?, ?)
+	`
+	db := s.db
+
+	m.CreatedAt = time.Unix(time.Now().Unix(), 0)
+	id, err := db.Insert(query, m.UserId, m.Name, hashAPIToken(token), m.CreatedAt.Unix(), unixOrNull(m.ExpiresAt))
+	if err != nil {
+		return "", err
+	}
+	m.Id = id
+	return token, nil
+}
+
+func (s *Store) FindAPITokensByUserId(userId int64) ([]*apiToken, error) {
+	query := `
+		SELECT
+			id AS id,
+			name AS name,
+			created_at AS created_at,
+			last_used_at AS last_used_at,
+			expires_at AS expires_at
+		FROM
+			api_tokens
+		WHERE
+			user_id = ?
+		ORDER BY
+			id
+	`
+	db := s.db
+
+	rows, err := db.Query(query, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ret := make([]*apiToken, 0)
+	for rows.Next() {
+		m := &apiToken{UserId: userId}
+		var createdAt int64
+		var lastUsedAt, expiresAt sql.NullInt64
+		if err := rows.Scan(&m.Id, &m.Name, &createdAt, &lastUsedAt, &expiresAt); err != nil {
+			return nil, err
+		}
+		m.CreatedAt = time.Unix(createdAt, 0)
+		m.LastUsedAt = timeOrZero(lastUsedAt)
+		m.ExpiresAt = timeOrZero(expiresAt)
+		ret = append(ret, m)
+	}
+	return ret, nil
+}
+
+func (s *Store) FindAPITokenById(id int64) (*apiToken, error) {
+	query := `
+		SELECT
+			user_id AS user_id,
+			name AS name,
+			created_at AS created_at,
+			last_used_at AS last_used_at,
+			expires_at AS expires_at
+		FROM
+			api_tokens
+		WHERE
+			id = ?
+	`
+	db := s.db
+
+	m := &apiToken{Id: id}
+	var createdAt int64
+	var lastUsedAt, expiresAt sql.NullInt64
+	if err := db.QueryRow(query, id).Scan(&m.UserId, &m.Name, &createdAt, &lastUsedAt, &expiresAt); err != nil {
+		return nil, err
+	}
+	m.CreatedAt = time.Unix(createdAt, 0)
+	m.LastUsedAt = timeOrZero(lastUsedAt)
+	m.ExpiresAt = timeOrZero(expiresAt)
+	return m, nil
+}
+
+/*
+ * トークンからユーザーを取得し, 最終使用日時を更新する.
+ * 存在しないか期限切れのトークンはsql.ErrNoRowsとして扱う.
+ */
+func (s *Store) FindUserByAPIToken(token string) (*user, error) {
+	if !strings.HasPrefix(token, apiTokenPrefix) {
+		return nil, sql.ErrNoRows
+	}
+	query := `
+		SELECT
+			id AS id,
+			user_id AS user_id
+		FROM
+			api_tokens
+		WHERE
+			token_hash = ?
+			AND (expires_at IS NULL OR expires_at > ?)
+	`
+	updateQuery := `
+		UPDATE
+			api_tokens
+		SET
+			last_used_at = ?
+		WHERE
+			id = ?
+	`
+	db := s.db
+
+	now := time.Now().Unix()
+	var id, userId int64
+	if err := db.QueryRow(query, hashAPIToken(token), now).Scan(&id, &userId); err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(updateQuery, now, id); err != nil {
+		return nil, err
+	}
+	return s.FindUserById(userId)
+}
+
+func (s *Store) RemoveAPIToken(m *apiToken) error {
+	query := `
+		DELETE
+		FROM
+			api_tokens
+		WHERE
+			id = ?
+	`
+	db := s.db
+
+	_, err := db.Exec(query, m.Id)
+	return err
+}
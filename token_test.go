@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAPIToken(t *testing.T) {
+	defer truncateTables()
+
+	u := createTestUser(t, "ci", roleEditor)
+	m := &apiToken{UserId: u.Id, Name: "ci upload"}
+	token, err := testStore.CreateAPIToken(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tokens, err := testStore.FindAPITokensByUserId(u.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 1 || !tokens[0].LastUsedAt.IsZero() {
+		t.Fatalf("発行したトークンが一覧に正しく表示されません.Actual: %v", tokens)
+	}
+
+	found, err := testStore.FindUserByAPIToken(token)
+	if err != nil {
+		t.Fatal("発行したトークンで認証できませんでした.", err)
+	}
+	if found.Id != u.Id {
+		t.Errorf("トークンのユーザーが一致しません.Expect: %v, Actual: %v", u.Id, found.Id)
+	}
+	tokens, _ = testStore.FindAPITokensByUserId(u.Id)
+	if tokens[0].LastUsedAt.IsZero() {
+		t.Errorf("トークンの最終使用日時が更新されていません.")
+	}
+
+	if _, err := testStore.FindUserByAPIToken(token + "x"); err == nil {
+		t.Errorf("不正なトークンで認証できてしまいました.")
+	}
+
+	if err := testStore.RemoveAPIToken(tokens[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testStore.FindUserByAPIToken(token); err == nil {
+		t.Errorf("失効したトークンで認証できてしまいました.")
+	}
+}
+
+func TestAPITokenExpiry(t *testing.T) {
+	defer truncateTables()
+
+	u := createTestUser(t, "ci", roleEditor)
+	m := &apiToken{UserId: u.Id, Name: "expired", ExpiresAt: time.Now().Add(-time.Minute)}
+	token, err := testStore.CreateAPIToken(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testStore.FindUserByAPIToken(token); err == nil {
+		t.Errorf("期限切れのトークンで認証できてしまいました.")
+	}
+}
+
+func TestAPITokenBearer(t *testing.T) {
+	defer truncateTables()
+
+	u := createTestUser(t, "ci", roleEditor)
+	token, err := testStore.CreateAPIToken(&apiToken{UserId: u.Id, Name: "ci"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("GET", "/api/v1/albums", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	serveTest(api_dispatch, w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("BearerトークンでのAPI呼び出しに失敗しました.Status: %v", w.Code)
+	}
+
+	r = httptest.NewRequest("POST", "/add_album", nil)
+	r.Header.Set("Authorization", "Bearer va_invalid")
+	w = httptest.NewRecorder()
+	serveTest(requireTokenPermission(permEdit, add_album), w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("不正なトークンが401になりませんでした.Status: %v", w.Code)
+	}
+}
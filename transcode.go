@@ -0,0 +1,366 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	_ "github.com/mattn/go-sqlite3"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * アップロードされた動画を, どのブラウザでも再生できる形式に変換する.
+ * 引数のパスはローカルのファイル.
+ */
+type transcoder interface {
+	// srcの動画を高さheightのH.264/AACのMP4に変換してdstに書き出す
+	Transcode(src string, dst string, height int64) error
+	// 変換後の動画srcをHLSのプレイリストdir/name.m3u8とセグメントに分割する
+	SegmentHLS(src string, dir string, name string) error
+}
+
+// 起動時に-ffmpegの指定で差し替える
+var videoTranscoder transcoder = &ffmpegTools{FFmpeg: "ffmpeg", FFprobe: "ffprobe"}
+
+// 作成する変換後の動画の高さ. 起動時に-renditionsで指定し, 空なら変換しない
+var renditionHeights = []int64{720, 360}
+
+// 動画の版の変換の状態
+const (
+	videoReady      = "ready"
+	videoProcessing = "processing"
+	videoFailed     = "failed"
+)
+
+/*
+ * -renditionsの値を解釈する. "720,360"のようにカンマ区切りで指定する.
+ */
+func parseRenditionHeights(s string) ([]int64, error) {
+	ret := make([]int64, 0)
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		h, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || h <= 0 || h%2 != 0 {
+			return nil, errors.New("invalid rendition height: " + v)
+		}
+		ret = append(ret, h)
+	}
+	return ret, nil
+}
+
+func (t *ffmpegTools) Transcode(src string, dst string, height int64) error {
+	_, err := runTool(t.FFmpeg, "-v", "error", "-y", "-i", src,
+		"-vf", "scale=-2:"+strconv.FormatInt(height, 10),
+		"-c:v", "libx264", "-preset", "veryfast", "-crf", "23", "-pix_fmt", "yuv420p",
+		"-c:a", "aac", "-b:a", "128k", "-movflags", "+faststart", "-f", "mp4", dst)
+	return err
+}
+
+/*
+ * 動画の版をブラウザ向けに変換したもの.
+ */
+type rendition struct {
+	Id        int64
+	VideoId   int64
+	Height    int64
+	MoviePath string
+}
+
+func (m *rendition) MimeType() string {
+	return formatMP4.MimeType
+}
+
+/*
+ * 動画の版の変換後の動画を高さの大きい順に返す.
+ */
+func (s *Store) FindRenditionsByVideoId(videoId int64) ([]*rendition, error) {
+	query := `
+		SELECT
+			rendition.id AS id,
+			rendition.height AS height,
+			rendition.filepath AS filepath
+		FROM
+			page_renditions rendition
+		WHERE
+			rendition.video_id = ?
+		ORDER BY
+			rendition.height DESC
+	`
+	db := s.db
+
+	rows, err := db.Query(query, videoId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ret := make([]*rendition, 0)
+	for rows.Next() {
+		m := &rendition{VideoId: videoId}
+		if err := rows.Scan(&m.Id, &m.Height, &m.MoviePath); err != nil {
+			return nil, err
+		}
+		ret = append(ret, m)
+	}
+	return ret, nil
+}
+
+func (s *Store) createRendition(m *rendition) error {
+	query := `
+		INSERT INTO page_renditions (video_id, height, filepath, created_at) values(?, ?, ?, ?)
+	`
+	db := s.db
+
+	id, err := db.Insert(query, m.VideoId, m.Height, m.MoviePath, time.Now().Unix())
+	m.Id = id
+	return err
+}
+
+func (s *Store) setVideoStatus(videoId int64, status string) error {
+	query := `
+		UPDATE
+			page_videos
+		SET
+			status = ?
+		WHERE
+			id = ?
+	`
+	db := s.db
+
+	_, err := db.Exec(query, status, videoId)
+	return err
+}
+
+/*
+ * 変換に失敗した版の変換後の動画とHLSの記録を削除する.
+ */
+func (s *Store) removeRenditions(videoId int64) error {
+	queries := []string{`
+		DELETE
+		FROM
+			page_renditions
+		WHERE
+			video_id = ?
+	`, `
+		DELETE
+		FROM
+			page_stream_files
+		WHERE
+			video_id = ?
+	`, `
+		UPDATE
+			page_videos
+		SET
+			stream_path = NULL
+		WHERE
+			id = ?
+	`}
+	db := s.db
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, query := range queries {
+		if _, err := tx.Exec(query, videoId); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+/*
+ * ページの現在の版のうち, 変換後の動画が無いものを返す.
+ */
+func (s *Store) FindCurrentVideoIdsWithoutRenditions() ([]int64, error) {
+	query := `
+		SELECT
+			video.id AS id
+		FROM
+			page_videos video
+			INNER JOIN pages page ON page.id = video.page_id AND page.filepath = video.filepath
+		WHERE
+			video.status <> ?
+			AND NOT EXISTS (SELECT 1 FROM page_renditions rendition WHERE rendition.video_id = video.id)
+		ORDER BY
+			video.id
+	`
+	db := s.db
+
+	rows, err := db.Query(query, videoProcessing)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ret := make([]int64, 0)
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ret = append(ret, id)
+	}
+	return ret, nil
+}
+
+/*
+ * 元の動画の高さから, 作成する変換後の動画の高さを決める.
+ * 拡大はせず, 元の動画が全ての高さより小さければ元の高さで1つ作る.
+ * 高さが分からなければrenditionHeightsを全て作る.
+ */
+func renditionTargets(srcHeight int64) []int64 {
+	ret := make([]int64, 0)
+	for _, h := range renditionHeights {
+		if srcHeight == 0 || h <= srcHeight {
+			ret = append(ret, h)
+		}
+	}
+	if len(ret) == 0 && len(renditionHeights) > 0 {
+		// H.264は奇数の高さを扱えない
+		ret = append(ret, srcHeight-srcHeight%2)
+	}
+	return ret
+}
+
+/*
+ * 変換後の動画のファイル名を決める.
+ */
+func renditionName(moviePath string, height int64) string {
+	return strings.TrimSuffix(moviePath, path.Ext(moviePath)) + "_" + strconv.FormatInt(height, 10) + "p" + formatMP4.Ext
+}
+
+/*
+ * 動画の版を変換し, 変換後の動画を保存先に置いて登録する.
+ * HLSを作成する場合は変換後の動画を分割したものも登録する.
+ * 元の動画は残す. 失敗した場合は作成途中の動画を削除して版を変換失敗とする.
+ */
+func (s *Store) transcodeVideo(videoId int64) error {
+	v, err := s.FindPageVideoById(videoId)
+	if err == sql.ErrNoRows {
+		// 変換を待つ間にページが削除された
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var srcHeight int64
+	if v.Media != nil {
+		srcHeight = v.Media.Height
+	}
+	hlsDir, err := ioutil.TempDir("", "video_album_hls")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(hlsDir)
+
+	created := make([]string, 0)
+	err = withLocalFile(v.MoviePath, func(src string) error {
+		variants := make([]*hlsVariant, 0)
+		for _, h := range renditionTargets(srcHeight) {
+			variant, err := s.transcodeRendition(v, src, h, hlsDir)
+			if err != nil {
+				return err
+			}
+			created = append(created, renditionName(v.MoviePath, h))
+			variants = append(variants, variant)
+		}
+		if !hlsEnabled {
+			return nil
+		}
+		saved, err := s.saveStreams(v, hlsDir, variants)
+		created = append(created, saved...)
+		return err
+	})
+	if err != nil {
+		s.removeRenditions(videoId)
+		s.removeMovieFiles(created)
+		if serr := s.setVideoStatus(videoId, videoFailed); serr != nil {
+			log.Println("transcode:", serr)
+		}
+		return err
+	}
+	return s.setVideoStatus(videoId, videoReady)
+}
+
+/*
+ * 高さheightの変換後の動画を作成して登録する.
+ * HLSを作成する場合は, 変換後の動画を分割したものをhlsDirに書き出す.
+ */
+func (s *Store) transcodeRendition(v *pageVideo, src string, height int64, hlsDir string) (*hlsVariant, error) {
+	f, err := ioutil.TempFile("", "video_album-*"+formatMP4.Ext)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	if err := videoTranscoder.Transcode(src, f.Name(), height); err != nil {
+		return nil, err
+	}
+	variant := &hlsVariant{Name: strconv.FormatInt(height, 10) + "p", Height: height, Bandwidth: height * 3000}
+	if hlsEnabled {
+		if err := videoTranscoder.SegmentHLS(f.Name(), hlsDir, variant.Name); err != nil {
+			return nil, err
+		}
+	}
+	fi, err := os.Stat(f.Name())
+	if err != nil {
+		return nil, err
+	}
+	if v.Media != nil && v.Media.DurationMs > 0 {
+		variant.Bandwidth = fi.Size() * 8 * 1000 / v.Media.DurationMs
+	}
+	r := &rendition{VideoId: v.Id, Height: height, MoviePath: renditionName(v.MoviePath, height)}
+	if err := putLocalFile(r.MoviePath, f.Name()); err != nil {
+		return nil, err
+	}
+	if err := s.createRendition(r); err != nil {
+		// 同じ動画を参照する他のページの変換後の動画でもあるため, 参照が無い場合のみ削除する
+		s.removeMovieFiles([]string{r.MoviePath})
+		return nil, err
+	}
+	return variant, nil
+}
+
+type videoSource struct {
+	MoviePath string
+	MimeType  string
+}
+
+/*
+ * ブラウザがそのまま再生できる形式か.
+ */
+func (m *pageVideo) webSafe() bool {
+	return m.MimeType == formatMP4.MimeType && m.Media != nil && m.Media.VideoCodec == "h264"
+}
+
+/*
+ * videoタグに並べる動画を, 再生に使ってほしい順に返す.
+ * ブラウザは最初に再生できたものを使うため, 元の動画がそのまま再生できれば元の動画,
+ * そうでなければ変換後の動画を解像度の高い順に先に並べる.
+ */
+func (m *pageVideo) Sources() []*videoSource {
+	original := &videoSource{MoviePath: m.MoviePath, MimeType: m.MimeType}
+	ret := make([]*videoSource, 0)
+	if m.webSafe() {
+		ret = append(ret, original)
+	}
+	for _, r := range m.Renditions {
+		ret = append(ret, &videoSource{MoviePath: r.MoviePath, MimeType: r.MimeType()})
+	}
+	if !m.webSafe() {
+		ret = append(ret, original)
+	}
+	return ret
+}
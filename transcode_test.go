@@ -0,0 +1,323 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+/*
+ * 外部ツールを使わないテスト用の実装.
+ * 元の動画の内容に高さを付けて書き出す. failHeightの高さでは失敗する.
+ * HLSはセグメント1つのプレイリストにする.
+ */
+type fakeTranscoder struct {
+	failHeight int64
+}
+
+func (t *fakeTranscoder) Transcode(src string, dst string, height int64) error {
+	if height == t.failHeight {
+		return errors.New("transcode failed")
+	}
+	b, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dst, append([]byte(strconv.FormatInt(height, 10)+"p:"), b...), 0666)
+}
+
+func (t *fakeTranscoder) SegmentHLS(src string, dir string, name string) error {
+	b, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, name+"_000.ts"), b, 0666); err != nil {
+		return err
+	}
+	playlist := "#EXTM3U\n#EXT-X-PLAYLIST-TYPE:VOD\n#EXTINF:6.0,\n" + name + "_000.ts\n#EXT-X-ENDLIST\n"
+	return ioutil.WriteFile(filepath.Join(dir, name+".m3u8"), []byte(playlist), 0666)
+}
+
+func useFakeTranscoder(t *fakeTranscoder) func() {
+	orig := videoTranscoder
+	videoTranscoder = t
+	return func() { videoTranscoder = orig }
+}
+
+func TestRenditionTargets(t *testing.T) {
+	orig := renditionHeights
+	defer func() { renditionHeights = orig }()
+	renditionHeights = []int64{720, 360}
+
+	tests := []struct {
+		srcHeight int64
+		expect    []int64
+	}{
+		{2160, []int64{720, 360}},
+		{720, []int64{720, 360}},
+		{480, []int64{360}},
+		{241, []int64{240}},
+		{0, []int64{720, 360}},
+	}
+	for _, test := range tests {
+		if actual := renditionTargets(test.srcHeight); !reflect.DeepEqual(actual, test.expect) {
+			t.Errorf("変換後の高さが異なります.src: %v, Expect: %v, Actual: %v", test.srcHeight, test.expect, actual)
+		}
+	}
+	if _, err := parseRenditionHeights("720, 360"); err != nil {
+		t.Errorf("正しい指定がエラーになりました.err: %v", err)
+	}
+	if heights, err := parseRenditionHeights(""); err != nil || len(heights) != 0 {
+		t.Errorf("空の指定で変換が無効になりません.")
+	}
+	for _, s := range []string{"720p", "-360", "721"} {
+		if _, err := parseRenditionHeights(s); err == nil {
+			t.Errorf("不正な指定がエラーになりませんでした.Actual: %v", s)
+		}
+	}
+}
+
+func TestTranscodeVideo(t *testing.T) {
+	defer truncateTables()
+	s, cleanup := useTempStorage(t)
+	defer cleanup()
+	defer useFakeTranscoder(&fakeTranscoder{})()
+
+	m := &album{Title: "test title1"}
+	if err := testStore.SaveAlbum(m); err != nil {
+		t.Fatal(err)
+	}
+	p := &page{AlbumId: m.Id, Title: "test page title", Description: "desc"}
+	if err := testStore.SavePage(p); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Put("phone.mov", strings.NewReader("hevc")); err != nil {
+		t.Fatal(err)
+	}
+	v, err := testStore.AddPageVideo(p, "phone.mov", 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testStore.SetPageMediaInfo(p, "phone.mov", &mediaInfo{Height: 1080, VideoCodec: "hevc", Container: "mov,mp4,m4a,3gp,3g2,mj2"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := testStore.setVideoStatus(v.Id, videoProcessing); err != nil {
+		t.Fatal(err)
+	}
+	if found, _ := testStore.FindPageById(p.Id); !found.Processing {
+		t.Errorf("変換待ちのページが変換中になっていません.")
+	}
+
+	if err := testStore.transcodeVideo(v.Id); err != nil {
+		t.Fatal(err)
+	}
+	if found, _ := testStore.FindPageById(p.Id); found.Processing {
+		t.Errorf("変換後もページが変換中のままです.")
+	}
+	for _, h := range []string{"720", "360"} {
+		obj, err := s.Open("phone_" + h + "p.mp4")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(obj)
+		obj.Close()
+		if string(b) != h+"p:hevc" {
+			t.Errorf("変換後の動画の内容が異なります.Actual: %v", string(b))
+		}
+	}
+	if readable, err := testStore.canReadMovie("phone_360p.mp4", nil); err != nil || !readable {
+		t.Errorf("変換後の動画を参照できません.err: %v", err)
+	}
+	streamFiles := []string{"phone_hls/master.m3u8", "phone_hls/720p.m3u8", "phone_hls/720p_000.ts", "phone_hls/360p.m3u8", "phone_hls/360p_000.ts"}
+	for _, file := range streamFiles {
+		if readable, err := testStore.canReadMovie(file, nil); err != nil || !readable {
+			t.Errorf("HLSのファイルを参照できません.file: %v, err: %v", file, err)
+		}
+	}
+	if found, _ := testStore.FindPageById(p.Id); found.StreamPath != "phone_hls/master.m3u8" {
+		t.Errorf("ページにHLSが登録されていません.Actual: %v", found.StreamPath)
+	}
+
+	// ブラウザで再生できない元の動画は最後に並ぶ
+	pld, err := testStore.FindPageListData(m.Id, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sources := make([]string, 0)
+	for _, src := range pld.SelectVideo.Sources() {
+		sources = append(sources, src.MoviePath)
+	}
+	if expect := []string{"phone_720p.mp4", "phone_360p.mp4", "phone.mov"}; !reflect.DeepEqual(sources, expect) {
+		t.Errorf("再生する動画の順序が異なります.Expect: %v, Actual: %v", expect, sources)
+	}
+	// テスト用の動画はMP4として正しくないため, 参照されていないファイルのみ確認する
+	issues, err := testStore.checkIntegrity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, issue := range issues {
+		if issue.Kind == fsckOrphanFile {
+			t.Errorf("変換後の動画が参照されていないファイルとして検出されました.Actual: %v", issue)
+		}
+	}
+
+	if err := testStore.RemovePage(p); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range append([]string{"phone.mov", "phone_720p.mp4", "phone_360p.mp4"}, streamFiles...) {
+		if _, err := s.Stat(file); !os.IsNotExist(err) {
+			t.Errorf("削除したページの動画が残っています.file: %v, err: %v", file, err)
+		}
+	}
+}
+
+func TestTranscodeVideoFailure(t *testing.T) {
+	defer truncateTables()
+	s, cleanup := useTempStorage(t)
+	defer cleanup()
+	defer useFakeTranscoder(&fakeTranscoder{failHeight: 360})()
+
+	m := &album{Title: "test title1"}
+	if err := testStore.SaveAlbum(m); err != nil {
+		t.Fatal(err)
+	}
+	p := &page{AlbumId: m.Id, Title: "test page title", Description: "desc"}
+	if err := testStore.SavePage(p); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Put("a.mp4", strings.NewReader("h264")); err != nil {
+		t.Fatal(err)
+	}
+	v, err := testStore.AddPageVideo(p, "a.mp4", 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testStore.SetPageMediaInfo(p, "a.mp4", &mediaInfo{Height: 720, VideoCodec: "h264", Container: "mov,mp4,m4a,3gp,3g2,mj2"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := testStore.transcodeVideo(v.Id); err == nil {
+		t.Errorf("変換の失敗がエラーになりませんでした.")
+	}
+	found, err := testStore.FindPageVideoById(v.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.Status != videoFailed {
+		t.Errorf("変換に失敗した版の状態が異なります.Actual: %v", found.Status)
+	}
+	if renditions, _ := testStore.FindRenditionsByVideoId(v.Id); len(renditions) != 0 {
+		t.Errorf("変換に失敗した版に変換後の動画が残っています.")
+	}
+	for _, file := range []string{"a_720p.mp4", "a_hls/720p.m3u8", "a_hls/720p_000.ts"} {
+		if _, err := s.Stat(file); !os.IsNotExist(err) {
+			t.Errorf("変換途中の動画が残っています.file: %v, err: %v", file, err)
+		}
+	}
+	if found.StreamPath != "" {
+		t.Errorf("変換に失敗した版にHLSが登録されています.")
+	}
+	// 元の動画はそのまま再生できるため先頭に並ぶ
+	if sources := found.Sources(); len(sources) != 1 || sources[0].MoviePath != "a.mp4" {
+		t.Errorf("再生する動画が異なります.")
+	}
+}
+
+func TestTranscodeRenditionOfRemovedPage(t *testing.T) {
+	defer truncateTables()
+	s, cleanup := useTempStorage(t)
+	defer cleanup()
+	defer useFakeTranscoder(&fakeTranscoder{})()
+	orig := hlsEnabled
+	defer func() { hlsEnabled = orig }()
+	hlsEnabled = false
+
+	m := &album{Title: "test title1"}
+	if err := testStore.SaveAlbum(m); err != nil {
+		t.Fatal(err)
+	}
+	// 同じ動画を2つのページに登録し, 一方は変換済み
+	video := testUploadVideo()
+	videos := make([]*pageVideo, 2)
+	pages := make([]*page, 2)
+	for i := range pages {
+		pages[i] = &page{AlbumId: m.Id, Title: "test page title", Description: "desc"}
+		if err := testStore.SavePage(pages[i]); err != nil {
+			t.Fatal(err)
+		}
+		moviePath, err := testStore.filesave(strings.NewReader(video))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if videos[i], err = testStore.AddPageVideo(pages[i], moviePath, 0, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	shared := renditionName(videos[0].MoviePath, 360)
+	if _, err := s.Put(shared, strings.NewReader("360p:"+video)); err != nil {
+		t.Fatal(err)
+	}
+	src, err := ioutil.TempFile("", "video_album-test-*.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(src.Name())
+	src.WriteString(video)
+	src.Close()
+
+	// 変換中にページが削除されると変換後の動画を登録できない
+	if err := testStore.RemovePage(pages[1]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testStore.transcodeRendition(videos[1], src.Name(), 360, ""); err == nil {
+		t.Errorf("削除した版に変換後の動画を登録できました.")
+	}
+	if _, err := s.Stat(shared); err != nil {
+		t.Errorf("他のページが参照している変換後の動画が削除されました.err: %v", err)
+	}
+}
+
+func TestFFmpegTranscode(t *testing.T) {
+	tools := &ffmpegTools{FFmpeg: "ffmpeg", FFprobe: "ffprobe"}
+	if _, err := exec.LookPath(tools.FFmpeg); err != nil {
+		t.Skip("ffmpeg is not installed")
+	}
+	if _, err := exec.LookPath(tools.FFprobe); err != nil {
+		t.Skip("ffprobe is not installed")
+	}
+	dir, err := ioutil.TempDir("", "video_album_media")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "test.mkv")
+	if _, err := runTool(tools.FFmpeg, "-v", "error", "-f", "lavfi", "-i", "testsrc=duration=1:size=640x480:rate=10", src); err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(dir, "test_240p.mp4")
+	if err := tools.Transcode(src, dst, 240); err != nil {
+		t.Fatal(err)
+	}
+	info, err := tools.Probe(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Height != 240 || info.VideoCodec != "h264" {
+		t.Errorf("変換後の動画が異なります.Actual: %+v", info)
+	}
+	if err := tools.SegmentHLS(dst, dir, "240p"); err != nil {
+		t.Fatal(err)
+	}
+	playlist, err := ioutil.ReadFile(filepath.Join(dir, "240p.m3u8"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(playlist), "240p_000.ts") {
+		t.Errorf("プレイリストにセグメントがありません.Actual: %v", string(playlist))
+	}
+}
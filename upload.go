@@ -0,0 +1,858 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	_ "github.com/mattn/go-sqlite3"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * tusプロトコルによる再開可能なアップロード.
+ * 受け取った分は保存先に断片として置き, 全て揃ったら1つの動画にまとめてページに登録する.
+ * https://tus.io/protocols/resumable-upload
+ */
+const tusVersion = "1.0.0"
+
+const tusExtensions = "creation,expiration,checksum,termination"
+
+// 保存先上の断片の置き場所
+const uploadChunkPrefix = "uploads/"
+
+// 最後に受け取ってからこの時間が過ぎたアップロードは削除する
+var uploadExpiry = 24 * time.Hour
+
+// tusで決められたステータスコード
+const statusChecksumMismatch = 460
+
+var (
+	errChecksumMismatch = errors.New("checksum mismatch")
+	errUploadOffset     = errors.New("upload offset does not match")
+)
+
+type upload struct {
+	Id      int64
+	UserId  int64
+	AlbumId int64
+	// 動画を差し替えるページ. 新しいページを作る場合は完了するまで0
+	PageId      int64
+	Title       string
+	Description string
+	Note        string
+	Filename    string
+	Length      int64
+	Offset      int64
+	// 完了時に確かめる動画全体のSHA-256(16進). 空なら確かめない
+	Checksum    string
+	CreatedAt   time.Time
+	ExpiresAt   time.Time
+	CompletedAt time.Time
+}
+
+type uploadChunk struct {
+	Offset    int64
+	Size      int64
+	MoviePath string
+}
+
+func (m *upload) Completed() bool {
+	return !m.CompletedAt.IsZero()
+}
+
+/*
+ * Upload-Metadataヘッダーを解釈する.
+ * "key base64値"をカンマで区切ったもので, 値は省略できる.
+ */
+func parseUploadMetadata(s string) (map[string]string, error) {
+	ret := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, " ", 2)
+		value := ""
+		if len(kv) == 2 {
+			b, err := base64.StdEncoding.DecodeString(kv[1])
+			if err != nil {
+				return nil, errBadRequest
+			}
+			value = string(b)
+		}
+		ret[kv[0]] = value
+	}
+	return ret, nil
+}
+
+/*
+ * Upload-Checksumヘッダーを解釈し, 計算するハッシュと期待する値を返す.
+ * ヘッダーが無ければnilを返す.
+ */
+func parseUploadChecksum(s string) (hash.Hash, []byte, error) {
+	if s == "" {
+		return nil, nil, nil
+	}
+	kv := strings.SplitN(s, " ", 2)
+	if len(kv) != 2 {
+		return nil, nil, errBadRequest
+	}
+	sum, err := base64.StdEncoding.DecodeString(kv[1])
+	if err != nil {
+		return nil, nil, errBadRequest
+	}
+	switch kv[0] {
+	case "md5":
+		return md5.New(), sum, nil
+	case "sha1":
+		return sha1.New(), sum, nil
+	case "sha256":
+		return sha256.New(), sum, nil
+	}
+	return nil, nil, errBadRequest
+}
+
+func (m *upload) Validate() error {
+	if m.Length <= 0 {
+		return errors.New("upload length must be positive")
+	}
+	if m.Checksum != "" {
+		if b, err := hex.DecodeString(m.Checksum); err != nil || len(b) != sha256.Size {
+			return errors.New("sha256 must be 64 hex digits")
+		}
+	}
+	if m.PageId == 0 || m.Title != "" {
+		if err := (&page{Title: m.Title, Description: m.Description}).Validate(); err != nil {
+			return err
+		}
+	}
+	return (&pageVideo{Note: m.Note}).Validate()
+}
+
+func (s *Store) CreateUpload(m *upload) error {
+	if err := m.Validate(); err != nil {
+		return err
+	}
+	query := `
+		INSERT INTO uploads (user_id, album_id, page_id, title, description, note, filename, length, received, checksum, created_at, expires_at) values(?, ?, ?, ?, ?, ?, ?, ?, 0, ?, ?, ?)
+	`
+	db := s.db
+
+	now := time.Unix(time.Now().Unix(), 0)
+	m.CreatedAt = now
+	m.ExpiresAt = now.Add(uploadExpiry)
+	id, err := db.Insert(query, m.UserId, m.AlbumId, m.PageId, m.Title, m.Description, m.Note, m.Filename, m.Length, m.Checksum, m.CreatedAt.Unix(), m.ExpiresAt.Unix())
+	m.Id = id
+	return err
+}
+
+func (s *Store) FindUploadById(id int64) (*upload, error) {
+	query := `
+		SELECT
+			id,
+			user_id,
+			album_id,
+			page_id,
+			title,
+			description,
+			note,
+			filename,
+			length,
+			received,
+			checksum,
+			created_at,
+			expires_at,
+			completed_at
+		FROM
+			uploads
+		WHERE
+			id = ?
+	`
+	db := s.db
+
+	m := &upload{}
+	var createdAt, expiresAt int64
+	var completedAt sql.NullInt64
+	err := db.QueryRow(query, id).Scan(&m.Id, &m.UserId, &m.AlbumId, &m.PageId, &m.Title, &m.Description, &m.Note, &m.Filename,
+		&m.Length, &m.Offset, &m.Checksum, &createdAt, &expiresAt, &completedAt)
+	if err != nil {
+		return nil, err
+	}
+	m.CreatedAt = time.Unix(createdAt, 0)
+	m.ExpiresAt = time.Unix(expiresAt, 0)
+	m.CompletedAt = timeOrZero(completedAt)
+	return m, nil
+}
+
+func (s *Store) uploadChunks(m *upload) ([]*uploadChunk, error) {
+	query := `
+		SELECT
+			start,
+			size,
+			filepath
+		FROM
+			upload_chunks
+		WHERE
+			upload_id = ?
+		ORDER BY
+			start
+	`
+	db := s.db
+
+	rows, err := db.Query(query, m.Id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ret := make([]*uploadChunk, 0)
+	for rows.Next() {
+		c := &uploadChunk{}
+		if err := rows.Scan(&c.Offset, &c.Size, &c.MoviePath); err != nil {
+			return nil, err
+		}
+		ret = append(ret, c)
+	}
+	return ret, nil
+}
+
+/*
+ * 断片の名前. 並べ替えやすいよう開始位置を0埋めする.
+ * 同じ位置への書き込みが重なっても上書きしないよう, 末尾はランダムにする.
+ */
+func uploadChunkName(uploadId int64, offset int64) string {
+	return fmt.Sprintf("%s%d_%020d_%s.part", uploadChunkPrefix, uploadId, offset, randStr())
+}
+
+/*
+ * rから受け取った分を断片として保存し, 受け取った位置を進める.
+ * 接続が切れても受け取った分は残し, 続きから再開できるようにする.
+ * checksumを指定した場合は, 断片全体が一致しなければ何も保存しない.
+ */
+func (s *Store) WriteUploadChunk(m *upload, r io.Reader, checksum string) (int64, error) {
+	h, expect, err := parseUploadChecksum(checksum)
+	if err != nil {
+		return 0, err
+	}
+	f, err := ioutil.TempFile("", "video_album-*.part")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	var w io.Writer = f
+	if h != nil {
+		w = io.MultiWriter(f, h)
+	}
+	// 宣言された長さを超えた分は受け取らない
+	n, readErr := io.Copy(w, io.LimitReader(r, m.Length-m.Offset))
+	if h != nil {
+		if readErr != nil {
+			return 0, readErr
+		}
+		if sum := h.Sum(nil); string(sum) != string(expect) {
+			return 0, errChecksumMismatch
+		}
+	}
+	if n == 0 {
+		return 0, readErr
+	}
+	if m.Offset == 0 && (n >= sniffLen || n == m.Length) {
+		// 動画でなければ残りを受け取る前に断る
+		head := make([]byte, sniffLen)
+		k, _ := f.ReadAt(head, 0)
+		if detectVideoFormat(head[:k]) == nil {
+			return 0, errNotVideo
+		}
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	name := uploadChunkName(m.Id, m.Offset)
+	if _, err := movieStorage.Put(name, f); err != nil {
+		return 0, err
+	}
+	if err := s.addUploadChunk(m, &uploadChunk{Offset: m.Offset, Size: n, MoviePath: name}); err != nil {
+		movieStorage.Delete(name)
+		return 0, err
+	}
+	return n, readErr
+}
+
+/*
+ * 断片を記録して受け取った位置を進める.
+ * 同時に同じ位置へ書き込まれた場合は, 先に記録した方だけを残す.
+ */
+func (s *Store) addUploadChunk(m *upload, c *uploadChunk) error {
+	updateQuery := `
+		UPDATE
+			uploads
+		SET
+			received = received + ?,
+			expires_at = ?
+		WHERE
+			id = ?
+			AND received = ?
+			AND completed_at IS NULL
+	`
+	insertQuery := `
+		INSERT INTO upload_chunks (upload_id, start, size, filepath) values(?, ?, ?, ?)
+	`
+	db := s.db
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	expiresAt := time.Unix(time.Now().Unix(), 0).Add(uploadExpiry)
+	res, err := tx.Exec(updateQuery, c.Size, expiresAt.Unix(), m.Id, c.Offset)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errUploadOffset
+	}
+	if _, err := tx.Exec(insertQuery, m.Id, c.Offset, c.Size, c.MoviePath); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	m.Offset += c.Size
+	m.ExpiresAt = expiresAt
+	return nil
+}
+
+/*
+ * 断片を順に開いて1つの動画として読む.
+ */
+type chunkReader struct {
+	chunks []*uploadChunk
+	cur    storageObject
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if r.cur == nil {
+			if len(r.chunks) == 0 {
+				return 0, io.EOF
+			}
+			obj, err := movieStorage.Open(r.chunks[0].MoviePath)
+			if err != nil {
+				return 0, err
+			}
+			r.cur = obj
+			r.chunks = r.chunks[1:]
+		}
+		n, err := r.cur.Read(p)
+		if err == io.EOF {
+			r.cur.Close()
+			r.cur = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (r *chunkReader) Close() error {
+	if r.cur != nil {
+		return r.cur.Close()
+	}
+	return nil
+}
+
+/*
+ * 全て受け取ったアップロードを1つの動画にまとめ, ページを保存して新しい版として登録する.
+ * 動画全体のチェックサムが一致しなければ登録しない.
+ */
+func (s *Store) CompleteUpload(m *upload, u *user) (*page, error) {
+	if ok, err := s.canWriteAlbum(m.AlbumId, u); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, errAlbumForbidden
+	}
+	p := &page{AlbumId: m.AlbumId}
+	if m.PageId != 0 {
+		var err error
+		if p, err = s.FindPageById(m.PageId); err != nil {
+			return nil, err
+		}
+		if p.AlbumId != m.AlbumId {
+			return nil, errAlbumForbidden
+		}
+	}
+	if m.PageId == 0 || m.Title != "" {
+		p.Title = m.Title
+		p.Description = m.Description
+	}
+	p.UpdatedBy = u.Id
+
+	chunks, err := s.uploadChunks(m)
+	if err != nil {
+		return nil, err
+	}
+	r := &chunkReader{chunks: chunks}
+	defer r.Close()
+	moviePath, err := s.filesave(r)
+	if err != nil {
+		return nil, err
+	}
+	// 保存した名前が動画全体のハッシュになっている
+	if m.Checksum != "" && blobSum(moviePath) != m.Checksum {
+		s.releaseMovieFile(moviePath)
+		return nil, errChecksumMismatch
+	}
+
+	// ページと版の登録, アップロードの完了は一度に行い, 途中で失敗した場合は再送でやり直せるようにする
+	v, files, err := s.registerUpload(m, p, moviePath, u.Id)
+	if err != nil {
+		s.releaseMovieFile(moviePath)
+		return nil, err
+	}
+	if err := s.removeMovieFiles(files); err != nil {
+		log.Println("upload:", m.Id, err)
+	}
+	if err := s.queueMediaJobs(v); err != nil {
+		log.Println("job:", moviePath, err)
+	}
+	return p, nil
+}
+
+func (s *Store) registerUpload(m *upload, p *page, moviePath string, userId int64) (*pageVideo, []string, error) {
+	db := s.db
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	if err := savePage(tx, p); err != nil {
+		return nil, nil, err
+	}
+	v, err := addPageVideo(tx, p, moviePath, userId, m.Note)
+	if err != nil {
+		return nil, nil, err
+	}
+	files, completedAt, err := markUploadCompleted(tx, m, p.Id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, nil, err
+	}
+	m.PageId = p.Id
+	m.CompletedAt = completedAt
+	return v, files, nil
+}
+
+/*
+ * アップロードを完了にし, 断片の記録を削除する. 断片のファイルはコミット後に削除する.
+ * 完了の応答が届かなかった場合に備え, アップロード自体は期限まで残す.
+ */
+func markUploadCompleted(tx *storeTx, m *upload, pageId int64) ([]string, time.Time, error) {
+	updateQuery := `
+		UPDATE
+			uploads
+		SET
+			page_id = ?,
+			completed_at = ?
+		WHERE
+			id = ?
+			AND completed_at IS NULL
+	`
+	deleteQuery := `
+		DELETE
+		FROM
+			upload_chunks
+		WHERE
+			upload_id = ?
+	`
+	files, err := queryMovieFiles(tx, "SELECT filepath FROM upload_chunks WHERE upload_id = ?", m.Id)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	now := time.Unix(time.Now().Unix(), 0)
+	res, err := tx.Exec(updateQuery, pageId, now.Unix(), m.Id)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	// 同時に完了した他のリクエストが既にページを登録している
+	if n, err := res.RowsAffected(); err != nil {
+		return nil, time.Time{}, err
+	} else if n == 0 {
+		return nil, time.Time{}, errUploadOffset
+	}
+	if _, err := tx.Exec(deleteQuery, m.Id); err != nil {
+		return nil, time.Time{}, err
+	}
+	return files, now, nil
+}
+
+/*
+ * アップロードと受け取った断片を削除する.
+ */
+func (s *Store) RemoveUpload(m *upload) error {
+	queries := []string{`
+		DELETE
+		FROM
+			upload_chunks
+		WHERE
+			upload_id = ?
+	`, `
+		DELETE
+		FROM
+			uploads
+		WHERE
+			id = ?
+	`}
+	db := s.db
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	files, err := queryMovieFiles(tx, "SELECT filepath FROM upload_chunks WHERE upload_id = ?", m.Id)
+	if err != nil {
+		return err
+	}
+	for _, query := range queries {
+		if _, err := tx.Exec(query, m.Id); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return s.removeMovieFiles(files)
+}
+
+/*
+ * 期限を過ぎたアップロードを削除する.
+ */
+func (s *Store) RemoveExpiredUploads(now time.Time) (int, error) {
+	query := `
+		SELECT
+			id
+		FROM
+			uploads
+		WHERE
+			expires_at < ?
+	`
+	db := s.db
+
+	rows, err := db.Query(query, now.Unix())
+	if err != nil {
+		return 0, err
+	}
+	ids := make([]int64, 0)
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		if err := s.RemoveUpload(&upload{Id: id}); err != nil {
+			return 0, err
+		}
+	}
+	return len(ids), nil
+}
+
+/*
+ * 期限を過ぎたアップロードを定期的に削除する.
+ */
+func startUploadCleaner(s *Store) {
+	go func() {
+		for {
+			if _, err := s.RemoveExpiredUploads(time.Now()); err != nil {
+				log.Println("upload:", err)
+			}
+			time.Sleep(time.Hour)
+		}
+	}()
+}
+
+/*
+ * tusの応答に共通のヘッダーを付け, クライアントのバージョンを確認する.
+ * 対応していなければ412を返してfalseになる.
+ */
+func checkTusResumable(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Method == "OPTIONS" || r.Header.Get("Tus-Resumable") == tusVersion {
+		return true
+	}
+	w.Header().Set("Tus-Version", tusVersion)
+	writeAPIStatus(w, http.StatusPreconditionFailed, "unsupported Tus-Resumable version")
+	return false
+}
+
+/*
+ * 残りの断片と, 揃った後にまとめる動画を置く空き容量があるか.
+ */
+func (s *Store) checkUploadDiskSpace(m *upload) error {
+	free, err := s.uploadableDiskSpace()
+	if err != nil {
+		return err
+	}
+	if free >= 0 && m.Length-m.Offset+m.Length > free {
+		return errDiskFull
+	}
+	return nil
+}
+
+func setUploadHeaders(w http.ResponseWriter, m *upload) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(m.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(m.Length, 10))
+	w.Header().Set("Upload-Expires", m.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.Header().Set("Cache-Control", "no-store")
+	if m.Completed() {
+		w.Header().Set("Upload-Page-Id", strconv.FormatInt(m.PageId, 10))
+	}
+}
+
+/*
+ * パスパラメータのアップロードを取得する. 他のユーザーのアップロードは見つからないものとする.
+ */
+func apiUpload(r *http.Request, params apiParams) (*upload, error) {
+	s := storeOf(r)
+	id, err := params.id("upload_id")
+	if err != nil {
+		return nil, err
+	}
+	m, err := s.FindUploadById(id)
+	if err != nil {
+		return nil, err
+	}
+	if m.UserId != currentUser(r).Id {
+		return nil, sql.ErrNoRows
+	}
+	return m, nil
+}
+
+func writeUploadError(w http.ResponseWriter, err error) {
+	switch err {
+	case errChecksumMismatch:
+		writeAPIStatus(w, statusChecksumMismatch, err.Error())
+	case errUploadOffset:
+		writeAPIStatus(w, http.StatusConflict, err.Error())
+	default:
+		writeAPIError(w, err)
+	}
+}
+
+func setTusMaxSize(w http.ResponseWriter) {
+	if maxUploadSize > 0 {
+		w.Header().Set("Tus-Max-Size", maxUploadSize.String())
+	}
+}
+
+func api_upload_options(w http.ResponseWriter, r *http.Request, params apiParams) {
+	checkTusResumable(w, r)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	w.Header().Set("Tus-Checksum-Algorithm", "md5,sha1,sha256")
+	setTusMaxSize(w)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/*
+ * アップロードを開始する.
+ * Upload-Metadataのalbum_idに登録先のアルバム, page_idに動画を差し替えるページを指定する.
+ * 新しいページを作る場合はtitleも必要.
+ */
+func api_create_upload(w http.ResponseWriter, r *http.Request, params apiParams) {
+	s := storeOf(r)
+	if !checkTusResumable(w, r) {
+		return
+	}
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil {
+		writeAPIStatus(w, http.StatusBadRequest, "Upload-Length is required")
+		return
+	}
+	meta, err := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	m := &upload{
+		UserId:      currentUser(r).Id,
+		Title:       meta["title"],
+		Description: meta["description"],
+		Note:        meta["note"],
+		Filename:    meta["filename"],
+		Length:      length,
+		Checksum:    strings.ToLower(meta["sha256"]),
+	}
+	if m.AlbumId, err = strconv.ParseInt(meta["album_id"], 10, 64); err != nil {
+		writeAPIStatus(w, http.StatusBadRequest, "album_id is required in Upload-Metadata")
+		return
+	}
+	if meta["page_id"] != "" {
+		if m.PageId, err = strconv.ParseInt(meta["page_id"], 10, 64); err != nil {
+			writeAPIError(w, errBadRequest)
+			return
+		}
+	}
+	if _, err := s.FindAlbumById(m.AlbumId); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	if err := checkAlbumAccess(r, m.AlbumId, true); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	if m.PageId != 0 {
+		p, err := s.FindPageById(m.PageId)
+		if err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		if p.AlbumId != m.AlbumId {
+			writeAPIError(w, sql.ErrNoRows)
+			return
+		}
+	}
+	if err := m.Validate(); err != nil {
+		writeAPIStatus(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	// 容量は開始時に宣言された長さで確保する
+	a, err := s.newUploadAllowance(m.UserId, m.AlbumId)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	if err := a.Check(m.Length); err != nil {
+		setTusMaxSize(w)
+		writeAPIError(w, err)
+		return
+	}
+	if err := s.CreateUpload(m); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	w.Header().Set("Location", apiPrefix+"/uploads/"+strconv.FormatInt(m.Id, 10))
+	setUploadHeaders(w, m)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func api_head_upload(w http.ResponseWriter, r *http.Request, params apiParams) {
+	if !checkTusResumable(w, r) {
+		return
+	}
+	m, err := apiUpload(r, params)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	setUploadHeaders(w, m)
+	w.WriteHeader(http.StatusOK)
+}
+
+/*
+ * 動画の続きを受け取る. 全て揃ったらページに登録し, Upload-Page-Idでページを返す.
+ */
+func api_patch_upload(w http.ResponseWriter, r *http.Request, params apiParams) {
+	s := storeOf(r)
+	if !checkTusResumable(w, r) {
+		return
+	}
+	m, err := apiUpload(r, params)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		writeAPIStatus(w, http.StatusUnsupportedMediaType, "Content-Type must be application/offset+octet-stream")
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		writeAPIStatus(w, http.StatusBadRequest, "Upload-Offset is required")
+		return
+	}
+	if m.Completed() && offset == m.Length {
+		// 完了の応答を受け取れなかったクライアントの再送
+		setUploadHeaders(w, m)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if m.Completed() || offset != m.Offset {
+		writeUploadError(w, errUploadOffset)
+		return
+	}
+	if err := s.checkUploadDiskSpace(m); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	if _, err := s.WriteUploadChunk(m, r.Body, r.Header.Get("Upload-Checksum")); err != nil && m.Offset == offset {
+		if err == errNotVideo {
+			s.RemoveUpload(m)
+		}
+		writeUploadError(w, err)
+		return
+	} else if err != nil {
+		// 途中で切れた場合も受け取った分は残っている
+		log.Println("upload:", m.Id, err)
+	}
+	if m.Offset == m.Length {
+		if _, err := s.CompleteUpload(m, currentUser(r)); err != nil {
+			// まとめた動画が壊れている場合は最初からやり直してもらう.
+			// それ以外は断片を残し, 同じ位置への再送で完了できるようにする
+			if err == errChecksumMismatch || err == errNotVideo {
+				s.RemoveUpload(m)
+			}
+			writeUploadError(w, err)
+			return
+		}
+	}
+	setUploadHeaders(w, m)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func api_delete_upload(w http.ResponseWriter, r *http.Request, params apiParams) {
+	s := storeOf(r)
+	if !checkTusResumable(w, r) {
+		return
+	}
+	m, err := apiUpload(r, params)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	if err := s.RemoveUpload(m); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// ログイン済みのCookieとtusのヘッダーを付けてアップロードのAPIを呼び出す
+func callTus(t *testing.T, u *user, method string, path string, headers map[string]string, body io.Reader) *httptest.ResponseRecorder {
+	sessionKey = []byte("0123456789abcdef0123456789abcdef")
+	r := httptest.NewRequest(method, path, body)
+	s, err := testStore.CreateSession(u.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.AddCookie(&http.Cookie{Name: sessionCookieName, Value: signSessionId(s.Id)})
+	r.Header.Set("Tus-Resumable", tusVersion)
+	if method == "PATCH" {
+		r.Header.Set("Content-Type", "application/offset+octet-stream")
+	}
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	serveTest(api_dispatch, w, r)
+	return w
+}
+
+func uploadMetadata(kv ...string) string {
+	pairs := make([]string, 0)
+	for i := 0; i < len(kv); i += 2 {
+		pairs = append(pairs, kv[i]+" "+base64.StdEncoding.EncodeToString([]byte(kv[i+1])))
+	}
+	return strings.Join(pairs, ",")
+}
+
+// 途中で接続が切れたリクエストのボディ
+type brokenReader struct{}
+
+func (brokenReader) Read(p []byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func testUploadVideo() string {
+	return testMP4Box("ftyp", 16) + testMP4Box("moov", 24) + testMP4Box("mdat", 2000)
+}
+
+func createTestUpload(t *testing.T, u *user, length int, meta string) string {
+	w := callTus(t, u, "POST", "/api/v1/uploads", map[string]string{"Upload-Length": strconv.Itoa(length), "Upload-Metadata": meta}, nil)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("アップロードを開始できません.Status: %v, Body: %v", w.Code, w.Body.String())
+	}
+	return w.Header().Get("Location")
+}
+
+func TestUploadResumable(t *testing.T) {
+	defer truncateTables()
+	s, cleanup := useTempStorage(t)
+	defer cleanup()
+
+	u := createTestUser(t, "alice", roleEditor)
+	m := &album{Title: "test title1"}
+	if err := testStore.SaveAlbum(m); err != nil {
+		t.Fatal(err)
+	}
+	video := testUploadVideo()
+	sum := sha256.Sum256([]byte(video))
+	location := createTestUpload(t, u, len(video), uploadMetadata("album_id", strconv.FormatInt(m.Id, 10), "title", "training", "description", "desc",
+		"note", "first take", "filename", "training.mp4", "sha256", hex.EncodeToString(sum[:])))
+	if !strings.HasPrefix(location, "/api/v1/uploads/") {
+		t.Fatalf("アップロードの場所が異なります.Actual: %v", location)
+	}
+
+	w := callTus(t, u, "PATCH", location, map[string]string{"Upload-Offset": "0"}, strings.NewReader(video[:600]))
+	if w.Code != http.StatusNoContent || w.Header().Get("Upload-Offset") != "600" {
+		t.Fatalf("1つ目の断片を受け取れません.Status: %v, Offset: %v", w.Code, w.Header().Get("Upload-Offset"))
+	}
+	if w := callTus(t, u, "PATCH", location, map[string]string{"Upload-Offset": "0"}, strings.NewReader(video[:600])); w.Code != http.StatusConflict {
+		t.Errorf("位置の異なる断片が409になりませんでした.Actual: %v", w.Code)
+	}
+
+	// 接続が切れても受け取った分は残る
+	body := io.MultiReader(strings.NewReader(video[600:1000]), brokenReader{})
+	w = callTus(t, u, "PATCH", location, map[string]string{"Upload-Offset": "600"}, body)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("途中で切れた断片が受け取れません.Status: %v, Body: %v", w.Code, w.Body.String())
+	}
+	w = callTus(t, u, "HEAD", location, nil, nil)
+	if w.Code != http.StatusOK || w.Header().Get("Upload-Offset") != "1000" || w.Header().Get("Upload-Length") != strconv.Itoa(len(video)) {
+		t.Fatalf("再開する位置が異なります.Status: %v, Offset: %v", w.Code, w.Header().Get("Upload-Offset"))
+	}
+	if w.Header().Get("Cache-Control") != "no-store" {
+		t.Errorf("再開する位置がキャッシュされます.")
+	}
+
+	w = callTus(t, u, "PATCH", location, map[string]string{"Upload-Offset": "1000"}, strings.NewReader(video[1000:]))
+	if w.Code != http.StatusNoContent || w.Header().Get("Upload-Offset") != strconv.Itoa(len(video)) {
+		t.Fatalf("最後の断片を受け取れません.Status: %v, Body: %v", w.Code, w.Body.String())
+	}
+	pageId, err := strconv.ParseInt(w.Header().Get("Upload-Page-Id"), 10, 64)
+	if err != nil {
+		t.Fatalf("登録したページが返されません.err: %v", err)
+	}
+	p, err := testStore.FindPageById(pageId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.AlbumId != m.Id || p.Title != "training" || p.Description != "desc" || !strings.HasSuffix(p.MoviePath, ".mp4") {
+		t.Errorf("登録したページが異なります.Actual: %+v", p)
+	}
+	obj, err := s.Open(p.MoviePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(obj)
+	obj.Close()
+	if string(b) != video {
+		t.Errorf("まとめた動画の内容が異なります.")
+	}
+	videos, _ := testStore.FindPageVideosByPageId(pageId)
+	if len(videos) != 1 || videos[0].Note != "first take" || videos[0].UserId != u.Id {
+		t.Errorf("動画の版が登録されていません.Actual: %v", videos)
+	}
+	if jobs, _ := testStore.FindJobs(jobQueued, 10); len(jobs) == 0 {
+		t.Errorf("アップロードした動画の処理が追加されていません.")
+	}
+	files, _ := s.List()
+	if len(files) != 1 || files[0].Name != p.MoviePath {
+		t.Errorf("断片が残っています.Actual: %v", files)
+	}
+
+	// 完了の応答を受け取れなかったクライアントの再送
+	w = callTus(t, u, "PATCH", location, map[string]string{"Upload-Offset": strconv.Itoa(len(video))}, strings.NewReader(""))
+	if w.Code != http.StatusNoContent || w.Header().Get("Upload-Page-Id") != strconv.FormatInt(pageId, 10) {
+		t.Errorf("完了したアップロードへの再送が成功しません.Status: %v", w.Code)
+	}
+	if pages, _ := testStore.FindPageByAlbumId(m.Id); len(pages) != 1 {
+		t.Errorf("再送でページが重複しました.Actual: %v", len(pages))
+	}
+}
+
+func TestUploadReplacePageVideo(t *testing.T) {
+	defer truncateTables()
+	_, cleanup := useTempStorage(t)
+	defer cleanup()
+
+	u := createTestUser(t, "alice", roleEditor)
+	m := &album{Title: "test title1"}
+	if err := testStore.SaveAlbum(m); err != nil {
+		t.Fatal(err)
+	}
+	p := &page{AlbumId: m.Id, Title: "test page title", Description: "desc"}
+	if err := testStore.SavePage(p); err != nil {
+		t.Fatal(err)
+	}
+	video := testUploadVideo()
+	location := createTestUpload(t, u, len(video), uploadMetadata("album_id", strconv.FormatInt(m.Id, 10), "page_id", strconv.FormatInt(p.Id, 10)))
+	w := callTus(t, u, "PATCH", location, map[string]string{"Upload-Offset": "0"}, strings.NewReader(video))
+	if w.Code != http.StatusNoContent || w.Header().Get("Upload-Page-Id") != strconv.FormatInt(p.Id, 10) {
+		t.Fatalf("ページの動画を差し替えられません.Status: %v, Body: %v", w.Code, w.Body.String())
+	}
+	found, err := testStore.FindPageById(p.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.Title != p.Title || found.Description != p.Description || found.MoviePath == "" {
+		t.Errorf("差し替えたページが異なります.Actual: %+v", found)
+	}
+}
+
+func TestUploadChecksum(t *testing.T) {
+	defer truncateTables()
+	s, cleanup := useTempStorage(t)
+	defer cleanup()
+
+	u := createTestUser(t, "alice", roleEditor)
+	m := &album{Title: "test title1"}
+	if err := testStore.SaveAlbum(m); err != nil {
+		t.Fatal(err)
+	}
+	video := testUploadVideo()
+	wrong := sha256.Sum256([]byte("other"))
+	location := createTestUpload(t, u, len(video), uploadMetadata("album_id", strconv.FormatInt(m.Id, 10), "title", "training", "sha256", hex.EncodeToString(wrong[:])))
+
+	// 断片のチェックサムが一致しなければ受け取らない
+	chunkSum := sha1.Sum([]byte("other"))
+	w := callTus(t, u, "PATCH", location, map[string]string{"Upload-Offset": "0", "Upload-Checksum": "sha1 " + base64.StdEncoding.EncodeToString(chunkSum[:])}, strings.NewReader(video[:600]))
+	if w.Code != statusChecksumMismatch {
+		t.Errorf("断片のチェックサムの不一致が460になりませんでした.Actual: %v", w.Code)
+	}
+	if w := callTus(t, u, "HEAD", location, nil, nil); w.Header().Get("Upload-Offset") != "0" {
+		t.Errorf("チェックサムが一致しない断片を受け取りました.Actual: %v", w.Header().Get("Upload-Offset"))
+	}
+	if w := callTus(t, u, "PATCH", location, map[string]string{"Upload-Offset": "0", "Upload-Checksum": "crc32 AAAA"}, strings.NewReader(video)); w.Code != http.StatusBadRequest {
+		t.Errorf("対応していないチェックサムが400になりませんでした.Actual: %v", w.Code)
+	}
+
+	// 動画全体のチェックサムが一致しなければ登録しない
+	chunkSum = sha1.Sum([]byte(video))
+	w = callTus(t, u, "PATCH", location, map[string]string{"Upload-Offset": "0", "Upload-Checksum": "sha1 " + base64.StdEncoding.EncodeToString(chunkSum[:])}, strings.NewReader(video))
+	if w.Code != statusChecksumMismatch {
+		t.Errorf("動画全体のチェックサムの不一致が460になりませんでした.Actual: %v", w.Code)
+	}
+	if pages, _ := testStore.FindPageByAlbumId(m.Id); len(pages) != 0 {
+		t.Errorf("チェックサムが一致しない動画が登録されました.")
+	}
+	if w := callTus(t, u, "HEAD", location, nil, nil); w.Code != http.StatusNotFound {
+		t.Errorf("チェックサムが一致しないアップロードが残っています.Actual: %v", w.Code)
+	}
+	if files, _ := s.List(); len(files) != 0 {
+		t.Errorf("チェックサムが一致しない動画が残っています.Actual: %v", files)
+	}
+}
+
+func TestUploadCompleteRetry(t *testing.T) {
+	defer truncateTables()
+	_, cleanup := useTempStorage(t)
+	defer cleanup()
+
+	u := createTestUser(t, "alice", roleEditor)
+	m := &album{Title: "test title1"}
+	if err := testStore.SaveAlbum(m); err != nil {
+		t.Fatal(err)
+	}
+	video := testUploadVideo()
+	location := createTestUpload(t, u, len(video), uploadMetadata("album_id", strconv.FormatInt(m.Id, 10), "title", "training"))
+
+	// アップロードの完了の記録に失敗する
+	if _, err := testStore.db.Exec(`CREATE TRIGGER fail_upload_completion BEFORE UPDATE OF completed_at ON uploads BEGIN SELECT RAISE(ABORT, 'database is locked'); END`); err != nil {
+		t.Fatal(err)
+	}
+	w := callTus(t, u, "PATCH", location, map[string]string{"Upload-Offset": "0"}, strings.NewReader(video))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("完了の失敗が500になりませんでした.Actual: %v", w.Code)
+	}
+	if pages, _ := testStore.FindPageByAlbumId(m.Id); len(pages) != 0 {
+		t.Errorf("完了に失敗したアップロードのページが残っています.Actual: %v", len(pages))
+	}
+	if w := callTus(t, u, "HEAD", location, nil, nil); w.Code != http.StatusOK || w.Header().Get("Upload-Offset") != strconv.Itoa(len(video)) {
+		t.Fatalf("受け取った動画が残っていません.Status: %v, Offset: %v", w.Code, w.Header().Get("Upload-Offset"))
+	}
+	if stats, _ := testStore.FindBlobStats(); stats.References != 0 {
+		t.Errorf("完了に失敗した動画の参照が残っています.Actual: %+v", stats)
+	}
+
+	// 同じ位置への再送で完了する
+	if _, err := testStore.db.Exec(`DROP TRIGGER fail_upload_completion`); err != nil {
+		t.Fatal(err)
+	}
+	w = callTus(t, u, "PATCH", location, map[string]string{"Upload-Offset": strconv.Itoa(len(video))}, strings.NewReader(""))
+	if w.Code != http.StatusNoContent || w.Header().Get("Upload-Page-Id") == "" {
+		t.Fatalf("再送で完了しません.Status: %v, Body: %v", w.Code, w.Body.String())
+	}
+	if pages, _ := testStore.FindPageByAlbumId(m.Id); len(pages) != 1 {
+		t.Errorf("登録されたページの数が異なります.Actual: %v", len(pages))
+	}
+}
+
+func TestUploadRejected(t *testing.T) {
+	defer truncateTables()
+	s, cleanup := useTempStorage(t)
+	defer cleanup()
+
+	alice := createTestUser(t, "alice", roleEditor)
+	bob := createTestUser(t, "bob", roleEditor)
+	carol := createTestUser(t, "carol", roleViewer)
+	m := &album{Title: "test title1"}
+	if err := testStore.SaveAlbum(m); err != nil {
+		t.Fatal(err)
+	}
+	albumId := strconv.FormatInt(m.Id, 10)
+
+	tests := []struct {
+		user    *user
+		headers map[string]string
+		status  int
+	}{
+		{alice, map[string]string{"Upload-Length": "100", "Upload-Metadata": uploadMetadata("album_id", albumId)}, http.StatusBadRequest},
+		{alice, map[string]string{"Upload-Metadata": uploadMetadata("album_id", albumId, "title", "t")}, http.StatusBadRequest},
+		{alice, map[string]string{"Upload-Length": "100", "Upload-Metadata": uploadMetadata("title", "t")}, http.StatusBadRequest},
+		{alice, map[string]string{"Upload-Length": "100", "Upload-Metadata": uploadMetadata("album_id", "999", "title", "t")}, http.StatusNotFound},
+		{alice, map[string]string{"Upload-Length": "100", "Upload-Metadata": uploadMetadata("album_id", albumId, "page_id", "999")}, http.StatusNotFound},
+		{alice, map[string]string{"Upload-Length": "100", "Upload-Metadata": uploadMetadata("album_id", albumId, "title", "t", "sha256", "abc")}, http.StatusBadRequest},
+		{alice, map[string]string{"Tus-Resumable": "0.2.2", "Upload-Length": "100", "Upload-Metadata": uploadMetadata("album_id", albumId, "title", "t")}, http.StatusPreconditionFailed},
+		{carol, map[string]string{"Upload-Length": "100", "Upload-Metadata": uploadMetadata("album_id", albumId, "title", "t")}, http.StatusForbidden},
+	}
+	for _, test := range tests {
+		w := callTus(t, test.user, "POST", "/api/v1/uploads", test.headers, nil)
+		if w.Code != test.status {
+			t.Errorf("ステータスが異なります.headers: %v, Expect: %v, Actual: %v", test.headers, test.status, w.Code)
+		}
+	}
+
+	location := createTestUpload(t, alice, 1000, uploadMetadata("album_id", albumId, "title", "t"))
+	if w := callTus(t, bob, "HEAD", location, nil, nil); w.Code != http.StatusNotFound {
+		t.Errorf("他のユーザーのアップロードを参照できました.Actual: %v", w.Code)
+	}
+	if w := callTus(t, alice, "PATCH", location, map[string]string{"Upload-Offset": "0", "Content-Type": "text/plain"}, strings.NewReader("x")); w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("Content-Typeの異なる断片が415になりませんでした.Actual: %v", w.Code)
+	}
+	// 動画でなければ最初の断片で断る
+	w := callTus(t, alice, "PATCH", location, map[string]string{"Upload-Offset": "0"}, strings.NewReader(strings.Repeat("<html>", 100)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("動画でないアップロードが400になりませんでした.Actual: %v", w.Code)
+	}
+	if files, _ := s.List(); len(files) != 0 {
+		t.Errorf("動画でないアップロードが保存されました.Actual: %v", files)
+	}
+
+	location = createTestUpload(t, alice, 1000, uploadMetadata("album_id", albumId, "title", "t"))
+	if w := callTus(t, alice, "PATCH", location, map[string]string{"Upload-Offset": "0"}, strings.NewReader(testUploadVideo()[:600])); w.Code != http.StatusNoContent {
+		t.Fatalf("断片を受け取れません.Actual: %v", w.Code)
+	}
+	if w := callTus(t, alice, "DELETE", location, nil, nil); w.Code != http.StatusNoContent {
+		t.Errorf("アップロードを取り消せません.Actual: %v", w.Code)
+	}
+	if files, _ := s.List(); len(files) != 0 {
+		t.Errorf("取り消したアップロードの断片が残っています.Actual: %v", files)
+	}
+}
+
+func TestRemoveExpiredUploads(t *testing.T) {
+	defer truncateTables()
+	s, cleanup := useTempStorage(t)
+	defer cleanup()
+
+	u := createTestUser(t, "alice", roleEditor)
+	m := &album{Title: "test title1"}
+	if err := testStore.SaveAlbum(m); err != nil {
+		t.Fatal(err)
+	}
+	location := createTestUpload(t, u, 1000, uploadMetadata("album_id", strconv.FormatInt(m.Id, 10), "title", "t"))
+	if w := callTus(t, u, "PATCH", location, map[string]string{"Upload-Offset": "0"}, strings.NewReader(testUploadVideo()[:600])); w.Code != http.StatusNoContent {
+		t.Fatalf("断片を受け取れません.Actual: %v", w.Code)
+	}
+	// 途中の断片は参照されていないファイルとして扱わない
+	issues, err := testStore.checkIntegrity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(issues) != 0 {
+		t.Errorf("アップロード途中の断片が問題として検出されました.Actual: %v", issues)
+	}
+
+	if n, err := testStore.RemoveExpiredUploads(time.Now()); err != nil || n != 0 {
+		t.Errorf("期限前のアップロードが削除されました.n: %v, err: %v", n, err)
+	}
+	if n, err := testStore.RemoveExpiredUploads(time.Now().Add(uploadExpiry + time.Minute)); err != nil || n != 1 {
+		t.Errorf("期限切れのアップロードが削除されません.n: %v, err: %v", n, err)
+	}
+	if w := callTus(t, u, "HEAD", location, nil, nil); w.Code != http.StatusNotFound {
+		t.Errorf("期限切れのアップロードが残っています.Actual: %v", w.Code)
+	}
+	if files, _ := s.List(); len(files) != 0 {
+		t.Errorf("期限切れのアップロードの断片が残っています.Actual: %v", files)
+	}
+}
+
+func TestUploadOptions(t *testing.T) {
+	defer truncateTables()
+	u := createTestUser(t, "alice", roleEditor)
+	w := callTus(t, u, "OPTIONS", "/api/v1/uploads", map[string]string{"Tus-Resumable": ""}, nil)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("ステータスが異なります.Actual: %v", w.Code)
+	}
+	if w.Header().Get("Tus-Version") != tusVersion || !strings.Contains(w.Header().Get("Tus-Extension"), "creation") {
+		t.Errorf("tusの情報が返されません.Actual: %v", w.Header())
+	}
+}
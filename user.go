@@ -0,0 +1,260 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	_ "github.com/mattn/go-sqlite3"
+	"golang.org/x/crypto/bcrypt"
+	"time"
+	"unicode/utf8"
+)
+
+// ログインセッションの有効期間
+const sessionLifetime = 7 * 24 * time.Hour
+
+type user struct {
+	Id           int64
+	Name         string
+	PasswordHash string
+	Role         string
+}
+
+func (s *Store) FindUserById(id int64) (*user, error) {
+	query := `
+		SELECT
+			name AS name,
+			password_hash AS password_hash,
+			role AS role
+		FROM
+			users
+		WHERE
+			id = ?
+	`
+	db := s.db
+
+	var name string
+	var hash string
+	var role string
+	if err := db.QueryRow(query, id).Scan(&name, &hash, &role); err != nil {
+		return nil, err
+	}
+	return &user{Id: id, Name: name, PasswordHash: hash, Role: role}, nil
+}
+
+func (s *Store) FindUserByName(name string) (*user, error) {
+	query := `
+		SELECT
+			id AS id,
+			password_hash AS password_hash,
+			role AS role
+		FROM
+			users
+		WHERE
+			name = ?
+	`
+	db := s.db
+
+	var id int64
+	var hash string
+	var role string
+	if err := db.QueryRow(query, name).Scan(&id, &hash, &role); err != nil {
+		return nil, err
+	}
+	return &user{Id: id, Name: name, PasswordHash: hash, Role: role}, nil
+}
+
+func (s *Store) FindUsers() ([]*user, error) {
+	query := `
+		SELECT
+			id AS id,
+			name AS name,
+			password_hash AS password_hash,
+			role AS role
+		FROM
+			users
+		ORDER BY
+			name
+	`
+	db := s.db
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ret := make([]*user, 0)
+	for rows.Next() {
+		m := &user{}
+		if err := rows.Scan(&m.Id, &m.Name, &m.PasswordHash, &m.Role); err != nil {
+			return nil, err
+		}
+		ret = append(ret, m)
+	}
+	return ret, nil
+}
+
+/*
+ * パスワードをbcryptでハッシュ化して設定する.
+ * DBへの保存はStore.SaveUserで行う.
+ */
+func (m *user) SetPassword(password string) error {
+	if utf8.RuneCountInString(password) < 8 {
+		return errors.New("password is too short")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	m.PasswordHash = string(hash)
+	return nil
+}
+
+func (m *user) Authenticate(password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(m.PasswordHash), []byte(password)) == nil
+}
+
+func (s *Store) createUser(m *user) error {
+	query := `
+		INSERT INTO users (name, password_hash, role) values(?, ?, ?)
+	`
+	db := s.db
+
+	id, err := db.Insert(query, m.Name, m.PasswordHash, m.Role)
+	if err != nil {
+		return err
+	}
+	m.Id = id
+	return nil
+}
+
+func (s *Store) updateUser(m *user) error {
+	query := `
+		UPDATE
+			users
+		SET
+			name = ?,
+			password_hash = ?,
+			role = ?
+		WHERE
+			id = ?
+	`
+	db := s.db
+
+	_, err := db.Exec(query, m.Name, m.PasswordHash, m.Role, m.Id)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (m *user) Validate() error {
+	if utf8.RuneCountInString(m.Name) == 0 {
+		return errors.New("name is nesecery.")
+	}
+	if utf8.RuneCountInString(m.Name) > 32 {
+		return errors.New("name is too long")
+	}
+	if m.PasswordHash == "" {
+		return errors.New("password is nesecery.")
+	}
+	if !validRole(m.Role) {
+		return errors.New("unknown role: " + m.Role)
+	}
+	return nil
+}
+
+func (s *Store) SaveUser(m *user) error {
+	if m.Role == "" {
+		m.Role = roleViewer
+	}
+	if err := m.Validate(); err != nil {
+		return err
+	}
+	_, err := s.FindUserById(m.Id)
+	if err == nil {
+		return s.updateUser(m)
+	} else {
+		return s.createUser(m)
+	}
+}
+
+type session struct {
+	Id        string
+	UserId    int64
+	ExpiresAt time.Time
+}
+
+func newSessionId() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (s *Store) CreateSession(userId int64) (*session, error) {
+	query := `
+		INSERT INTO sessions (id, user_id, expires_at) values(?, ?, ?)
+	`
+	id, err := newSessionId()
+	if err != nil {
+		return nil, err
+	}
+	m := &session{Id: id, UserId: userId, ExpiresAt: time.Now().Add(sessionLifetime)}
+
+	db := s.db
+
+	if _, err := db.Exec(query, m.Id, m.UserId, m.ExpiresAt.Unix()); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+/*
+ * 有効期限内のセッションを取得する.
+ * 期限切れのセッションはsql.ErrNoRowsとして扱う.
+ */
+func (s *Store) FindSessionById(id string) (*session, error) {
+	query := `
+		SELECT
+			user_id AS user_id,
+			expires_at AS expires_at
+		FROM
+			sessions
+		WHERE
+			id = ?
+			AND expires_at > ?
+	`
+	db := s.db
+
+	var userId int64
+	var expiresAt int64
+	if err := db.QueryRow(query, id, time.Now().Unix()).Scan(&userId, &expiresAt); err != nil {
+		return nil, err
+	}
+	return &session{Id: id, UserId: userId, ExpiresAt: time.Unix(expiresAt, 0)}, nil
+}
+
+/*
+ * セッションを破棄する.
+ * 併せて期限切れのセッションも削除しておく.
+ */
+func (s *Store) RemoveSession(m *session) error {
+	query := `
+		DELETE
+		FROM
+			sessions
+		WHERE
+			id = ?
+			OR expires_at <= ?
+	`
+	db := s.db
+
+	_, err := db.Exec(query, m.Id, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	return nil
+}
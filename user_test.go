@@ -0,0 +1,130 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestUserCreateBySave(t *testing.T) {
+	defer truncateTables()
+
+	u := &user{Name: "alice"}
+	if err := u.SetPassword("correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	if err := testStore.SaveUser(u); err != nil {
+		t.Fatal(err)
+	}
+	res, err := testStore.FindUserByName("alice")
+	if err != nil {
+		t.Fatal("Save関数で作成したユーザーが見つかりませんでした.", err)
+	}
+	if res.Id != u.Id {
+		t.Errorf("FindUserByNameで取得したユーザーのIDが一致しませんでした.Expect: %v, Actual: %v", u.Id, res.Id)
+	}
+	if res.PasswordHash == "correct horse" {
+		t.Errorf("パスワードが平文のまま保存されています.")
+	}
+	if !res.Authenticate("correct horse") {
+		t.Errorf("正しいパスワードで認証できませんでした.")
+	}
+	if res.Authenticate("wrong horse") {
+		t.Errorf("誤ったパスワードで認証できてしまいました.")
+	}
+}
+
+func TestUserValidate(t *testing.T) {
+	defer truncateTables()
+
+	u := &user{Name: "bob"}
+	if err := u.SetPassword("short"); err == nil {
+		t.Errorf("8文字未満のパスワードが設定できてしまいました.")
+	}
+	if err := testStore.SaveUser(u); err == nil {
+		t.Errorf("パスワード未設定のユーザーが登録できてしまいました.")
+	}
+	u = &user{Name: ""}
+	u.SetPassword("correct horse")
+	if err := testStore.SaveUser(u); err == nil {
+		t.Errorf("必須入力のはずのユーザー名に空文字での登録を行うことができました")
+	}
+}
+
+func TestSession(t *testing.T) {
+	defer truncateTables()
+
+	u := &user{Name: "alice"}
+	u.SetPassword("correct horse")
+	if err := testStore.SaveUser(u); err != nil {
+		t.Fatal(err)
+	}
+	s, err := testStore.CreateSession(u.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found, err := testStore.FindSessionById(s.Id)
+	if err != nil {
+		t.Fatal("CreateSessionで作成したセッションが見つかりませんでした.", err)
+	}
+	if found.UserId != u.Id {
+		t.Errorf("セッションのユーザーIDが一致しませんでした.Expect: %v, Actual: %v", u.Id, found.UserId)
+	}
+	if err := testStore.RemoveSession(found); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testStore.FindSessionById(s.Id); err == nil {
+		t.Errorf("削除したはずのセッションが残っています.")
+	}
+}
+
+func TestSessionCookieSignature(t *testing.T) {
+	sessionKey = []byte("0123456789abcdef0123456789abcdef")
+
+	value := signSessionId("abc")
+	id, err := verifySessionCookie(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "abc" {
+		t.Errorf("Cookieから取り出したセッションIDが一致しませんでした.Expect: abc, Actual: %v", id)
+	}
+	if _, err := verifySessionCookie("abd" + value[3:]); err == nil {
+		t.Errorf("改ざんされたCookieが検証を通過しました.")
+	}
+}
+
+func TestUserRole(t *testing.T) {
+	defer truncateTables()
+
+	u := &user{Name: "carol"}
+	u.SetPassword("correct horse")
+	if err := testStore.SaveUser(u); err != nil {
+		t.Fatal(err)
+	}
+	res, err := testStore.FindUserById(u.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Role != roleViewer {
+		t.Errorf("権限未指定のユーザーがviewerになっていません.Actual: %v", res.Role)
+	}
+	if res.Can(permEdit) {
+		t.Errorf("viewerに編集権限があります.")
+	}
+
+	res.Role = roleEditor
+	if err := testStore.SaveUser(res); err != nil {
+		t.Fatal(err)
+	}
+	res, err = testStore.FindUserById(u.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Can(permEdit) || res.Can(permManageUsers) {
+		t.Errorf("editorの権限が正しくありません.")
+	}
+
+	res.Role = "superuser"
+	if err := testStore.SaveUser(res); err == nil {
+		t.Errorf("存在しない権限で保存できてしまいました.")
+	}
+}
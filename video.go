@@ -0,0 +1,453 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	_ "github.com/mattn/go-sqlite3"
+	"time"
+	"unicode/utf8"
+)
+
+/*
+ * ページにアップロードされた動画の版.
+ * 現在の版はpages.filepathが指すもので, 差し替えられた版は差し替えられた日時を記録して以前の版として残す.
+ * 以前の版のファイルもページを削除するまで残す.
+ */
+type pageVideo struct {
+	Id           int64
+	PageId       int64
+	MoviePath    string
+	MimeType     string
+	Thumbnail    string
+	UserId       int64 // 登録者が不明な場合は0
+	UploaderName string
+	Note         string
+	CreatedAt    time.Time
+	// 差し替えられた日時. 現在の版はゼロ
+	RetiredAt time.Time
+	// 動画の長さや解像度など. まだ調べていなければnil
+	Media *mediaInfo
+	// ブラウザ向けの変換の状態と, 変換後の動画. RenditionsはSelectVersionで読み込む
+	Status     string
+	Renditions []*rendition
+	// HLSのマスタープレイリスト. 無ければ空
+	StreamPath string
+	// ページの現在の版か
+	Current bool
+}
+
+func (m *pageVideo) Validate() error {
+	if utf8.RuneCountInString(m.Note) > 256 {
+		return errors.New("note is too long")
+	}
+	return nil
+}
+
+const pageVideoColumns = `
+			video.id AS id,
+			video.page_id AS page_id,
+			video.filepath AS filepath,
+			video.mime_type AS mime_type,
+			video.thumbnail AS thumbnail,
+			video.user_id AS user_id,
+			uploader.name AS uploader_name,
+			video.note AS note,
+			video.created_at AS created_at,
+			video.retired_at AS retired_at,
+			video.status AS status,
+			video.stream_path AS stream_path,
+			video.duration_ms AS duration_ms,
+			video.width AS width,
+			video.height AS height,
+			video.video_codec AS video_codec,
+			video.audio_codec AS audio_codec,
+			video.bitrate AS bitrate,
+			video.container AS container,
+			video.file_size AS file_size
+		FROM
+			page_videos video
+			LEFT JOIN users uploader ON uploader.id = video.user_id
+`
+
+func scanPageVideo(row interface {
+	Scan(dest ...interface{}) error
+}) (*pageVideo, error) {
+	m := &pageVideo{}
+	var mimeType sql.NullString
+	var thumbnail sql.NullString
+	var userId sql.NullInt64
+	var uploaderName sql.NullString
+	var createdAt int64
+	var retiredAt sql.NullInt64
+	var streamPath sql.NullString
+	var media nullMediaInfo
+	dest := append([]interface{}{&m.Id, &m.PageId, &m.MoviePath, &mimeType, &thumbnail, &userId, &uploaderName, &m.Note, &createdAt, &retiredAt, &m.Status, &streamPath}, media.dest()...)
+	if err := row.Scan(dest...); err != nil {
+		return nil, err
+	}
+	if retiredAt.Valid {
+		m.RetiredAt = time.Unix(retiredAt.Int64, 0)
+	} else {
+		m.Current = true
+	}
+	m.StreamPath = streamPath.String
+	m.Media = media.value()
+	m.MimeType = videoMimeType(m.MoviePath, mimeType)
+	m.Thumbnail = thumbnail.String
+	m.UserId = userId.Int64
+	m.UploaderName = uploaderName.String
+	m.CreatedAt = time.Unix(createdAt, 0)
+	return m, nil
+}
+
+/*
+ * ページの動画の版を新しい順に返す.
+ */
+func (s *Store) FindPageVideosByPageId(pageId int64) ([]*pageVideo, error) {
+	query := `
+		SELECT` + pageVideoColumns + `
+		WHERE
+			video.page_id = ?
+		ORDER BY
+			video.id DESC
+	`
+	db := s.db
+
+	rows, err := db.Query(query, pageId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ret := make([]*pageVideo, 0)
+	for rows.Next() {
+		m, err := scanPageVideo(rows)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, m)
+	}
+	return ret, nil
+}
+
+func (s *Store) FindPageVideoById(videoId int64) (*pageVideo, error) {
+	query := `
+		SELECT` + pageVideoColumns + `
+		WHERE
+			video.id = ?
+	`
+	db := s.db
+
+	return scanPageVideo(db.QueryRow(query, videoId))
+}
+
+/*
+ * ページに新しい版の動画を登録し, 現在の版にする. それまでの現在の版は以前の版として残す.
+ * 版の記録が始まる前から登録されていた動画は, 登録者不明の版として記録してから差し替える.
+ * 新しい版のサムネイルと動画の情報は後からSetThumbnail, SetMediaInfoで登録する.
+ * 容量の計算のため, ファイルの大きさだけは登録時に記録する.
+ */
+func (s *Store) AddPageVideo(m *page, moviePath string, userId int64, note string) (*pageVideo, error) {
+	db := s.db
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	v, err := addPageVideo(tx, m, moviePath, userId, note)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func addPageVideo(tx *storeTx, m *page, moviePath string, userId int64, note string) (*pageVideo, error) {
+	v := &pageVideo{PageId: m.Id, MoviePath: moviePath, MimeType: contentTypeOf(moviePath), UserId: userId, Note: note, Current: true}
+	if err := v.Validate(); err != nil {
+		return nil, err
+	}
+	insertQuery := `
+		INSERT INTO page_videos (page_id, filepath, mime_type, user_id, note, file_size, created_at) values(?, ?, ?, ?, ?, ?, ?)
+	`
+	updateQuery := `
+		UPDATE
+			pages
+		SET
+			filepath = ?,
+			mime_type = ?,
+			thumbnail = NULL,
+			duration_ms = NULL,
+			width = NULL,
+			height = NULL,
+			video_codec = NULL,
+			audio_codec = NULL,
+			bitrate = NULL,
+			container = NULL,
+			file_size = NULL
+		WHERE
+			id = ?
+	`
+	now := time.Now().Unix()
+	if err := insertLegacyPageVideos(tx, m.Id, now); err != nil {
+		return nil, err
+	}
+	if err := retirePageVideos(tx, m.Id, now); err != nil {
+		return nil, err
+	}
+	uploader := sql.NullInt64{Int64: userId, Valid: userId != 0}
+	var size int64
+	if info, err := movieStorage.Stat(moviePath); err == nil {
+		size = info.Size
+	}
+	id, err := tx.Insert(insertQuery, m.Id, moviePath, v.MimeType, uploader, note, size, now)
+	if err != nil {
+		return nil, err
+	}
+	v.Id = id
+	if _, err := tx.Exec(updateQuery, moviePath, v.MimeType, m.Id); err != nil {
+		return nil, err
+	}
+	v.CreatedAt = time.Unix(now, 0)
+	m.MoviePath = moviePath
+	m.MimeType = v.MimeType
+	m.Thumbnail = ""
+	m.Media = nil
+	return v, nil
+}
+
+/*
+ * 版の記録が始まる前から登録されていた現在の動画を, 登録者不明の版として記録する.
+ * pageIdが0の場合は全てのページが対象.
+ */
+func insertLegacyPageVideos(tx *storeTx, pageId int64, now int64) error {
+	query := `
+		INSERT INTO page_videos (page_id, filepath, mime_type, thumbnail, user_id, note, created_at, ` + mediaInfoColumns + `)
+		SELECT
+			id, filepath, mime_type, thumbnail, CAST(NULL AS BIGINT), '', CAST(? AS BIGINT), ` + mediaInfoColumns + `
+		FROM
+			pages page
+		WHERE
+			(? = 0 OR page.id = ?)
+			AND page.filepath IS NOT NULL
+			AND page.filepath <> ''
+			AND NOT EXISTS (
+				SELECT 1 FROM page_videos video WHERE video.page_id = page.id AND video.filepath = page.filepath
+			)
+	`
+	_, err := tx.Exec(query, now, pageId, pageId)
+	return err
+}
+
+/*
+ * 全てのページについて, 版として記録されていない現在の動画を記録する.
+ */
+func (s *Store) RecordLegacyPageVideos() error {
+	db := s.db
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := insertLegacyPageVideos(tx, 0, time.Now().Unix()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+/*
+ * ページを以前の版の動画に戻す.
+ * 他のページの版を指定した場合はsql.ErrNoRowsを返す.
+ */
+func (s *Store) RevertPageVideo(m *page, videoId int64) error {
+	selectQuery := `
+		SELECT
+			filepath AS filepath,
+			mime_type AS mime_type,
+			thumbnail AS thumbnail,
+			` + mediaInfoColumns + `
+		FROM
+			page_videos
+		WHERE
+			id = ?
+			AND page_id = ?
+	`
+	updateQuery := `
+		UPDATE
+			pages
+		SET
+			filepath = ?,
+			mime_type = ?,
+			thumbnail = ?,
+			duration_ms = ?,
+			width = ?,
+			height = ?,
+			video_codec = ?,
+			audio_codec = ?,
+			bitrate = ?,
+			container = ?,
+			file_size = ?
+		WHERE
+			id = ?
+	`
+	restoreQuery := `
+		UPDATE
+			page_videos
+		SET
+			retired_at = NULL
+		WHERE
+			id = ?
+	`
+	db := s.db
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var moviePath string
+	var mimeType sql.NullString
+	var thumbnail sql.NullString
+	var media nullMediaInfo
+	if err := tx.QueryRow(selectQuery, videoId, m.Id).Scan(append([]interface{}{&moviePath, &mimeType, &thumbnail}, media.dest()...)...); err != nil {
+		return err
+	}
+	args := []interface{}{moviePath, mimeType, thumbnail, media.DurationMs, media.Width, media.Height, media.VideoCodec, media.AudioCodec, media.Bitrate, media.Container, media.FileSize, m.Id}
+	if _, err := tx.Exec(updateQuery, args...); err != nil {
+		return err
+	}
+	if err := retirePageVideos(tx, m.Id, time.Now().Unix()); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(restoreQuery, videoId); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	m.MoviePath = moviePath
+	m.MimeType = videoMimeType(moviePath, mimeType)
+	m.Thumbnail = thumbnail.String
+	m.Media = media.value()
+	return nil
+}
+
+/*
+ * ページの動画moviePathのサムネイルを登録する.
+ * moviePathが現在の版であればページのサムネイルにもなる.
+ */
+func (s *Store) SetPageThumbnail(m *page, moviePath string, thumbnail string) error {
+	queries := []string{`
+		UPDATE
+			page_videos
+		SET
+			thumbnail = ?
+		WHERE
+			page_id = ?
+			AND filepath = ?
+	`, `
+		UPDATE
+			pages
+		SET
+			thumbnail = ?
+		WHERE
+			id = ?
+			AND filepath = ?
+	`}
+	db := s.db
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, query := range queries {
+		if _, err := tx.Exec(query, thumbnail, m.Id, moviePath); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if m.MoviePath == moviePath {
+		m.Thumbnail = thumbnail
+	}
+	return nil
+}
+
+/*
+ * ページの現在の版を, nowに差し替えられた以前の版にする.
+ */
+func retirePageVideos(tx *storeTx, pageId int64, now int64) error {
+	query := `
+		UPDATE
+			page_videos
+		SET
+			retired_at = ?
+		WHERE
+			page_id = ?
+			AND retired_at IS NULL
+	`
+	_, err := tx.Exec(query, now, pageId)
+	return err
+}
+
+/*
+ * ページの動画moviePathの長さや解像度などを登録する.
+ * moviePathが現在の版であればページにも登録する.
+ */
+func (s *Store) SetPageMediaInfo(m *page, moviePath string, info *mediaInfo) error {
+	set := `
+		SET
+			duration_ms = ?,
+			width = ?,
+			height = ?,
+			video_codec = ?,
+			audio_codec = ?,
+			bitrate = ?,
+			container = ?,
+			file_size = ?
+	`
+	queries := []string{`
+		UPDATE
+			page_videos` + set + `
+		WHERE
+			page_id = ?
+			AND filepath = ?
+	`, `
+		UPDATE
+			pages` + set + `
+		WHERE
+			id = ?
+			AND filepath = ?
+	`}
+	db := s.db
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	args := append(info.values(), m.Id, moviePath)
+	for _, query := range queries {
+		if _, err := tx.Exec(query, args...); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if m.MoviePath == moviePath {
+		m.Media = info
+	}
+	return nil
+}
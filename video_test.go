@@ -0,0 +1,147 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestPageAddVideo(t *testing.T) {
+	defer truncateTables()
+	s, cleanup := useTempStorage(t)
+	defer cleanup()
+
+	u := createTestUser(t, "alice", roleEditor)
+	m := &album{Title: "test title1"}
+	if err := testStore.SaveAlbum(m); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{"legacy.mp4", "v2.mp4", "v3.mp4"} {
+		if _, err := s.Put(file, strings.NewReader("movie")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 版の記録が始まる前に登録されたページ
+	p := &page{AlbumId: m.Id, Title: "test page title", Description: "desc", MoviePath: "legacy.mp4"}
+	if err := testStore.SavePage(p); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := testStore.AddPageVideo(p, "v2.mp4", u.Id, "UI変更のため撮り直し"); err != nil {
+		t.Fatal(err)
+	}
+	v3, err := testStore.AddPageVideo(p, "v3.mp4", u.Id, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	videos, err := testStore.FindPageVideosByPageId(p.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(videos) != 3 {
+		t.Fatalf("動画の版の数が異なります.Expect: 3, Actual: %v", len(videos))
+	}
+	if videos[0].Id != v3.Id || !videos[0].Current {
+		t.Errorf("最後に登録した版が現在の版になっていません.Actual: %v", videos[0])
+	}
+	if videos[1].MoviePath != "v2.mp4" || videos[1].UploaderName != "alice" || videos[1].Note != "UI変更のため撮り直し" || videos[1].Current {
+		t.Errorf("以前の版の登録者やメモが記録されていません.Actual: %v", videos[1])
+	}
+	if videos[2].MoviePath != "legacy.mp4" || videos[2].UserId != 0 {
+		t.Errorf("元から登録されていた動画が登録者不明の版として残っていません.Actual: %v", videos[2])
+	}
+
+	// 以前の版に戻す
+	if err := testStore.RevertPageVideo(p, videos[2].Id); err != nil {
+		t.Fatal(err)
+	}
+	found, err := testStore.FindPageById(p.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.MoviePath != "legacy.mp4" {
+		t.Errorf("以前の版に戻っていません.Actual: %v", found.MoviePath)
+	}
+	if readable, err := testStore.canReadMovie("v3.mp4", nil); err != nil || !readable {
+		t.Errorf("以前の版の動画を参照できません.err: %v", err)
+	}
+
+	// ページの削除で全ての版のファイルが消える
+	if err := testStore.RemovePage(p); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{"legacy.mp4", "v2.mp4", "v3.mp4"} {
+		if _, err := s.Stat(file); !os.IsNotExist(err) {
+			t.Errorf("削除したページの動画ファイルが残っています.file: %v, err: %v", file, err)
+		}
+	}
+}
+
+func TestPageRevertVideoOfOtherPage(t *testing.T) {
+	defer truncateTables()
+
+	m := &album{Title: "test title1"}
+	if err := testStore.SaveAlbum(m); err != nil {
+		t.Fatal(err)
+	}
+	p1 := &page{AlbumId: m.Id, Title: "test page title1", Description: "desc"}
+	p2 := &page{AlbumId: m.Id, Title: "test page title2", Description: "desc"}
+	for _, p := range []*page{p1, p2} {
+		if err := testStore.SavePage(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	v, err := testStore.AddPageVideo(p1, "a.mp4", 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testStore.RevertPageVideo(p2, v.Id); err == nil {
+		t.Errorf("他のページの版に戻すことができました.")
+	}
+}
+
+func TestPageCurrentVersionOfSameFile(t *testing.T) {
+	defer truncateTables()
+	s, cleanup := useTempStorage(t)
+	defer cleanup()
+
+	m := &album{Title: "test title1"}
+	if err := testStore.SaveAlbum(m); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{"a.mp4", "b.mp4"} {
+		if _, err := s.Put(file, strings.NewReader("movie")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p := &page{AlbumId: m.Id, Title: "test page title", Description: "desc"}
+	if err := testStore.SavePage(p); err != nil {
+		t.Fatal(err)
+	}
+	// 同じ内容の動画を登録し直すと, 以前の版と同じファイルを指す
+	old, err := testStore.AddPageVideo(p, "a.mp4", 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testStore.AddPageVideo(p, "b.mp4", 0, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testStore.AddPageVideo(p, "a.mp4", 0, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := testStore.setVideoStreams(old.Id, "old.m3u8", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := testStore.setVideoStatus(old.Id, videoProcessing); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := testStore.FindPageById(p.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.StreamPath != "" || found.Processing {
+		t.Errorf("以前の版の変換の状態が現在の版として読み込まれました.StreamPath: %v, Processing: %v", found.StreamPath, found.Processing)
+	}
+}